@@ -0,0 +1,372 @@
+// Command protogen writes TypeScript declarations and a JSON Schema for the
+// wire protocol, generated from protocol.WireTypes. Run it through
+// go generate ./internal/protocol.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"skepsi/backend/internal/protocol"
+)
+
+const header = "Code generated by protogen from backend/internal/protocol. DO NOT EDIT."
+
+type output struct {
+	path     string
+	generate func() ([]byte, error)
+}
+
+// outputs are relative to the backend module root.
+var outputs = []output{
+	{"internal/protocol/protocol.schema.json", generateSchema},
+	{"../frontend/protocol.gen.ts", generateTS},
+	{"../client/src/protocol.gen.ts", generateTS},
+}
+
+func main() {
+	root := flag.String("root", ".", "backend module root")
+	flag.Parse()
+	for _, out := range outputs {
+		data, err := out.generate()
+		if err != nil {
+			slog.Error("protogen failed", "output", out.path, "error", err)
+			os.Exit(1)
+		}
+		if err := os.WriteFile(filepath.Join(*root, out.path), data, 0o644); err != nil {
+			slog.Error("protogen failed", "output", out.path, "error", err)
+			os.Exit(1)
+		}
+	}
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+type field struct {
+	name     string
+	typ      reflect.Type
+	optional bool
+	tags     []string
+	enum     string
+}
+
+func fieldsOf(wt protocol.WireType) ([]field, error) {
+	var out []field
+	t := wt.Type
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		if sf.Anonymous {
+			return nil, fmt.Errorf("%s.%s: embedded fields are not supported", t.Name(), sf.Name)
+		}
+		name, opts, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		f := field{name: name, typ: sf.Type, optional: strings.Contains(opts, "omitempty"), enum: sf.Tag.Get("wire")}
+		if _, ok := protocol.WireEnums[f.enum]; f.enum != "" && !ok {
+			return nil, fmt.Errorf("%s.%s: unknown wire enum %q", t.Name(), sf.Name, f.enum)
+		}
+		if name == "type" && len(wt.Tags) > 0 {
+			f.tags = wt.Tags
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+func registered(t reflect.Type) bool {
+	for _, wt := range protocol.WireTypes {
+		if wt.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedEnumNames() []string {
+	names := make([]string, 0, len(protocol.WireEnums))
+	for name := range protocol.WireEnums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func tsType(t reflect.Type) (string, error) {
+	if t == rawMessageType {
+		return "unknown", nil
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return tsType(t.Elem())
+	case reflect.String:
+		return "string", nil
+	case reflect.Bool:
+		return "boolean", nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number", nil
+	case reflect.Slice:
+		elem, err := tsType(t.Elem())
+		if err != nil {
+			return "", err
+		}
+		if strings.Contains(elem, " ") {
+			elem = "(" + elem + ")"
+		}
+		return elem + "[]", nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return "", fmt.Errorf("map key %s is not a string", t.Key())
+		}
+		elem, err := tsType(t.Elem())
+		if err != nil {
+			return "", err
+		}
+		return "Record<string, " + elem + ">", nil
+	case reflect.Struct:
+		if !registered(t) {
+			return "", fmt.Errorf("%s is used on the wire but missing from protocol.WireTypes", t)
+		}
+		return t.Name(), nil
+	}
+	return "", fmt.Errorf("unsupported type %s", t)
+}
+
+func tsUnion(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = strconv.Quote(v)
+	}
+	return strings.Join(quoted, " | ")
+}
+
+func generateTS() ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// %s\n\n", header)
+	fmt.Fprintf(&b, "export const PROTOCOL_VERSION = %d;\n", protocol.ProtocolVersion)
+	fmt.Fprintf(&b, "export const MIN_PROTOCOL_VERSION = %d;\n", protocol.MinProtocolVersion)
+	for _, name := range sortedEnumNames() {
+		fmt.Fprintf(&b, "\nexport type %s = %s;\n", name, tsUnion(protocol.WireEnums[name]))
+	}
+	var fromClient, fromServer []string
+	for _, wt := range protocol.WireTypes {
+		fields, err := fieldsOf(wt)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&b, "\nexport type %s = {\n", wt.Type.Name())
+		for _, f := range fields {
+			var typ string
+			switch {
+			case f.tags != nil:
+				typ = tsUnion(f.tags)
+			case f.enum != "" && f.typ.Kind() == reflect.Slice:
+				typ = f.enum + "[]"
+			case f.enum != "":
+				typ = f.enum
+			default:
+				if typ, err = tsType(f.typ); err != nil {
+					return nil, fmt.Errorf("%s.%s: %w", wt.Type.Name(), f.name, err)
+				}
+			}
+			opt := ""
+			if f.optional {
+				opt = "?"
+			} else if f.typ.Kind() == reflect.Pointer {
+				typ += " | null"
+			}
+			fmt.Fprintf(&b, "  %s%s: %s;\n", f.name, opt, typ)
+		}
+		b.WriteString("};\n")
+		if wt.FromClient {
+			fromClient = append(fromClient, wt.Type.Name())
+		}
+		if wt.FromServer {
+			fromServer = append(fromServer, wt.Type.Name())
+		}
+	}
+	fmt.Fprintf(&b, "\nexport type ClientMessage =\n  | %s;\n", strings.Join(fromClient, "\n  | "))
+	fmt.Fprintf(&b, "\nexport type ServerMessage =\n  | %s;\n", strings.Join(fromServer, "\n  | "))
+	return b.Bytes(), nil
+}
+
+// object is a JSON object that keeps its keys in insertion order, so schema
+// properties follow the Go field order.
+type object []struct {
+	key   string
+	value interface{}
+}
+
+func (o *object) set(key string, value interface{}) {
+	*o = append(*o, struct {
+		key   string
+		value interface{}
+	}{key, value})
+}
+
+func (o object) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, kv := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(kv.key)
+		b.Write(k)
+		b.WriteByte(':')
+		v, err := json.Marshal(kv.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+func ref(name string) object {
+	var o object
+	o.set("$ref", "#/$defs/"+name)
+	return o
+}
+
+func schemaType(t reflect.Type) (object, error) {
+	var o object
+	if t == rawMessageType {
+		return object{}, nil
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaType(t.Elem())
+	case reflect.String:
+		o.set("type", "string")
+	case reflect.Bool:
+		o.set("type", "boolean")
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		o.set("type", "integer")
+	case reflect.Float32, reflect.Float64:
+		o.set("type", "number")
+	case reflect.Slice:
+		items, err := schemaType(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		o.set("type", "array")
+		o.set("items", items)
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("map key %s is not a string", t.Key())
+		}
+		values, err := schemaType(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		o.set("type", "object")
+		o.set("additionalProperties", values)
+	case reflect.Struct:
+		if !registered(t) {
+			return nil, fmt.Errorf("%s is used on the wire but missing from protocol.WireTypes", t)
+		}
+		return ref(t.Name()), nil
+	default:
+		return nil, fmt.Errorf("unsupported type %s", t)
+	}
+	return o, nil
+}
+
+func oneOf(names []string) object {
+	refs := make([]object, len(names))
+	for i, n := range names {
+		refs[i] = ref(n)
+	}
+	var o object
+	o.set("oneOf", refs)
+	return o
+}
+
+func generateSchema() ([]byte, error) {
+	var defs object
+	for _, name := range sortedEnumNames() {
+		var e object
+		e.set("enum", protocol.WireEnums[name])
+		defs.set(name, e)
+	}
+	var fromClient, fromServer []string
+	for _, wt := range protocol.WireTypes {
+		fields, err := fieldsOf(wt)
+		if err != nil {
+			return nil, err
+		}
+		var props object
+		required := []string{}
+		for _, f := range fields {
+			var ps object
+			switch {
+			case f.tags != nil:
+				ps.set("enum", f.tags)
+			case f.enum != "" && f.typ.Kind() == reflect.Slice:
+				ps.set("type", "array")
+				ps.set("items", ref(f.enum))
+			case f.enum != "":
+				ps = ref(f.enum)
+			default:
+				if ps, err = schemaType(f.typ); err != nil {
+					return nil, fmt.Errorf("%s.%s: %w", wt.Type.Name(), f.name, err)
+				}
+			}
+			if !f.optional && f.typ.Kind() == reflect.Pointer {
+				var nullable object
+				nullable.set("anyOf", []object{ps, {{"type", "null"}}})
+				ps = nullable
+			}
+			props.set(f.name, ps)
+			if !f.optional {
+				required = append(required, f.name)
+			}
+		}
+		var def object
+		def.set("type", "object")
+		def.set("properties", props)
+		def.set("required", required)
+		defs.set(wt.Type.Name(), def)
+		if wt.FromClient {
+			fromClient = append(fromClient, wt.Type.Name())
+		}
+		if wt.FromServer {
+			fromServer = append(fromServer, wt.Type.Name())
+		}
+	}
+	defs.set("ClientMessage", oneOf(fromClient))
+	defs.set("ServerMessage", oneOf(fromServer))
+
+	var root object
+	root.set("$schema", "https://json-schema.org/draft/2020-12/schema")
+	root.set("title", "Skepsi wire protocol")
+	root.set("description", header)
+	root.set("x-protocol-version", protocol.ProtocolVersion)
+	root.set("anyOf", []object{ref("ClientMessage"), ref("ServerMessage")})
+	root.set("$defs", defs)
+	data, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
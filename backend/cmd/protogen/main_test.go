@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGeneratedFilesUpToDate(t *testing.T) {
+	for _, out := range outputs {
+		want, err := out.generate()
+		if err != nil {
+			t.Fatalf("%s: %v", out.path, err)
+		}
+		got, err := os.ReadFile(filepath.Join("..", "..", out.path))
+		if err != nil {
+			t.Fatalf("%s: %v", out.path, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s is stale; run go generate ./internal/protocol", out.path)
+		}
+	}
+}
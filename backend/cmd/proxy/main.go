@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -12,6 +14,7 @@ import (
 	"syscall"
 	"time"
 
+	"skepsi/backend/internal/protocol"
 	"skepsi/backend/internal/router"
 	"skepsi/backend/internal/validate"
 
@@ -26,6 +29,7 @@ const (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    protocol.Subprotocols(),
 	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
@@ -58,7 +62,32 @@ func main() {
 		addr = ":" + p
 	}
 
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/ws", wsHandler(sel, &healthyMu, &healthyBackends))
+
+	server := &http.Server{Addr: addr, Handler: nil}
+	go func() {
+		slog.Info("proxy listening", "addr", addr, "backends", allBackends)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("proxy error", "error", err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	slog.Info("proxy shutting down")
+	cancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("proxy shutdown error", "error", err)
+	}
+	slog.Info("proxy stopped")
+}
+
+// wsHandler proxies a client's socket to the backend that owns its doc.
+func wsHandler(sel *router.Selector, healthyMu *sync.RWMutex, healthyBackends *[]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		doc := r.URL.Query().Get("doc")
 		if err := validate.DocID(doc); err != nil {
 			http.Error(w, "invalid or missing doc query parameter: "+err.Error(), http.StatusBadRequest)
@@ -81,11 +110,25 @@ func main() {
 		}
 		defer clientConn.Close()
 
-		backendConn, _, err := websocket.DefaultDialer.Dial(backendWSURL, nil)
+		backendHeader := http.Header{}
+		if sp := clientConn.Subprotocol(); sp != "" {
+			backendHeader.Set("Sec-WebSocket-Protocol", sp)
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			backendHeader.Set("X-Forwarded-For", host)
+		}
+		backendConn, resp, err := websocket.DefaultDialer.Dial(backendWSURL, backendHeader)
+		if err != nil && resp != nil && resp.StatusCode == http.StatusServiceUnavailable {
+			// The doc's backend is full. Another backend would split the
+			// doc's room, so the client is asked to come back later instead.
+			slog.Info("proxy backend full", "doc", doc, "backend", base)
+			_ = clientConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "server is full"))
+			return
+		}
 		if err != nil {
 			healthyMu.RLock()
-			others := make([]string, 0, len(healthyBackends))
-			for _, b := range healthyBackends {
+			others := make([]string, 0, len(*healthyBackends))
+			for _, b := range *healthyBackends {
 				if b != base {
 					others = append(others, b)
 				}
@@ -97,7 +140,7 @@ func main() {
 					retryURL += "?" + r.URL.RawQuery
 				}
 				var retryErr error
-				backendConn, _, retryErr = websocket.DefaultDialer.Dial(retryURL, nil)
+				backendConn, _, retryErr = websocket.DefaultDialer.Dial(retryURL, backendHeader)
 				if retryErr == nil {
 					err = nil
 					slog.Info("proxy dial retry succeeded", "doc", doc, "backend", other)
@@ -112,47 +155,28 @@ func main() {
 		}
 		defer backendConn.Close()
 
-		go func() {
-			for {
-				mt, msg, err := clientConn.ReadMessage()
-				if err != nil {
-					return
-				}
-				if err := backendConn.WriteMessage(mt, msg); err != nil {
-					return
-				}
-			}
-		}()
-		for {
-			mt, msg, err := backendConn.ReadMessage()
-			if err != nil {
-				return
-			}
-			if err := clientConn.WriteMessage(mt, msg); err != nil {
-				return
+		go relay(backendConn, clientConn)
+		relay(clientConn, backendConn)
+	}
+}
+
+// relay copies frames from src to dst until src closes. A close frame from src
+// is passed on with its code and text, so the client learns why the backend
+// hung up, e.g. an unsupported protocol version or rate limiting.
+func relay(dst, src *websocket.Conn) {
+	for {
+		mt, msg, err := src.ReadMessage()
+		if err != nil {
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) && ce.Code != websocket.CloseAbnormalClosure {
+				_ = dst.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(ce.Code, ce.Text))
 			}
+			return
 		}
-	})
-
-	server := &http.Server{Addr: addr, Handler: nil}
-	go func() {
-		slog.Info("proxy listening", "addr", addr, "backends", allBackends)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			slog.Error("proxy error", "error", err)
+		if err := dst.WriteMessage(mt, msg); err != nil {
+			return
 		}
-	}()
-
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	<-sig
-	slog.Info("proxy shutting down")
-	cancel()
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer shutdownCancel()
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		slog.Error("proxy shutdown error", "error", err)
 	}
-	slog.Info("proxy stopped")
 }
 
 func runHealthChecks(ctx context.Context, allBackends []string, sel *router.Selector, healthyMu *sync.RWMutex, healthyBackends *[]string) {
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"skepsi/backend/internal/protocol"
+	"skepsi/backend/internal/router"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestBackendCloseReachesClient has the backend turn a client away for an
+// unsupported version. The client must see the backend's close code, not an
+// abnormal closure.
+func TestBackendCloseReachesClient(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msg := websocket.FormatCloseMessage(protocol.CloseUnsupportedVersion, "unsupported protocol version")
+		_ = conn.WriteMessage(websocket.CloseMessage, msg)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+
+	var healthyMu sync.RWMutex
+	healthy := []string{backend.URL}
+	proxy := httptest.NewServer(wsHandler(router.NewSelector(healthy), &healthyMu, &healthy))
+	defer proxy.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+proxy.URL[4:]+"/ws?doc=d", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, _, err = client.ReadMessage()
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != protocol.CloseUnsupportedVersion || ce.Text != "unsupported protocol version" {
+		t.Errorf("client should get the backend's close frame, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"skepsi/backend/internal/logger"
+	"skepsi/backend/internal/room"
+	"skepsi/backend/internal/store"
+	"skepsi/backend/internal/wal"
+	"skepsi/backend/internal/ws"
+)
+
+// envDuration reads a Go duration such as "50ms" from the environment. A value
+// that does not parse stops the server rather than being silently ignored.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logger.Log.Error("invalid_config", "name", name, "value", v, "error", err)
+		os.Exit(1)
+	}
+	return d
+}
+
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		logger.Log.Error("invalid_config", "name", name, "value", v, "error", err)
+		os.Exit(1)
+	}
+	return n
+}
+
+// envSlowConsumer reads SLOW_CONSUMER, which is "resync" or "drop".
+func envSlowConsumer() room.SlowConsumerPolicy {
+	p := room.SlowConsumerPolicy(os.Getenv("SLOW_CONSUMER"))
+	switch p {
+	case "":
+		return room.SlowConsumerResync
+	case room.SlowConsumerResync, room.SlowConsumerDrop:
+		return p
+	}
+	logger.Log.Error("invalid_config", "name", "SLOW_CONSUMER", "value", p)
+	os.Exit(1)
+	return p
+}
+
+// roomOptions builds the room manager configuration from the environment. The
+// returned store is nil unless DATA_DIR is set.
+func roomOptions() ([]room.Option, store.Store) {
+	opts := []room.Option{
+		room.WithCursorFlushInterval(envDuration("CURSOR_FLUSH_INTERVAL", 50*time.Millisecond)),
+		room.WithIdleTTL(envDuration("ROOM_IDLE_TTL", 10*time.Minute)),
+		room.WithSyncTimeout(envDuration("SYNC_TIMEOUT", 600*time.Millisecond), envInt("SYNC_ATTEMPTS", 3)),
+		room.WithResumeBuffer(envInt("RESUME_BUFFER", 1024)),
+		room.WithMaxPeers(envInt("MAX_PEERS_PER_DOC", 0), envInt("MAX_OBSERVERS_PER_DOC", 0)),
+		room.WithSlowConsumer(envSlowConsumer()),
+		room.WithShards(envInt("ROOM_SHARDS", 0)),
+	}
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return opts, nil
+	}
+	s, err := store.OpenFileStore(dir, wal.Options{})
+	if err != nil {
+		logger.Log.Error("store_open_failed", "dir", dir, "error", err)
+		os.Exit(1)
+	}
+	opts = append(opts,
+		room.WithStore(s),
+		room.WithSnapshotEvery(envInt("SNAPSHOT_EVERY_OPS", 1000), envDuration("SNAPSHOT_INTERVAL", 5*time.Minute)),
+	)
+	return opts, s
+}
+
+// envLimits reads <prefix>_OPS (per second), <prefix>_BYTES (per second) and
+// <prefix>_JOINS (per minute).
+func envLimits(prefix string, def ws.Limits) ws.Limits {
+	return ws.Limits{
+		OpsPerSecond:   float64(envInt(prefix+"_OPS", int(def.OpsPerSecond))),
+		BytesPerSecond: float64(envInt(prefix+"_BYTES", int(def.BytesPerSecond))),
+		JoinsPerMinute: float64(envInt(prefix+"_JOINS", int(def.JoinsPerMinute))),
+	}
+}
+
+// hubOptions builds the hub configuration from the environment.
+func hubOptions() []ws.Option {
+	return []ws.Option{
+		ws.WithMaxSubscriptions(envInt("MAX_SUBSCRIPTIONS", ws.DefaultMaxSubscriptions)),
+		ws.WithMaxConns(envInt("MAX_CONNS", 0)),
+		ws.WithSendBuffer(envInt("SEND_BUFFER", ws.SendBufferSize)),
+		ws.WithSessionGrace(envDuration("SESSION_GRACE", ws.DefaultSessionGrace)),
+		ws.WithConnLimits(envLimits("RATE_CONN", ws.DefaultConnLimits)),
+		ws.WithSiteLimits(envLimits("RATE_SITE", ws.Limits{})),
+		ws.WithIPLimits(envLimits("RATE_IP", ws.Limits{})),
+		ws.WithTrustForwardedFor(os.Getenv("TRUST_FORWARDED_FOR") == "1"),
+	}
+}
@@ -6,9 +6,11 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"skepsi/backend/internal/logger"
 	"skepsi/backend/internal/metrics"
+	"skepsi/backend/internal/protocol"
 	"skepsi/backend/internal/room"
 	"skepsi/backend/internal/validate"
 	"skepsi/backend/internal/ws"
@@ -16,18 +18,25 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// shutdownTimeout bounds how long the rooms get to save their snapshots once
+// the server is asked to stop.
+const shutdownTimeout = 30 * time.Second
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    protocol.Subprotocols(),
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
 }
 
 func main() {
-	roomManager := room.NewManager(nil)
-	hub := ws.NewHub(roomManager)
+	roomOpts, docStore := roomOptions()
+	roomManager := room.NewManager(nil, roomOpts...)
+	hub := ws.NewHub(roomManager, hubOptions()...)
 	roomManager.SetDropCallback(hub.DropClient)
+	roomManager.SetRefuseCallback(hub.RefuseSubscription)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -58,14 +67,18 @@ func main() {
 			}
 			logger.Log.Info("ws_connect", "doc", doc)
 		}
+		if !hub.Admit(doc) {
+			http.Error(w, "server is full, retry later", http.StatusServiceUnavailable)
+			return
+		}
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			logger.Log.Warn("upgrade_failed", "error", err)
 			return
 		}
-		c := hub.Register(conn)
+		c := hub.Connect(conn, r)
 		go c.ReadPump(ctx, func(raw []byte) {
-			hub.Incoming(c.ID, raw)
+			hub.Incoming(c, raw)
 		}, func() {
 			hub.Unregister(c)
 		})
@@ -91,5 +104,14 @@ func main() {
 	cancel()
 	_ = server.Shutdown(context.Background())
 	<-hub.Done()
+	// Rooms snapshot as they stop, so the store has to outlive them.
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer shutdownCancel()
+	roomManager.Shutdown(shutdownCtx)
+	if docStore != nil {
+		if err := docStore.Close(); err != nil {
+			logger.Log.Error("store_close_failed", "error", err)
+		}
+	}
 	logger.Log.Info("server_stopped")
 }
@@ -169,6 +169,16 @@ func (e *Engine) Positions() []Position {
 	return out
 }
 
+// Elements returns a copy of every element in document order, tombstones and
+// the two boundary elements included.
+func (e *Engine) Elements() []Element {
+	out := make([]Element, len(e.elements))
+	for i, el := range e.elements {
+		out[i] = *el
+	}
+	return out
+}
+
 func (e *Engine) ElementAt(pos Position) *Element {
 	i := e.indexOf(pos)
 	if i < 0 {
@@ -188,3 +188,21 @@ func TestSelectiveUndoScenario(t *testing.T) {
 		t.Errorf("replica 4 (reordered): expected \"AB\", got %q", e4.String())
 	}
 }
+
+func TestElementsIncludesTombstones(t *testing.T) {
+	e := NewEngine()
+	e.ApplyRemote(Position{10}, 'a', false)
+	e.ApplyRemote(Position{20}, 'b', false)
+	e.Delete(Position{10})
+	els := e.Elements()
+	if len(els) != 4 {
+		t.Fatalf("expected 2 boundaries and 2 elements, got %d", len(els))
+	}
+	if els[1].Value != 'a' || !els[1].Deleted || els[2].Value != 'b' || els[2].Deleted {
+		t.Errorf("unexpected elements %+v", els)
+	}
+	els[2].Deleted = true
+	if e.String() != "b" {
+		t.Error("Elements should return copies")
+	}
+}
@@ -9,46 +9,212 @@ import (
 
 var (
 	OpsProcessedTotal      atomic.Uint64
+	BatchesProcessedTotal  atomic.Uint64
 	ConnectionsTotal       atomic.Uint64
 	BackpressureDropsTotal atomic.Uint64
 	SendSkipsTotal         atomic.Uint64
 	ActiveConnections      atomic.Uint64
 	ActiveRooms            atomic.Uint64
 	ActivePeers            atomic.Uint64
+	CursorsCoalescedTotal  atomic.Uint64
+	DuplicateOpsTotal      atomic.Uint64
+	CounterGapsTotal       atomic.Uint64
+	SnapshotsTotal         atomic.Uint64
+	SnapshotFailuresTotal  atomic.Uint64
+	LogSegmentsTruncated   atomic.Uint64
+	RoomsCreatedTotal      atomic.Uint64
+	RoomsEvictedTotal      atomic.Uint64
+	RoomsWokenTotal        atomic.Uint64
+	SubscriptionsRejected  atomic.Uint64
+	SyncTimeoutsTotal      atomic.Uint64
+	SyncRetriesTotal       atomic.Uint64
+	SyncFailuresTotal      atomic.Uint64
+	ResumesTotal           atomic.Uint64
+	ResumeMissesTotal      atomic.Uint64
+	SessionsSuspended      atomic.Uint64
+	SessionsResumed        atomic.Uint64
+	SessionsExpired        atomic.Uint64
+	SessionsResumeFailed   atomic.Uint64
+	ThrottledMessages      atomic.Uint64
+	ThrottledBytes         atomic.Uint64
+	RateLimitCloses        atomic.Uint64
+	ConnectionsRefused     atomic.Uint64
+	JoinsRefused           atomic.Uint64
+	ObserverJoins          atomic.Uint64
+	SlowConsumers          atomic.Uint64
+	SlowConsumerResyncs    atomic.Uint64
+	SlowConsumerDrops      atomic.Uint64
+	RoomCommandDrops       atomic.Uint64
+	SnapshotEveryOps       atomic.Uint64
+	SnapshotIntervalSecs   atomic.Uint64
 )
 
-func IncOpsProcessed()        { OpsProcessedTotal.Add(1) }
-func IncConnections()         { ConnectionsTotal.Add(1) }
-func IncBackpressure()        { BackpressureDropsTotal.Add(1) }
-func IncSendSkips()           { SendSkipsTotal.Add(1) }
-func DecActiveConns()         { ActiveConnections.Add(^uint64(0)) }
-func SetActiveConns(n uint64) { ActiveConnections.Store(n) }
-func SetActiveRooms(n uint64) { ActiveRooms.Store(n) }
-func SetActivePeers(n uint64) { ActivePeers.Store(n) }
+func IncOpsProcessed()                 { OpsProcessedTotal.Add(1) }
+func AddOpsProcessed(n uint64)         { OpsProcessedTotal.Add(n) }
+func IncBatchesProcessed()             { BatchesProcessedTotal.Add(1) }
+func IncConnections()                  { ConnectionsTotal.Add(1) }
+func IncBackpressure()                 { BackpressureDropsTotal.Add(1) }
+func IncSendSkips()                    { SendSkipsTotal.Add(1) }
+func DecActiveConns()                  { ActiveConnections.Add(^uint64(0)) }
+func SetActiveConns(n uint64)          { ActiveConnections.Store(n) }
+func SetActiveRooms(n uint64)          { ActiveRooms.Store(n) }
+func SetActivePeers(n uint64)          { ActivePeers.Store(n) }
+func IncCursorsCoalesced()             { CursorsCoalescedTotal.Add(1) }
+func IncDuplicateOps()                 { DuplicateOpsTotal.Add(1) }
+func IncCounterGaps()                  { CounterGapsTotal.Add(1) }
+func IncSnapshots()                    { SnapshotsTotal.Add(1) }
+func IncSnapshotFailures()             { SnapshotFailuresTotal.Add(1) }
+func AddLogSegmentsTruncated(n uint64) { LogSegmentsTruncated.Add(n) }
+func IncRoomsCreated()                 { RoomsCreatedTotal.Add(1) }
+func IncRoomsEvicted()                 { RoomsEvictedTotal.Add(1) }
+func IncRoomsWoken()                   { RoomsWokenTotal.Add(1) }
+func IncSubscriptionsRejected()        { SubscriptionsRejected.Add(1) }
+func IncSyncTimeouts()                 { SyncTimeoutsTotal.Add(1) }
+func IncSyncRetries()                  { SyncRetriesTotal.Add(1) }
+func IncSyncFailures()                 { SyncFailuresTotal.Add(1) }
+func IncResumes()                      { ResumesTotal.Add(1) }
+func IncResumeMisses()                 { ResumeMissesTotal.Add(1) }
+func IncSessionsSuspended()            { SessionsSuspended.Add(1) }
+func IncSessionsResumed()              { SessionsResumed.Add(1) }
+func IncSessionsExpired()              { SessionsExpired.Add(1) }
+func IncSessionsResumeFailed()         { SessionsResumeFailed.Add(1) }
+func IncThrottledMessages()            { ThrottledMessages.Add(1) }
+func AddThrottledBytes(n uint64)       { ThrottledBytes.Add(n) }
+func IncRateLimitCloses()              { RateLimitCloses.Add(1) }
+func IncConnectionsRefused()           { ConnectionsRefused.Add(1) }
+func IncJoinsRefused()                 { JoinsRefused.Add(1) }
+func IncObserverJoins()                { ObserverJoins.Add(1) }
+func IncSlowConsumers()                { SlowConsumers.Add(1) }
+func IncSlowConsumerResyncs()          { SlowConsumerResyncs.Add(1) }
+func IncSlowConsumerDrops()            { SlowConsumerDrops.Add(1) }
+func IncRoomCommandDrops()             { RoomCommandDrops.Add(1) }
+
+// SetSnapshotSchedule publishes the compaction settings so dashboards can show
+// them next to the counters.
+func SetSnapshotSchedule(everyOps uint64, intervalSecs uint64) {
+	SnapshotEveryOps.Store(everyOps)
+	SnapshotIntervalSecs.Store(intervalSecs)
+}
 
 func Handler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Query().Get("format") == "json" {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"ops_processed_total":      OpsProcessedTotal.Load(),
-			"connections_total":        ConnectionsTotal.Load(),
-			"backpressure_drops_total": BackpressureDropsTotal.Load(),
-			"send_skips_total":         SendSkipsTotal.Load(),
-			"active_connections":       ActiveConnections.Load(),
-			"active_rooms":             ActiveRooms.Load(),
-			"active_peers":             ActivePeers.Load(),
+			"ops_processed_total":          OpsProcessedTotal.Load(),
+			"batches_processed_total":      BatchesProcessedTotal.Load(),
+			"connections_total":            ConnectionsTotal.Load(),
+			"backpressure_drops_total":     BackpressureDropsTotal.Load(),
+			"send_skips_total":             SendSkipsTotal.Load(),
+			"cursors_coalesced_total":      CursorsCoalescedTotal.Load(),
+			"duplicate_ops_total":          DuplicateOpsTotal.Load(),
+			"counter_gaps_total":           CounterGapsTotal.Load(),
+			"snapshots_total":              SnapshotsTotal.Load(),
+			"snapshot_failures_total":      SnapshotFailuresTotal.Load(),
+			"log_segments_truncated_total": LogSegmentsTruncated.Load(),
+			"rooms_created_total":          RoomsCreatedTotal.Load(),
+			"rooms_evicted_total":          RoomsEvictedTotal.Load(),
+			"rooms_woken_total":            RoomsWokenTotal.Load(),
+			"subscriptions_rejected_total": SubscriptionsRejected.Load(),
+			"sync_timeouts_total":          SyncTimeoutsTotal.Load(),
+			"sync_retries_total":           SyncRetriesTotal.Load(),
+			"sync_failures_total":          SyncFailuresTotal.Load(),
+			"resumes_total":                ResumesTotal.Load(),
+			"resume_misses_total":          ResumeMissesTotal.Load(),
+			"sessions_suspended_total":     SessionsSuspended.Load(),
+			"sessions_resumed_total":       SessionsResumed.Load(),
+			"sessions_expired_total":       SessionsExpired.Load(),
+			"sessions_resume_failed_total": SessionsResumeFailed.Load(),
+			"throttled_messages_total":     ThrottledMessages.Load(),
+			"throttled_bytes_total":        ThrottledBytes.Load(),
+			"rate_limit_closes_total":      RateLimitCloses.Load(),
+			"connections_refused_total":    ConnectionsRefused.Load(),
+			"joins_refused_total":          JoinsRefused.Load(),
+			"observer_joins_total":         ObserverJoins.Load(),
+			"slow_consumers_total":         SlowConsumers.Load(),
+			"slow_consumer_resyncs_total":  SlowConsumerResyncs.Load(),
+			"slow_consumer_drops_total":    SlowConsumerDrops.Load(),
+			"room_command_drops_total":     RoomCommandDrops.Load(),
+			"snapshot_every_ops":           SnapshotEveryOps.Load(),
+			"snapshot_interval_seconds":    SnapshotIntervalSecs.Load(),
+			"active_connections":           ActiveConnections.Load(),
+			"active_rooms":                 ActiveRooms.Load(),
+			"active_peers":                 ActivePeers.Load(),
 		})
 		return
 	}
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Write([]byte("skepsi_ops_processed_total counter\n"))
 	w.Write([]byte("skepsi_ops_processed_total " + strconv.FormatUint(OpsProcessedTotal.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_batches_processed_total counter\n"))
+	w.Write([]byte("skepsi_batches_processed_total " + strconv.FormatUint(BatchesProcessedTotal.Load(), 10) + "\n"))
 	w.Write([]byte("skepsi_connections_total counter\n"))
 	w.Write([]byte("skepsi_connections_total " + strconv.FormatUint(ConnectionsTotal.Load(), 10) + "\n"))
 	w.Write([]byte("skepsi_backpressure_drops_total counter\n"))
 	w.Write([]byte("skepsi_backpressure_drops_total " + strconv.FormatUint(BackpressureDropsTotal.Load(), 10) + "\n"))
 	w.Write([]byte("skepsi_send_skips_total counter\n"))
 	w.Write([]byte("skepsi_send_skips_total " + strconv.FormatUint(SendSkipsTotal.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_cursors_coalesced_total counter\n"))
+	w.Write([]byte("skepsi_cursors_coalesced_total " + strconv.FormatUint(CursorsCoalescedTotal.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_duplicate_ops_total counter\n"))
+	w.Write([]byte("skepsi_duplicate_ops_total " + strconv.FormatUint(DuplicateOpsTotal.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_counter_gaps_total counter\n"))
+	w.Write([]byte("skepsi_counter_gaps_total " + strconv.FormatUint(CounterGapsTotal.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_snapshots_total counter\n"))
+	w.Write([]byte("skepsi_snapshots_total " + strconv.FormatUint(SnapshotsTotal.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_snapshot_failures_total counter\n"))
+	w.Write([]byte("skepsi_snapshot_failures_total " + strconv.FormatUint(SnapshotFailuresTotal.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_log_segments_truncated_total counter\n"))
+	w.Write([]byte("skepsi_log_segments_truncated_total " + strconv.FormatUint(LogSegmentsTruncated.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_rooms_created_total counter\n"))
+	w.Write([]byte("skepsi_rooms_created_total " + strconv.FormatUint(RoomsCreatedTotal.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_rooms_evicted_total counter\n"))
+	w.Write([]byte("skepsi_rooms_evicted_total " + strconv.FormatUint(RoomsEvictedTotal.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_rooms_woken_total counter\n"))
+	w.Write([]byte("skepsi_rooms_woken_total " + strconv.FormatUint(RoomsWokenTotal.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_subscriptions_rejected_total counter\n"))
+	w.Write([]byte("skepsi_subscriptions_rejected_total " + strconv.FormatUint(SubscriptionsRejected.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_sync_timeouts_total counter\n"))
+	w.Write([]byte("skepsi_sync_timeouts_total " + strconv.FormatUint(SyncTimeoutsTotal.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_sync_retries_total counter\n"))
+	w.Write([]byte("skepsi_sync_retries_total " + strconv.FormatUint(SyncRetriesTotal.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_sync_failures_total counter\n"))
+	w.Write([]byte("skepsi_sync_failures_total " + strconv.FormatUint(SyncFailuresTotal.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_resumes_total counter\n"))
+	w.Write([]byte("skepsi_resumes_total " + strconv.FormatUint(ResumesTotal.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_resume_misses_total counter\n"))
+	w.Write([]byte("skepsi_resume_misses_total " + strconv.FormatUint(ResumeMissesTotal.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_sessions_suspended_total counter\n"))
+	w.Write([]byte("skepsi_sessions_suspended_total " + strconv.FormatUint(SessionsSuspended.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_sessions_resumed_total counter\n"))
+	w.Write([]byte("skepsi_sessions_resumed_total " + strconv.FormatUint(SessionsResumed.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_sessions_expired_total counter\n"))
+	w.Write([]byte("skepsi_sessions_expired_total " + strconv.FormatUint(SessionsExpired.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_sessions_resume_failed_total counter\n"))
+	w.Write([]byte("skepsi_sessions_resume_failed_total " + strconv.FormatUint(SessionsResumeFailed.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_throttled_messages_total counter\n"))
+	w.Write([]byte("skepsi_throttled_messages_total " + strconv.FormatUint(ThrottledMessages.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_throttled_bytes_total counter\n"))
+	w.Write([]byte("skepsi_throttled_bytes_total " + strconv.FormatUint(ThrottledBytes.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_rate_limit_closes_total counter\n"))
+	w.Write([]byte("skepsi_rate_limit_closes_total " + strconv.FormatUint(RateLimitCloses.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_connections_refused_total counter\n"))
+	w.Write([]byte("skepsi_connections_refused_total " + strconv.FormatUint(ConnectionsRefused.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_joins_refused_total counter\n"))
+	w.Write([]byte("skepsi_joins_refused_total " + strconv.FormatUint(JoinsRefused.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_observer_joins_total counter\n"))
+	w.Write([]byte("skepsi_observer_joins_total " + strconv.FormatUint(ObserverJoins.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_slow_consumers_total counter\n"))
+	w.Write([]byte("skepsi_slow_consumers_total " + strconv.FormatUint(SlowConsumers.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_slow_consumer_resyncs_total counter\n"))
+	w.Write([]byte("skepsi_slow_consumer_resyncs_total " + strconv.FormatUint(SlowConsumerResyncs.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_slow_consumer_drops_total counter\n"))
+	w.Write([]byte("skepsi_slow_consumer_drops_total " + strconv.FormatUint(SlowConsumerDrops.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_room_command_drops_total counter\n"))
+	w.Write([]byte("skepsi_room_command_drops_total " + strconv.FormatUint(RoomCommandDrops.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_snapshot_every_ops gauge\n"))
+	w.Write([]byte("skepsi_snapshot_every_ops " + strconv.FormatUint(SnapshotEveryOps.Load(), 10) + "\n"))
+	w.Write([]byte("skepsi_snapshot_interval_seconds gauge\n"))
+	w.Write([]byte("skepsi_snapshot_interval_seconds " + strconv.FormatUint(SnapshotIntervalSecs.Load(), 10) + "\n"))
 	w.Write([]byte("skepsi_active_rooms gauge\n"))
 	w.Write([]byte("skepsi_active_rooms " + strconv.FormatUint(ActiveRooms.Load(), 10) + "\n"))
 	w.Write([]byte("skepsi_active_peers gauge\n"))
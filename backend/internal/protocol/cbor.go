@@ -0,0 +1,288 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// A minimal CBOR (RFC 8949) encoder and decoder covering the JSON data model:
+// integers, floats, text strings, arrays, maps with text keys, booleans and
+// null. Indefinite-length items, tags and byte strings are rejected.
+
+const (
+	cborMajorUint   = 0
+	cborMajorNegInt = 1
+	cborMajorBytes  = 2
+	cborMajorText   = 3
+	cborMajorArray  = 4
+	cborMajorMap    = 5
+	cborMajorTag    = 6
+	cborMajorSimple = 7
+
+	cborFalse   = 0xf4
+	cborTrue    = 0xf5
+	cborNull    = 0xf6
+	cborUndef   = 0xf7
+	cborFloat16 = 0xf9
+	cborFloat32 = 0xfa
+	cborFloat64 = 0xfb
+
+	cborMaxDepth = 64
+)
+
+var (
+	ErrCBORTruncated   = errors.New("cbor: unexpected end of input")
+	ErrCBORUnsupported = errors.New("cbor: unsupported item")
+	ErrCBORTrailing    = errors.New("cbor: trailing bytes after item")
+	ErrCBORTooDeep     = errors.New("cbor: nesting too deep")
+)
+
+func jsonToCBOR(raw []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(raw)/2)
+	return appendCBOR(out, v)
+}
+
+func cborToJSON(frame []byte) ([]byte, error) {
+	d := cborDecoder{buf: frame}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.off != len(d.buf) {
+		return nil, ErrCBORTrailing
+	}
+	return json.Marshal(v)
+}
+
+func appendCBORHead(out []byte, major byte, n uint64) []byte {
+	m := major << 5
+	switch {
+	case n < 24:
+		return append(out, m|byte(n))
+	case n <= math.MaxUint8:
+		return append(out, m|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(out, m|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(out, m|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(out, m|27), n)
+	}
+}
+
+func appendCBOR(out []byte, v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case nil:
+		return append(out, cborNull), nil
+	case bool:
+		if x {
+			return append(out, cborTrue), nil
+		}
+		return append(out, cborFalse), nil
+	case json.Number:
+		if i, err := strconv.ParseInt(string(x), 10, 64); err == nil {
+			if i >= 0 {
+				return appendCBORHead(out, cborMajorUint, uint64(i)), nil
+			}
+			return appendCBORHead(out, cborMajorNegInt, uint64(-(i + 1))), nil
+		}
+		f, err := x.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(append(out, cborFloat64), math.Float64bits(f)), nil
+	case string:
+		out = appendCBORHead(out, cborMajorText, uint64(len(x)))
+		return append(out, x...), nil
+	case []interface{}:
+		out = appendCBORHead(out, cborMajorArray, uint64(len(x)))
+		var err error
+		for _, e := range x {
+			if out, err = appendCBOR(out, e); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out = appendCBORHead(out, cborMajorMap, uint64(len(x)))
+		var err error
+		for _, k := range keys {
+			out = appendCBORHead(out, cborMajorText, uint64(len(k)))
+			out = append(out, k...)
+			if out, err = appendCBOR(out, x[k]); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	default:
+		return nil, ErrCBORUnsupported
+	}
+}
+
+type cborDecoder struct {
+	buf []byte
+	off int
+}
+
+func (d *cborDecoder) head() (major byte, info byte, n uint64, err error) {
+	if d.off >= len(d.buf) {
+		return 0, 0, 0, ErrCBORTruncated
+	}
+	b := d.buf[d.off]
+	d.off++
+	major, info = b>>5, b&0x1f
+	var size int
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, 0, ErrCBORUnsupported
+	}
+	if len(d.buf)-d.off < size {
+		return 0, 0, 0, ErrCBORTruncated
+	}
+	p := d.buf[d.off : d.off+size]
+	d.off += size
+	switch size {
+	case 1:
+		n = uint64(p[0])
+	case 2:
+		n = uint64(binary.BigEndian.Uint16(p))
+	case 4:
+		n = uint64(binary.BigEndian.Uint32(p))
+	default:
+		n = binary.BigEndian.Uint64(p)
+	}
+	return major, info, n, nil
+}
+
+func (d *cborDecoder) text(n uint64) (string, error) {
+	if n > uint64(len(d.buf)-d.off) {
+		return "", ErrCBORTruncated
+	}
+	s := string(d.buf[d.off : d.off+int(n)])
+	d.off += int(n)
+	return s, nil
+}
+
+func (d *cborDecoder) value(depth int) (interface{}, error) {
+	if depth > cborMaxDepth {
+		return nil, ErrCBORTooDeep
+	}
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case cborMajorUint:
+		return n, nil
+	case cborMajorNegInt:
+		if n > math.MaxInt64 {
+			return nil, ErrCBORUnsupported
+		}
+		return -1 - int64(n), nil
+	case cborMajorText:
+		return d.text(n)
+	case cborMajorArray:
+		if n > uint64(len(d.buf)-d.off) {
+			return nil, ErrCBORTruncated
+		}
+		arr := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case cborMajorMap:
+		if n > uint64(len(d.buf)-d.off)/2 {
+			return nil, ErrCBORTruncated
+		}
+		obj := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			km, _, kn, err := d.head()
+			if err != nil {
+				return nil, err
+			}
+			if km != cborMajorText {
+				return nil, ErrCBORUnsupported
+			}
+			k, err := d.text(kn)
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			obj[k] = v
+		}
+		return obj, nil
+	case cborMajorSimple:
+		switch info {
+		case cborFalse & 0x1f:
+			return false, nil
+		case cborTrue & 0x1f:
+			return true, nil
+		case cborNull & 0x1f, cborUndef & 0x1f:
+			return nil, nil
+		case cborFloat16 & 0x1f:
+			return float16ToFloat64(uint16(n)), nil
+		case cborFloat32 & 0x1f:
+			return float64(math.Float32frombits(uint32(n))), nil
+		case cborFloat64 & 0x1f:
+			return math.Float64frombits(n), nil
+		}
+		return nil, ErrCBORUnsupported
+	default:
+		return nil, ErrCBORUnsupported
+	}
+}
+
+func float16ToFloat64(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
@@ -0,0 +1,85 @@
+package protocol
+
+import "sync"
+
+// Wire encodings are negotiated with the Sec-WebSocket-Protocol header. JSON is
+// the canonical form inside the server: rooms fan out JSON bytes and each
+// connection converts to its own encoding on the way in and out, so JSON and
+// binary clients can share a room. A fanned out frame travels as a Frame, so
+// it is converted once and the bytes are shared by its CBOR recipients.
+const (
+	SubprotocolJSON = "skepsi.json"
+	SubprotocolCBOR = "skepsi.cbor"
+)
+
+// Subprotocols lists the encodings the server accepts, for websocket.Upgrader.
+func Subprotocols() []string {
+	return []string{SubprotocolCBOR, SubprotocolJSON}
+}
+
+type Codec interface {
+	Name() string
+	Binary() bool
+	Encode(canonical []byte) ([]byte, error)
+	Decode(frame []byte) ([]byte, error)
+}
+
+var (
+	JSONCodec Codec = jsonCodec{}
+	CBORCodec Codec = cborCodec{}
+)
+
+// CodecFor returns the codec for a negotiated subprotocol. Clients that did not
+// ask for one get JSON.
+func CodecFor(subprotocol string) Codec {
+	if subprotocol == SubprotocolCBOR {
+		return CBORCodec
+	}
+	return JSONCodec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                            { return SubprotocolJSON }
+func (jsonCodec) Binary() bool                            { return false }
+func (jsonCodec) Encode(canonical []byte) ([]byte, error) { return canonical, nil }
+func (jsonCodec) Decode(frame []byte) ([]byte, error)     { return frame, nil }
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string { return SubprotocolCBOR }
+func (cborCodec) Binary() bool { return true }
+
+func (cborCodec) Encode(canonical []byte) ([]byte, error) {
+	return jsonToCBOR(canonical)
+}
+
+func (cborCodec) Decode(frame []byte) ([]byte, error) {
+	if len(frame) > MaxPayloadBytes {
+		return nil, ErrPayloadTooLarge
+	}
+	return cborToJSON(frame)
+}
+
+// Frame is a canonical frame on its way out to one or more connections. Its
+// binary encoding is made by the first binary connection that writes it and
+// shared with the rest; CBOR is the only binary codec.
+type Frame struct {
+	JSON   []byte
+	once   sync.Once
+	binary []byte
+	err    error
+}
+
+func NewFrame(canonical []byte) *Frame {
+	return &Frame{JSON: canonical}
+}
+
+// Encode returns the frame in c's encoding.
+func (f *Frame) Encode(c Codec) ([]byte, error) {
+	if !c.Binary() {
+		return c.Encode(f.JSON)
+	}
+	f.once.Do(func() { f.binary, f.err = c.Encode(f.JSON) })
+	return f.binary, f.err
+}
@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestCBORRoundTrip(t *testing.T) {
+	in := []byte(`{"type":"insert","docId":"d1","siteId":"s1","opId":{"site":"s1","counter":300},` +
+		`"payload":{"position":[0,32768,65535],"value":"é"},"timestamp":-5,"ratio":0.5,"ok":true,"none":null}`)
+	frame, err := CBORCodec.Encode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame) >= len(in) {
+		t.Errorf("cbor frame (%d bytes) not smaller than json (%d bytes)", len(frame), len(in))
+	}
+	out, err := CBORCodec.Decode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want, got interface{}
+	if err := json.Unmarshal(in, &want); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatal(err)
+	}
+	wantJSON, _ := json.Marshal(want)
+	gotJSON, _ := json.Marshal(got)
+	if !bytes.Equal(wantJSON, gotJSON) {
+		t.Errorf("round trip mismatch:\n got %s\nwant %s", gotJSON, wantJSON)
+	}
+}
+
+func TestFrameEncodesOnceForAllRecipients(t *testing.T) {
+	canonical := []byte(`{"type":"insert","docId":"d1","opId":{"site":"s1","counter":1}}`)
+	frame := NewFrame(canonical)
+	first, err := frame.Encode(CBORCodec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := frame.Encode(CBORCodec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &first[0] != &second[0] {
+		t.Error("the same frame should be converted once for all its recipients")
+	}
+	want, _ := CBORCodec.Encode(canonical)
+	if !bytes.Equal(first, want) {
+		t.Error("shared encoding differs from the codec's")
+	}
+	if text, _ := frame.Encode(JSONCodec); &text[0] != &canonical[0] {
+		t.Error("json recipients should get the canonical bytes")
+	}
+}
+
+func TestCBORDecodeRejectsMalformed(t *testing.T) {
+	cases := map[string][]byte{
+		"truncated text":  {0x63, 'a', 'b'},
+		"huge array":      {0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"indefinite map":  {0xbf, 0xff},
+		"non-text key":    {0xa1, 0x01, 0x02},
+		"trailing bytes":  {0x01, 0x02},
+		"empty":           {},
+		"byte string":     {0x41, 0x00},
+		"negint overflow": {0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	for name, frame := range cases {
+		if _, err := CBORCodec.Decode(frame); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestCodecFor(t *testing.T) {
+	if CodecFor(SubprotocolCBOR) != CBORCodec {
+		t.Error("cbor subprotocol should select cbor codec")
+	}
+	if CodecFor("") != JSONCodec || CodecFor(SubprotocolJSON) != JSONCodec {
+		t.Error("missing or json subprotocol should select json codec")
+	}
+}
+
+func TestDecodeMessageVariants(t *testing.T) {
+	m, err := DecodeMessage([]byte(`{"type":"join","docId":"d","siteId":"s","known":{"s":7}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := m.Join()
+	if err != nil || j.Known["s"] != 7 {
+		t.Fatalf("join: %+v %v", j, err)
+	}
+	if _, err := m.Operation(); err != nil {
+		t.Errorf("join is a valid operation type: %v", err)
+	}
+	if _, _, err := m.Targeted(); err != ErrInvalidType {
+		t.Errorf("join is not targeted: %v", err)
+	}
+	m, _ = DecodeMessage([]byte(`{"type":"sync_op","docId":"d"}`))
+	if _, _, err := m.Targeted(); err != ErrMissingTarget {
+		t.Errorf("expected ErrMissingTarget, got %v", err)
+	}
+	m, _ = DecodeMessage([]byte(`{"type":"subscribe","docId":"d","siteId":"s","known":{"s":3}}`))
+	s, err := m.Subscribe()
+	if err != nil || s.Join().Type != TypeJoin || s.Join().Known["s"] != 3 {
+		t.Errorf("subscribe: %+v %v", s, err)
+	}
+	m, _ = DecodeMessage([]byte(`{"type":"unsubscribe","siteId":"s"}`))
+	if _, err := m.Unsubscribe(); err != ErrMissingDocId {
+		t.Errorf("expected ErrMissingDocId, got %v", err)
+	}
+}
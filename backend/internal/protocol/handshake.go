@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ProtocolVersion is the message format this server speaks. Clients that never
+// send hello are treated as version 1 with no optional features.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// Close codes in the 4000-4999 application range.
+const (
+	CloseUnsupportedVersion = 4001
+	CloseRateLimited        = 4029
+)
+
+type FeatureSet uint32
+
+const (
+	FeatureBatch FeatureSet = 1 << iota
+	FeatureAcks
+	FeaturePresence
+	FeatureResend
+	FeatureSubscriptions
+	FeatureSyncStatus
+	FeatureSessions
+	FeatureObserve
+)
+
+var featureNames = []struct {
+	f    FeatureSet
+	name string
+}{
+	{FeatureBatch, "batch"},
+	{FeatureAcks, "acks"},
+	{FeaturePresence, "presence"},
+	{FeatureResend, "resend"},
+	{FeatureSubscriptions, "subscriptions"},
+	{FeatureSyncStatus, "sync_status"},
+	{FeatureSessions, "sessions"},
+	{FeatureObserve, "observe"},
+}
+
+// ServerFeatures is everything this server can do; a connection gets the
+// intersection with what its client announced.
+const ServerFeatures = FeatureBatch | FeatureAcks | FeaturePresence | FeatureResend | FeatureSubscriptions | FeatureSyncStatus | FeatureSessions | FeatureObserve
+
+var (
+	ErrMissingVersion     = errors.New("missing protocol version")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+)
+
+func ParseFeatures(names []string) FeatureSet {
+	var fs FeatureSet
+	for _, n := range names {
+		for _, fn := range featureNames {
+			if fn.name == n {
+				fs |= fn.f
+			}
+		}
+	}
+	return fs
+}
+
+func (fs FeatureSet) Has(f FeatureSet) bool {
+	return fs&f == f
+}
+
+func (fs FeatureSet) Names() []string {
+	names := []string{}
+	for _, fn := range featureNames {
+		if fs.Has(fn.f) {
+			names = append(names, fn.name)
+		}
+	}
+	return names
+}
+
+// HelloMessage opens a connection. The server's reply carries a session token
+// when sessions were negotiated, and a hello sent first thing on a socket that
+// took over a session has Resumed set.
+type HelloMessage struct {
+	Type       string   `json:"type"`
+	Version    int      `json:"version"`
+	MinVersion int      `json:"minVersion,omitempty"`
+	Features   []string `json:"features" wire:"Feature"`
+	Session    string   `json:"session,omitempty"`
+	Resumed    bool     `json:"resumed,omitempty"`
+}
+
+func NewServerHello() HelloMessage {
+	return HelloMessage{
+		Type:       TypeHello,
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+		Features:   ServerFeatures.Names(),
+	}
+}
+
+// Hello validates a client hello and returns the version and features the
+// connection will use. A client may speak a newer version than the server as
+// long as its minVersion (default: its version) still covers ProtocolVersion.
+func (m *Message) Hello() (version int, features FeatureSet, err error) {
+	if m.Type != TypeHello {
+		return 0, 0, ErrInvalidType
+	}
+	if m.Version <= 0 {
+		return 0, 0, ErrMissingVersion
+	}
+	clientMin := m.MinVersion
+	if clientMin <= 0 || clientMin > m.Version {
+		clientMin = m.Version
+	}
+	if m.Version < MinProtocolVersion || clientMin > ProtocolVersion {
+		return 0, 0, fmt.Errorf("%w: client speaks %d-%d, server speaks %d-%d",
+			ErrUnsupportedVersion, clientMin, m.Version, MinProtocolVersion, ProtocolVersion)
+	}
+	return min(m.Version, ProtocolVersion), ParseFeatures(m.Features) & ServerFeatures, nil
+}
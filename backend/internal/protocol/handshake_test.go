@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHelloNegotiation(t *testing.T) {
+	cases := []struct {
+		raw      string
+		version  int
+		features FeatureSet
+		err      error
+	}{
+		{`{"type":"hello","version":1,"features":["batch","telepathy"]}`, 1, FeatureBatch, nil},
+		{`{"type":"hello","version":3,"minVersion":1,"features":["acks","batch"]}`, 1, FeatureBatch | FeatureAcks, nil},
+		{`{"type":"hello","version":3,"features":[]}`, 0, 0, ErrUnsupportedVersion},
+		{`{"type":"hello","version":2,"minVersion":2}`, 0, 0, ErrUnsupportedVersion},
+		{`{"type":"hello"}`, 0, 0, ErrMissingVersion},
+	}
+	for _, tc := range cases {
+		m, err := DecodeMessage([]byte(tc.raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		version, features, err := m.Hello()
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: err %v, want %v", tc.raw, err, tc.err)
+			continue
+		}
+		if version != tc.version || features != tc.features {
+			t.Errorf("%s: got v%d %v, want v%d %v", tc.raw, version, features.Names(), tc.version, tc.features.Names())
+		}
+	}
+}
+
+func TestServerHelloAdvertisesFeatures(t *testing.T) {
+	h := NewServerHello()
+	if h.Version != ProtocolVersion || ParseFeatures(h.Features) != ServerFeatures {
+		t.Errorf("unexpected server hello %+v", h)
+	}
+}
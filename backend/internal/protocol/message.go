@@ -10,8 +10,20 @@ const (
 	TypeJoin     = "join"
 	TypeSyncOp   = "sync_op"
 	TypeSyncDone = "sync_done"
+	TypeBatch    = "batch"
+	TypeHello    = "hello"
+	TypeAck      = "ack"
+	TypeError    = "error"
+	TypePresence = "presence"
+	TypeRoster   = "roster"
+	TypeResend   = "resend"
+
+	TypeSubscribe   = "subscribe"
+	TypeUnsubscribe = "unsubscribe"
+	TypeSyncStatus  = "sync_status"
 
 	TypePeerJoined = "peer_joined"
+	TypePeerLeft   = "peer_left"
 )
 
 var ValidOperationTypes = map[string]bool{
@@ -22,6 +34,12 @@ var ValidOperationTypes = map[string]bool{
 	TypeJoin:   true,
 }
 
+// Cursors are not batched: the room only keeps the latest one per site.
+var ValidBatchedTypes = map[string]bool{
+	TypeInsert: true,
+	TypeDelete: true,
+}
+
 var ValidTargetedTypes = map[string]bool{
 	TypeSyncOp:   true,
 	TypeSyncDone: true,
@@ -40,13 +58,29 @@ type Operation struct {
 	Payload     json.RawMessage `json:"payload"`
 	Timestamp   int64           `json:"timestamp"`
 	InverseOpId *OpId           `json:"inverseOpId,omitempty"`
+	// Seq is stamped by the room on inserts and deletes it relays; clients
+	// don't set it.
+	Seq uint64 `json:"seq,omitempty"`
 }
 
+// JoinMessage asks for the doc. Known is the joiner's version vector: for each
+// site, the counter up to which it holds every op of that site. A peer answering
+// the join skips those ops. Epoch and LastSeq, the room epoch and the highest
+// seq of it the client has seen, let the room send only what it missed.
 type JoinMessage struct {
-	Type       string `json:"type"`
-	DocId      string `json:"docId"`
-	SiteId     string `json:"siteId"`
-	KnownClock int64  `json:"knownClock"`
+	Type    string         `json:"type"`
+	DocId   string         `json:"docId"`
+	SiteId  string         `json:"siteId"`
+	Known   map[string]int `json:"known,omitempty"`
+	Epoch   string         `json:"epoch,omitempty"`
+	LastSeq uint64         `json:"lastSeq,omitempty"`
+}
+
+type BatchMessage struct {
+	Type   string      `json:"type"`
+	DocId  string      `json:"docId"`
+	SiteId string      `json:"siteId"`
+	Ops    []Operation `json:"ops"`
 }
 
 type SyncOpMessage struct {
@@ -56,10 +90,37 @@ type SyncOpMessage struct {
 	Op     Operation `json:"op"`
 }
 
+// SyncDoneMessage ends a sync. When the server answers a join itself, Seq is
+// the room's seq the joiner is now up to and Epoch the room's epoch: seqs only
+// go on from each other within one epoch.
 type SyncDoneMessage struct {
 	Type   string `json:"type"`
 	DocId  string `json:"docId"`
 	Target string `json:"target"`
+	Seq    uint64 `json:"seq,omitempty"`
+	Epoch  string `json:"epoch,omitempty"`
+}
+
+// Message is the union of every client message shape. The hub decodes each
+// frame into it once and validates the variant it needs from there.
+type Message struct {
+	Type        string          `json:"type"`
+	DocId       string          `json:"docId"`
+	SiteId      string          `json:"siteId"`
+	OpId        OpId            `json:"opId"`
+	Payload     json.RawMessage `json:"payload"`
+	Timestamp   int64           `json:"timestamp"`
+	InverseOpId *OpId           `json:"inverseOpId,omitempty"`
+	Known       map[string]int  `json:"known"`
+	Epoch       string          `json:"epoch"`
+	LastSeq     uint64          `json:"lastSeq"`
+	Target      string          `json:"target"`
+	Op          *Operation      `json:"op,omitempty"`
+	Ops         []Operation     `json:"ops,omitempty"`
+	Version     int             `json:"version"`
+	MinVersion  int             `json:"minVersion"`
+	Features    []string        `json:"features"`
+	State       json.RawMessage `json:"state"`
 }
 
 type PeerJoined struct {
@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+var ErrInvalidPayload = errors.New("invalid payload")
+
+type InsertPayload struct {
+	Position []int  `json:"position"`
+	Value    string `json:"value"`
+}
+
+type DeletePayload struct {
+	Position []int `json:"position"`
+}
+
+type CursorPayload struct {
+	Position []int `json:"position"`
+}
+
+func (op *Operation) InsertPayload() (*InsertPayload, error) {
+	if op.Type != TypeInsert {
+		return nil, ErrInvalidType
+	}
+	var p InsertPayload
+	if err := json.Unmarshal(op.Payload, &p); err != nil || len(p.Position) == 0 {
+		return nil, ErrInvalidPayload
+	}
+	return &p, nil
+}
+
+func (op *Operation) DeletePayload() (*DeletePayload, error) {
+	if op.Type != TypeDelete {
+		return nil, ErrInvalidType
+	}
+	var p DeletePayload
+	if err := json.Unmarshal(op.Payload, &p); err != nil || len(p.Position) == 0 {
+		return nil, ErrInvalidPayload
+	}
+	return &p, nil
+}
+
+// validatePayload checks the payload of ops the server applies to its replica.
+func (op *Operation) validatePayload() error {
+	var err error
+	switch op.Type {
+	case TypeInsert:
+		_, err = op.InsertPayload()
+	case TypeDelete:
+		_, err = op.DeletePayload()
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+const MaxPresenceBytes = 4 << 10
+
+// Reasons carried by peer_left.
+const (
+	LeftDisconnected = "disconnected"
+	LeftDropped      = "dropped"
+	LeftUnsubscribed = "unsubscribed"
+)
+
+var ErrPresenceTooLarge = errors.New("presence state exceeds max size")
+
+// PresenceMessage carries a peer's ephemeral state (name, color, selection,
+// ...). The server treats state as an opaque JSON object and forgets it when
+// the peer leaves.
+type PresenceMessage struct {
+	Type   string          `json:"type"`
+	DocId  string          `json:"docId"`
+	SiteId string          `json:"siteId"`
+	State  json.RawMessage `json:"state"`
+}
+
+type PeerLeft struct {
+	Type   string `json:"type"`
+	DocId  string `json:"docId"`
+	SiteId string `json:"siteId"`
+	Reason string `json:"reason" wire:"LeftReason"`
+}
+
+type RosterEntry struct {
+	SiteId string          `json:"siteId"`
+	State  json.RawMessage `json:"state,omitempty"`
+}
+
+// RosterMessage lists everyone else in the doc; a joiner gets it once.
+type RosterMessage struct {
+	Type  string        `json:"type"`
+	DocId string        `json:"docId"`
+	Peers []RosterEntry `json:"peers"`
+}
+
+func NewPeerLeft(docId, siteId, reason string) PeerLeft {
+	return PeerLeft{Type: TypePeerLeft, DocId: docId, SiteId: siteId, Reason: reason}
+}
+
+func (m *Message) Presence() (*PresenceMessage, error) {
+	if m.Type != TypePresence {
+		return nil, ErrInvalidType
+	}
+	if m.DocId == "" {
+		return nil, ErrMissingDocId
+	}
+	if m.SiteId == "" {
+		return nil, ErrMissingSiteId
+	}
+	if len(m.State) > MaxPresenceBytes {
+		return nil, ErrPresenceTooLarge
+	}
+	state := bytes.TrimSpace(m.State)
+	if len(state) == 0 || bytes.Equal(state, []byte("null")) {
+		state = nil
+	} else if state[0] != '{' {
+		return nil, ErrInvalidPayload
+	}
+	return &PresenceMessage{Type: TypePresence, DocId: m.DocId, SiteId: m.SiteId, State: state}, nil
+}
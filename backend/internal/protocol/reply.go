@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Machine-readable codes carried by error replies.
+const (
+	CodeMalformed            = "malformed"
+	CodeInvalidType          = "invalid_type"
+	CodeMissingDocId         = "missing_doc_id"
+	CodeMissingSiteId        = "missing_site_id"
+	CodeMissingTarget        = "missing_target"
+	CodePayloadTooLarge      = "payload_too_large"
+	CodeEmptyBatch           = "empty_batch"
+	CodeBatchTooLarge        = "batch_too_large"
+	CodeBatchMismatch        = "batch_mismatch"
+	CodeSiteMismatch         = "site_mismatch"
+	CodeSiteChanged          = "site_changed"
+	CodeMissingVersion       = "missing_version"
+	CodeUnsupportedVersion   = "unsupported_version"
+	CodeInvalidPayload       = "invalid_payload"
+	CodePresenceTooLarge     = "presence_too_large"
+	CodeOverloaded           = "overloaded"
+	CodeTooManySubscriptions = "too_many_subscriptions"
+	CodeRateLimited          = "rate_limited"
+	CodeRoomFull             = "room_full"
+	CodeStoreUnavailable     = "store_unavailable"
+)
+
+var (
+	ErrOverloaded  = errors.New("server overloaded, retry later")
+	ErrRateLimited = errors.New("rate limit exceeded, slow down")
+	ErrRoomFull    = errors.New("doc is full")
+	// ErrStoreUnavailable answers an op the room couldn't write to its log;
+	// it was not relayed and can be sent again.
+	ErrStoreUnavailable = errors.New("op could not be saved, retry later")
+)
+
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrInvalidType, CodeInvalidType},
+	{ErrMissingDocId, CodeMissingDocId},
+	{ErrMissingSiteId, CodeMissingSiteId},
+	{ErrMissingTarget, CodeMissingTarget},
+	{ErrPayloadTooLarge, CodePayloadTooLarge},
+	{ErrEmptyBatch, CodeEmptyBatch},
+	{ErrBatchTooLarge, CodeBatchTooLarge},
+	{ErrBatchMismatch, CodeBatchMismatch},
+	{ErrSiteMismatch, CodeSiteMismatch},
+	{ErrSiteChanged, CodeSiteChanged},
+	{ErrMissingVersion, CodeMissingVersion},
+	{ErrUnsupportedVersion, CodeUnsupportedVersion},
+	{ErrInvalidPayload, CodeInvalidPayload},
+	{ErrPresenceTooLarge, CodePresenceTooLarge},
+	{ErrOverloaded, CodeOverloaded},
+	{ErrTooManySubscriptions, CodeTooManySubscriptions},
+	{ErrRateLimited, CodeRateLimited},
+	{ErrRoomFull, CodeRoomFull},
+	{ErrStoreUnavailable, CodeStoreUnavailable},
+}
+
+// ErrorCodes lists every code an error reply can carry.
+func ErrorCodes() []string {
+	codes := []string{CodeMalformed}
+	for _, ec := range errorCodes {
+		codes = append(codes, ec.code)
+	}
+	return codes
+}
+
+// ErrorCode maps a validation error to its reply code. Anything that is not
+// one of the protocol errors came from decoding and is reported as malformed.
+func ErrorCode(err error) string {
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code
+		}
+	}
+	return CodeMalformed
+}
+
+type AckMessage struct {
+	Type  string `json:"type"`
+	DocId string `json:"docId"`
+	OpIds []OpId `json:"opIds"`
+}
+
+type ErrorMessage struct {
+	Type    string `json:"type"`
+	Code    string `json:"code" wire:"ErrorCode"`
+	Message string `json:"message"`
+	DocId   string `json:"docId,omitempty"`
+	OpId    *OpId  `json:"opId,omitempty"`
+}
+
+func NewAck(docId string, opIds ...OpId) ([]byte, error) {
+	return json.Marshal(AckMessage{Type: TypeAck, DocId: docId, OpIds: opIds})
+}
+
+// NewError builds an error reply. docId and opId identify the rejected message
+// when they could be decoded and may be empty.
+func NewError(err error, docId string, opId *OpId) ([]byte, error) {
+	return json.Marshal(ErrorMessage{
+		Type:    TypeError,
+		Code:    ErrorCode(err),
+		Message: err.Error(),
+		DocId:   docId,
+		OpId:    opId,
+	})
+}
@@ -0,0 +1,17 @@
+package protocol
+
+import "encoding/json"
+
+// ResendMessage asks a client to send its ops From..To (inclusive counters) for
+// a doc again, after the server saw a gap in the site's counters.
+type ResendMessage struct {
+	Type  string `json:"type"`
+	DocId string `json:"docId"`
+	Site  string `json:"site"`
+	From  int    `json:"from"`
+	To    int    `json:"to"`
+}
+
+func NewResend(docId, site string, from, to int) ([]byte, error) {
+	return json.Marshal(ResendMessage{Type: TypeResend, DocId: docId, Site: site, From: from, To: to})
+}
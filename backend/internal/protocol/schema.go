@@ -0,0 +1,54 @@
+package protocol
+
+import "reflect"
+
+//go:generate go run ../../cmd/protogen -root ../..
+
+// WireType describes one message or component for the TypeScript and JSON
+// Schema generator. Tags are the values its "type" field may take.
+type WireType struct {
+	Type       reflect.Type
+	Tags       []string
+	FromClient bool
+	FromServer bool
+}
+
+func wire(v interface{}, fromClient, fromServer bool, tags ...string) WireType {
+	return WireType{Type: reflect.TypeOf(v), Tags: tags, FromClient: fromClient, FromServer: fromServer}
+}
+
+// WireTypes lists every shape that crosses the wire, components first. Add new
+// messages here and run go generate ./internal/protocol.
+var WireTypes = []WireType{
+	wire(OpId{}, false, false),
+	wire(InsertPayload{}, false, false),
+	wire(DeletePayload{}, false, false),
+	wire(CursorPayload{}, false, false),
+	wire(Operation{}, true, true, TypeInsert, TypeDelete, TypeCursor, TypeSync),
+	wire(JoinMessage{}, true, true, TypeJoin),
+	wire(SyncOpMessage{}, true, true, TypeSyncOp),
+	wire(SyncDoneMessage{}, true, true, TypeSyncDone),
+	wire(BatchMessage{}, true, true, TypeBatch),
+	wire(HelloMessage{}, true, true, TypeHello),
+	wire(AckMessage{}, false, true, TypeAck),
+	wire(ErrorMessage{}, false, true, TypeError),
+	wire(PresenceMessage{}, true, true, TypePresence),
+	wire(PeerJoined{}, false, true, TypePeerJoined),
+	wire(PeerLeft{}, false, true, TypePeerLeft),
+	wire(RosterEntry{}, false, false),
+	wire(RosterMessage{}, false, true, TypeRoster),
+	wire(ResendMessage{}, false, true, TypeResend),
+	wire(SyncStatusMessage{}, false, true, TypeSyncStatus),
+	wire(SubscribeMessage{}, true, false, TypeSubscribe),
+	wire(UnsubscribeMessage{}, true, false, TypeUnsubscribe),
+}
+
+// WireEnums are string unions exported alongside the message types. A field
+// tagged wire:"Name" is typed as the union Name.
+var WireEnums = map[string][]string{
+	"Feature":     ServerFeatures.Names(),
+	"ErrorCode":   ErrorCodes(),
+	"Subprotocol": Subprotocols(),
+	"LeftReason":  {LeftDisconnected, LeftDropped, LeftUnsubscribed},
+	"SyncState":   {SyncRequested, SyncRetrying, SyncFailed},
+}
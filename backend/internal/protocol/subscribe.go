@@ -0,0 +1,58 @@
+package protocol
+
+import "errors"
+
+var (
+	ErrTooManySubscriptions = errors.New("connection has too many subscriptions")
+	// ErrSiteChanged rejects a message that speaks for another site than the
+	// one the connection joined the doc with.
+	ErrSiteChanged = errors.New("connection already joined as another site")
+)
+
+// SubscribeMessage adds a doc to the connection. It is answered like a join:
+// roster, cursors and the doc's content. Sending an op to a doc the
+// connection isn't subscribed to still subscribes it implicitly.
+type SubscribeMessage struct {
+	Type    string         `json:"type"`
+	DocId   string         `json:"docId"`
+	SiteId  string         `json:"siteId"`
+	Known   map[string]int `json:"known,omitempty"`
+	Epoch   string         `json:"epoch,omitempty"`
+	LastSeq uint64         `json:"lastSeq,omitempty"`
+}
+
+// UnsubscribeMessage takes a doc off the connection; the other peers see the
+// site leave with reason "unsubscribed".
+type UnsubscribeMessage struct {
+	Type  string `json:"type"`
+	DocId string `json:"docId"`
+}
+
+func (m *Message) Subscribe() (*SubscribeMessage, error) {
+	if m.Type != TypeSubscribe {
+		return nil, ErrInvalidType
+	}
+	if m.DocId == "" {
+		return nil, ErrMissingDocId
+	}
+	if m.SiteId == "" {
+		return nil, ErrMissingSiteId
+	}
+	return &SubscribeMessage{Type: TypeSubscribe, DocId: m.DocId, SiteId: m.SiteId, Known: m.Known, Epoch: m.Epoch, LastSeq: m.LastSeq}, nil
+}
+
+func (m *Message) Unsubscribe() (*UnsubscribeMessage, error) {
+	if m.Type != TypeUnsubscribe {
+		return nil, ErrInvalidType
+	}
+	if m.DocId == "" {
+		return nil, ErrMissingDocId
+	}
+	return &UnsubscribeMessage{Type: TypeUnsubscribe, DocId: m.DocId}, nil
+}
+
+// Join is the join frame a subscribe stands for, as a peer answering the
+// sync request expects it.
+func (s *SubscribeMessage) Join() *JoinMessage {
+	return &JoinMessage{Type: TypeJoin, DocId: s.DocId, SiteId: s.SiteId, Known: s.Known, Epoch: s.Epoch, LastSeq: s.LastSeq}
+}
@@ -0,0 +1,25 @@
+package protocol
+
+import "encoding/json"
+
+// States carried by sync_status.
+const (
+	SyncRequested = "requested"
+	SyncRetrying  = "retrying"
+	SyncFailed    = "failed"
+)
+
+// SyncStatusMessage tells a joiner how the server is getting its doc from
+// other peers: which attempt is running and how many sync ops have been
+// relayed so far. A failed sync is still followed by sync_done.
+type SyncStatusMessage struct {
+	Type    string `json:"type"`
+	DocId   string `json:"docId"`
+	State   string `json:"state" wire:"SyncState"`
+	Attempt int    `json:"attempt"`
+	Ops     int    `json:"ops"`
+}
+
+func NewSyncStatus(docId, state string, attempt, ops int) ([]byte, error) {
+	return json.Marshal(SyncStatusMessage{Type: TypeSyncStatus, DocId: docId, State: state, Attempt: attempt, Ops: ops})
+}
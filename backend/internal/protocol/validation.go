@@ -5,7 +5,10 @@ import (
 	"errors"
 )
 
-const MaxPayloadBytes = 1 << 20
+const (
+	MaxPayloadBytes = 1 << 20
+	MaxBatchOps     = 1000
+)
 
 var (
 	ErrInvalidType     = errors.New("invalid operation type")
@@ -13,80 +16,166 @@ var (
 	ErrMissingSiteId   = errors.New("missing siteId")
 	ErrMissingTarget   = errors.New("missing target")
 	ErrPayloadTooLarge = errors.New("payload exceeds max size")
+	ErrEmptyBatch      = errors.New("batch has no operations")
+	ErrBatchTooLarge   = errors.New("batch exceeds max operations")
+	ErrBatchMismatch   = errors.New("batched operation belongs to another doc or site")
+	// ErrSiteMismatch rejects an insert or delete whose opId names another
+	// site than the one sending it, which would let it pass for that site's
+	// op in the room's duplicate check.
+	ErrSiteMismatch = errors.New("opId belongs to another site")
 )
 
-type messageEnvelope struct {
-	Type   string `json:"type"`
-	DocId  string `json:"docId"`
-	Target string `json:"target"`
-}
-
-func ValidateOperation(raw []byte) (*Operation, error) {
+func DecodeMessage(raw []byte) (*Message, error) {
 	if len(raw) > MaxPayloadBytes {
 		return nil, ErrPayloadTooLarge
 	}
-	var op Operation
-	if err := json.Unmarshal(raw, &op); err != nil {
+	var m Message
+	if err := json.Unmarshal(raw, &m); err != nil {
 		return nil, err
 	}
-	if !ValidOperationTypes[op.Type] {
+	return &m, nil
+}
+
+func (m *Message) Operation() (*Operation, error) {
+	if !ValidOperationTypes[m.Type] {
 		return nil, ErrInvalidType
 	}
-	if op.DocId == "" {
+	if m.DocId == "" {
 		return nil, ErrMissingDocId
 	}
-	if op.SiteId == "" {
+	if m.SiteId == "" {
 		return nil, ErrMissingSiteId
 	}
-	return &op, nil
+	op := &Operation{
+		Type:        m.Type,
+		DocId:       m.DocId,
+		SiteId:      m.SiteId,
+		OpId:        m.OpId,
+		Payload:     m.Payload,
+		Timestamp:   m.Timestamp,
+		InverseOpId: m.InverseOpId,
+	}
+	if err := op.validatePayload(); err != nil {
+		return nil, err
+	}
+	if ValidBatchedTypes[op.Type] && op.OpId.Site != op.SiteId {
+		return nil, ErrSiteMismatch
+	}
+	return op, nil
 }
 
-func ParseMessageType(raw []byte) (msgType string, err error) {
-	var env struct {
-		Type string `json:"type"`
+func (m *Message) Join() (*JoinMessage, error) {
+	if m.Type != TypeJoin {
+		return nil, ErrInvalidType
 	}
-	if err := json.Unmarshal(raw, &env); err != nil {
-		return "", err
+	if m.DocId == "" {
+		return nil, ErrMissingDocId
 	}
-	return env.Type, nil
+	if m.SiteId == "" {
+		return nil, ErrMissingSiteId
+	}
+	return &JoinMessage{
+		Type:    m.Type,
+		DocId:   m.DocId,
+		SiteId:  m.SiteId,
+		Known:   m.Known,
+		Epoch:   m.Epoch,
+		LastSeq: m.LastSeq,
+	}, nil
 }
 
-func ValidateJoin(raw []byte) (*JoinMessage, error) {
-	if len(raw) > MaxPayloadBytes {
-		return nil, ErrPayloadTooLarge
+func (m *Message) Targeted() (docId, target string, err error) {
+	if !ValidTargetedTypes[m.Type] {
+		return "", "", ErrInvalidType
 	}
-	var j JoinMessage
-	if err := json.Unmarshal(raw, &j); err != nil {
-		return nil, err
+	if m.DocId == "" {
+		return "", "", ErrMissingDocId
+	}
+	if m.Target == "" {
+		return "", "", ErrMissingTarget
 	}
-	if j.Type != TypeJoin {
+	return m.DocId, m.Target, nil
+}
+
+// Batch validates a batch as a unit: one bad operation rejects the whole
+// batch. Operations may omit docId and siteId, which default to the batch's.
+// Repeated OpIds within the batch are dropped.
+func (m *Message) Batch() (*BatchMessage, error) {
+	if m.Type != TypeBatch {
 		return nil, ErrInvalidType
 	}
-	if j.DocId == "" {
+	if m.DocId == "" {
 		return nil, ErrMissingDocId
 	}
-	if j.SiteId == "" {
+	if m.SiteId == "" {
 		return nil, ErrMissingSiteId
 	}
-	return &j, nil
+	if len(m.Ops) == 0 {
+		return nil, ErrEmptyBatch
+	}
+	if len(m.Ops) > MaxBatchOps {
+		return nil, ErrBatchTooLarge
+	}
+	seen := make(map[OpId]bool, len(m.Ops))
+	ops := make([]Operation, 0, len(m.Ops))
+	for _, op := range m.Ops {
+		if !ValidBatchedTypes[op.Type] {
+			return nil, ErrInvalidType
+		}
+		if op.DocId == "" {
+			op.DocId = m.DocId
+		}
+		if op.SiteId == "" {
+			op.SiteId = m.SiteId
+		}
+		if op.DocId != m.DocId || op.SiteId != m.SiteId {
+			return nil, ErrBatchMismatch
+		}
+		if err := op.validatePayload(); err != nil {
+			return nil, err
+		}
+		if op.OpId.Site != op.SiteId {
+			return nil, ErrSiteMismatch
+		}
+		if seen[op.OpId] {
+			continue
+		}
+		seen[op.OpId] = true
+		ops = append(ops, op)
+	}
+	return &BatchMessage{Type: TypeBatch, DocId: m.DocId, SiteId: m.SiteId, Ops: ops}, nil
 }
 
-func ParseTargetedMessage(raw []byte) (docId, target string, err error) {
-	if len(raw) > MaxPayloadBytes {
-		return "", "", ErrPayloadTooLarge
+func ValidateOperation(raw []byte) (*Operation, error) {
+	m, err := DecodeMessage(raw)
+	if err != nil {
+		return nil, err
 	}
-	var env messageEnvelope
-	if err := json.Unmarshal(raw, &env); err != nil {
-		return "", "", err
+	return m.Operation()
+}
+
+func ParseMessageType(raw []byte) (msgType string, err error) {
+	var env struct {
+		Type string `json:"type"`
 	}
-	if !ValidTargetedTypes[env.Type] {
-		return "", "", ErrInvalidType
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return "", err
 	}
-	if env.DocId == "" {
-		return "", "", ErrMissingDocId
+	return env.Type, nil
+}
+
+func ValidateJoin(raw []byte) (*JoinMessage, error) {
+	m, err := DecodeMessage(raw)
+	if err != nil {
+		return nil, err
 	}
-	if env.Target == "" {
-		return "", "", ErrMissingTarget
+	return m.Join()
+}
+
+func ParseTargetedMessage(raw []byte) (docId, target string, err error) {
+	m, err := DecodeMessage(raw)
+	if err != nil {
+		return "", "", err
 	}
-	return env.DocId, env.Target, nil
+	return m.Targeted()
 }
@@ -0,0 +1,74 @@
+package protocol
+
+import "testing"
+
+func TestBatchValidation(t *testing.T) {
+	m, err := DecodeMessage([]byte(`{"type":"batch","docId":"d","siteId":"s","ops":[` +
+		`{"type":"insert","opId":{"site":"s","counter":1},"payload":{"position":[5],"value":"a"}},` +
+		`{"type":"insert","opId":{"site":"s","counter":1},"payload":{"position":[5],"value":"a"}},` +
+		`{"type":"delete","docId":"d","siteId":"s","opId":{"site":"s","counter":2},"payload":{"position":[5]}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := m.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Ops) != 2 {
+		t.Fatalf("expected duplicate op dropped, got %d ops", len(b.Ops))
+	}
+	if b.Ops[0].DocId != "d" || b.Ops[0].SiteId != "s" {
+		t.Errorf("batch defaults not applied: %+v", b.Ops[0])
+	}
+
+	bad := map[string]error{
+		`{"type":"batch","docId":"d","siteId":"s","ops":[]}`:                                                                             ErrEmptyBatch,
+		`{"type":"batch","siteId":"s","ops":[{"type":"insert"}]}`:                                                                        ErrMissingDocId,
+		`{"type":"batch","docId":"d","siteId":"s","ops":[{"type":"join"}]}`:                                                              ErrInvalidType,
+		`{"type":"batch","docId":"d","siteId":"s","ops":[{"type":"insert","docId":"other"}]}`:                                            ErrBatchMismatch,
+		`{"type":"batch","docId":"d","siteId":"s","ops":[{"type":"insert","siteId":"impostor"}]}`:                                        ErrBatchMismatch,
+		`{"type":"batch","docId":"d","siteId":"s","ops":[{"type":"delete","payload":{}}]}`:                                               ErrInvalidPayload,
+		`{"type":"batch","docId":"d","siteId":"s","ops":[{"type":"delete","opId":{"site":"t","counter":1},"payload":{"position":[5]}}]}`: ErrSiteMismatch,
+	}
+	for raw, want := range bad {
+		m, err := DecodeMessage([]byte(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Batch(); err != want {
+			t.Errorf("%s: got %v, want %v", raw, err, want)
+		}
+	}
+}
+
+func TestOperationPayloadValidation(t *testing.T) {
+	bad := []string{
+		`{"type":"insert","docId":"d","siteId":"s"}`,
+		`{"type":"insert","docId":"d","siteId":"s","payload":{"position":[],"value":"a"}}`,
+		`{"type":"delete","docId":"d","siteId":"s","payload":{"position":"5"}}`,
+	}
+	for _, raw := range bad {
+		m, err := DecodeMessage([]byte(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Operation(); err != ErrInvalidPayload {
+			t.Errorf("%s: got %v, want ErrInvalidPayload", raw, err)
+		}
+	}
+	m, _ := DecodeMessage([]byte(`{"type":"cursor","docId":"d","siteId":"s"}`))
+	if _, err := m.Operation(); err != nil {
+		t.Errorf("cursor payloads are not checked: %v", err)
+	}
+}
+
+func TestOperationSiteMismatch(t *testing.T) {
+	m, _ := DecodeMessage([]byte(`{"type":"insert","docId":"d","siteId":"s","opId":{"site":"t","counter":1},"payload":{"position":[5],"value":"a"}}`))
+	if _, err := m.Operation(); err != ErrSiteMismatch {
+		t.Errorf("insert under another site's opId: got %v, want ErrSiteMismatch", err)
+	}
+	m, _ = DecodeMessage([]byte(`{"type":"insert","docId":"d","siteId":"s","opId":{"site":"s","counter":1},"payload":{"position":[5],"value":"a"}}`))
+	if _, err := m.Operation(); err != nil {
+		t.Errorf("insert under its own opId: %v", err)
+	}
+}
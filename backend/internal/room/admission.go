@@ -0,0 +1,85 @@
+package room
+
+import (
+	"skepsi/backend/internal/logger"
+	"skepsi/backend/internal/metrics"
+	"skepsi/backend/internal/protocol"
+)
+
+// A room with a peer cap turns away joins once it holds that many peers. A
+// joiner that negotiated the observe feature is let in as an observer instead,
+// up to the observer cap: it gets the doc and everything relayed to it, but it
+// is left out of presence and nothing it sends is relayed. Observers don't
+// count towards the peer cap and stay observers until they rejoin.
+
+// full reports whether a new connection can only join as an observer.
+func (r *room) full() bool {
+	return r.cfg.maxPeers > 0 && len(r.peersByConn)-r.observers >= r.cfg.maxPeers
+}
+
+// admit reports whether a new connection can join, and whether as an observer.
+func (r *room) admit(features protocol.FeatureSet) (ok, observer bool) {
+	if !r.full() {
+		return true, false
+	}
+	if !features.Has(protocol.FeatureObserve) || r.observers >= r.cfg.maxObservers {
+		return false, false
+	}
+	return true, true
+}
+
+// refuse tells a connection the room had no space for it, if it asked for
+// acks. Every message it sends to the doc comes with another join, so it hears
+// again each time.
+func (r *room) refuse(connID uint64, ch chan *protocol.Frame, features protocol.FeatureSet) {
+	metrics.IncJoinsRefused()
+	logger.WithConnAndDoc(connID, r.docId).Info("join_refused", "peers", len(r.peersByConn)-r.observers, "observers", r.observers)
+	r.reportGone(connID)
+	r.manager.Refuse(r.docId, connID)
+	if !features.Has(protocol.FeatureAcks) {
+		return
+	}
+	if raw, err := protocol.NewError(protocol.ErrRoomFull, r.docId, nil); err == nil {
+		safeSend(ch, protocol.NewFrame(raw))
+	}
+}
+
+// canWrite reports whether what connID sends may go out to the room. Writes
+// from an observer are answered with room_full, one error per op.
+func (r *room) canWrite(connID uint64, opIds ...protocol.OpId) bool {
+	p, ok := r.peersByConn[connID]
+	if !ok {
+		return false
+	}
+	if !p.observer {
+		return true
+	}
+	if !p.features.Has(protocol.FeatureAcks) {
+		return false
+	}
+	for i := range opIds {
+		raw, err := protocol.NewError(protocol.ErrRoomFull, r.docId, &opIds[i])
+		if err != nil || !r.send(p, raw) {
+			return false
+		}
+	}
+	return false
+}
+
+// Full reports whether the doc's room would turn away any new connection, so
+// it can be refused before the websocket upgrade. A doc without a room isn't
+// full.
+func (m *Manager) Full(docId string) bool {
+	if m.cfg.maxPeers == 0 {
+		return false
+	}
+	s := m.shardFor(docId)
+	s.mu.Lock()
+	r, ok := s.rooms[docId]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	peers, observers := r.peerCount.Load(), r.observerCount.Load()
+	return peers-observers >= uint64(m.cfg.maxPeers) && observers >= uint64(m.cfg.maxObservers)
+}
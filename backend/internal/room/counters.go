@@ -0,0 +1,197 @@
+package room
+
+import (
+	"encoding/json"
+	"slices"
+
+	"skepsi/backend/internal/metrics"
+	"skepsi/backend/internal/protocol"
+)
+
+// maxTrackedCounters bounds the out-of-order counters kept per site. Past it the
+// room stops waiting for the oldest gap.
+const maxTrackedCounters = 4096
+
+// siteCounters tracks which op counters of one site a room has relayed. The
+// first counter seen is the floor: everything from floor to contiguous has been
+// seen, anything else that has is kept in seen until the gap below it fills.
+type siteCounters struct {
+	floor      int
+	contiguous int
+	highest    int
+	seen       map[int]bool
+}
+
+// seen reports whether the room has already relayed an insert or delete.
+func (r *room) seen(op *protocol.Operation) bool {
+	sc, ok := r.counters[op.OpId.Site]
+	return ok && sc.has(op.OpId.Counter)
+}
+
+// observe records a new insert or delete. A counter past the highest one seen
+// so far opens a gap, and the sender is asked to resend what is missing.
+func (r *room) observe(connID uint64, op *protocol.Operation) {
+	site, c := op.OpId.Site, op.OpId.Counter
+	sc, ok := r.counters[site]
+	if !ok {
+		r.counters[site] = newSiteCounters(c)
+		return
+	}
+	highest := sc.highest
+	sc.add(c)
+	if c > highest+1 {
+		metrics.IncCounterGaps()
+		r.requestResend(connID, site, highest+1, c-1)
+	}
+}
+
+func newSiteCounters(c int) *siteCounters {
+	return &siteCounters{floor: c, contiguous: c, highest: c, seen: make(map[int]bool)}
+}
+
+// restoredCounters rebuilds a site's counters as a snapshot recorded them.
+func restoredCounters(floor, contiguous int, seen []int) *siteCounters {
+	sc := &siteCounters{floor: floor, contiguous: contiguous, highest: contiguous, seen: make(map[int]bool, len(seen))}
+	for _, c := range seen {
+		sc.add(c)
+	}
+	return sc
+}
+
+// above lists the counters seen past the first gap, for a snapshot.
+func (sc *siteCounters) above() []int {
+	if len(sc.seen) == 0 {
+		return nil
+	}
+	cs := make([]int, 0, len(sc.seen))
+	for c := range sc.seen {
+		cs = append(cs, c)
+	}
+	slices.Sort(cs)
+	return cs
+}
+
+func (sc *siteCounters) has(c int) bool {
+	return (c >= sc.floor && c <= sc.contiguous) || sc.seen[c]
+}
+
+// add records counter c and reports whether it had not been seen before.
+func (sc *siteCounters) add(c int) bool {
+	if sc.has(c) {
+		return false
+	}
+	if c > sc.highest {
+		sc.highest = c
+	}
+	sc.seen[c] = true
+	sc.advance()
+	if len(sc.seen) > maxTrackedCounters {
+		sc.skipGap()
+	}
+	return true
+}
+
+func (sc *siteCounters) advance() {
+	for sc.seen[sc.contiguous+1] {
+		delete(sc.seen, sc.contiguous+1)
+		sc.contiguous++
+	}
+}
+
+// skipGap forgets counters below the floor, then gives up on the oldest gap
+// until the site is back under the limit.
+func (sc *siteCounters) skipGap() {
+	for c := range sc.seen {
+		if c < sc.floor {
+			delete(sc.seen, c)
+		}
+	}
+	for len(sc.seen) > maxTrackedCounters {
+		next := sc.highest
+		for c := range sc.seen {
+			if c < next {
+				next = c
+			}
+		}
+		delete(sc.seen, next)
+		sc.contiguous = next
+		sc.advance()
+	}
+}
+
+func (r *room) requestResend(connID uint64, site string, from, to int) {
+	p, ok := r.peersByConn[connID]
+	if !ok || !p.features.Has(protocol.FeatureResend) {
+		return
+	}
+	raw, err := protocol.NewResend(r.docId, site, from, to)
+	if err != nil {
+		return
+	}
+	r.send(p, raw)
+}
+
+func tracked(op *protocol.Operation) bool {
+	return op.Type == protocol.TypeInsert || op.Type == protocol.TypeDelete
+}
+
+// accept applies a new insert or delete to the op log and the replica, and
+// returns the frame to relay with its seq stamped in, raising the sender's
+// known counter for the op's site. It reports false for ops
+// the room has already relayed, and an error for ops it couldn't log, which
+// are left as if the room had never seen them.
+func (r *room) accept(connID uint64, op *protocol.Operation, raw []byte) ([]byte, bool, error) {
+	if !tracked(op) {
+		return raw, true, nil
+	}
+	if r.seen(op) {
+		metrics.IncDuplicateOps()
+		return nil, false, nil
+	}
+	raw = r.stamp(op, raw)
+	if err := r.persist(raw); err != nil {
+		r.seq--
+		op.Seq = 0
+		return nil, false, err
+	}
+	r.observe(connID, op)
+	if p, ok := r.peersByConn[connID]; ok {
+		p.know(op.OpId)
+	}
+	cp := *op
+	r.recent.push(&cp)
+	r.replica.apply(op)
+	r.scheduleSnapshot()
+	return raw, true, nil
+}
+
+// acceptBatch drops ops the room has already relayed and re-encodes the batch
+// frame with the seqs of the rest. It also returns the ids of the ops it
+// couldn't log.
+func (r *room) acceptBatch(connID uint64, batch *protocol.BatchMessage, raw []byte, opRaws [][]byte) ([]byte, [][]byte, []protocol.OpId) {
+	fresh := make([]protocol.Operation, 0, len(batch.Ops))
+	freshRaws := make([][]byte, 0, len(opRaws))
+	var failed []protocol.OpId
+	for i := range batch.Ops {
+		opRaw, ok, err := r.accept(connID, &batch.Ops[i], opRaws[i])
+		if err != nil {
+			failed = append(failed, batch.Ops[i].OpId)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		fresh = append(fresh, batch.Ops[i])
+		freshRaws = append(freshRaws, opRaw)
+	}
+	if len(fresh) == 0 {
+		return raw, freshRaws, failed
+	}
+	stamped := *batch
+	stamped.Ops = fresh
+	out, err := json.Marshal(stamped)
+	if err != nil {
+		return raw, freshRaws, failed
+	}
+	return out, freshRaws, failed
+}
@@ -0,0 +1,67 @@
+package room
+
+import (
+	"time"
+
+	"skepsi/backend/internal/metrics"
+)
+
+// Cursor updates are latest-value-wins: a room keeps only the newest cursor of
+// each site and sends the ones that changed at most once per flush interval.
+// An update that arrives before the previous one went out replaces it.
+
+type cursor struct {
+	raw   []byte
+	dirty bool
+}
+
+func (r *room) setCursor(connID uint64, siteId string, raw []byte) {
+	if _, ok := r.peersByConn[connID]; !ok {
+		return
+	}
+	c, ok := r.cursors[siteId]
+	if !ok {
+		c = &cursor{}
+		r.cursors[siteId] = c
+	} else if c.dirty {
+		metrics.IncCursorsCoalesced()
+	}
+	c.raw, c.dirty = raw, true
+	if r.cfg.cursorFlushInterval == 0 {
+		r.flushCursors()
+		return
+	}
+	if r.cursorFlush == nil {
+		r.cursorFlush = time.After(r.cfg.cursorFlushInterval)
+	}
+}
+
+func (r *room) flushCursors() {
+	for siteId, c := range r.cursors {
+		if !c.dirty {
+			continue
+		}
+		c.dirty = false
+		for _, p := range r.peersByConn {
+			if p.siteId != siteId {
+				r.send(p, c.raw)
+			}
+		}
+	}
+}
+
+// sendCursors gives a joiner the current cursor of every other site.
+func (r *room) sendCursors(joiner *peer) {
+	for siteId, c := range r.cursors {
+		if siteId == joiner.siteId {
+			continue
+		}
+		if !r.send(joiner, c.raw) {
+			return
+		}
+	}
+}
+
+func (r *room) dropCursor(siteId string) {
+	delete(r.cursors, siteId)
+}
@@ -0,0 +1,91 @@
+package room
+
+import (
+	"time"
+
+	"skepsi/backend/internal/logger"
+	"skepsi/backend/internal/metrics"
+)
+
+// A peer whose send queue is full has missed whatever the room just tried to
+// send it. Under the resync policy it is marked as lagging instead of counting
+// failures towards a drop: nothing more is queued for it, acks it is owed are
+// saved up, and once its queue has drained it is caught up. It gets the ops it
+// missed from the recent ops ring, or the whole doc from the replica if the
+// ring has moved past them, as a replay ahead of anything live, then roster
+// and cursors. The saved acks follow the replay. A sync it was waiting on is
+// asked for again. A peer that doesn't drain within maxLag is dropped after
+// all.
+
+// SlowConsumerPolicy says what a room does with a peer that can't keep up.
+type SlowConsumerPolicy string
+
+const (
+	// SlowConsumerResync stops sending to the peer and catches it up once it
+	// has drained.
+	SlowConsumerResync SlowConsumerPolicy = "resync"
+	// SlowConsumerDrop drops the peer after a few sends in a row fail.
+	SlowConsumerDrop SlowConsumerPolicy = "drop"
+)
+
+const (
+	lagCheckInterval = 50 * time.Millisecond
+	maxLag           = 30 * time.Second
+)
+
+// lag marks p as lagging from seq from, usually the seq the room was at
+// before the frame it couldn't take.
+func (r *room) lag(p *peer, from uint64) {
+	p.lagging = true
+	p.lagSeq = from
+	p.laggedAt = time.Now()
+	metrics.IncSlowConsumers()
+	logger.WithConnAndDoc(p.connID, r.docId).Warn("peer_lagging", "seq", p.lagSeq, "queued", len(p.ch))
+	if r.lagCheck == nil {
+		r.lagCheck = time.After(lagCheckInterval)
+	}
+}
+
+// checkLagging catches up every lagging peer whose queue is down to a quarter
+// and drops those that have lagged too long.
+func (r *room) checkLagging() {
+	lagging := false
+	for _, p := range r.peersByConn {
+		if !p.lagging {
+			continue
+		}
+		switch {
+		case len(p.ch) <= cap(p.ch)/4:
+			r.catchUp(p)
+		case time.Since(p.laggedAt) > maxLag:
+			metrics.IncSlowConsumerDrops()
+			logger.WithConnAndDoc(p.connID, r.docId).Warn("lagging_peer_dropped", "lagged", time.Since(p.laggedAt))
+			r.dropPeer(p)
+		default:
+			lagging = true
+		}
+	}
+	if lagging {
+		r.lagCheck = time.After(lagCheckInterval)
+	}
+}
+
+func (r *room) catchUp(p *peer) {
+	from := p.lagSeq
+	p.lagging = false
+	msgs, ok := r.syncSince(p.siteId, from)
+	if !ok {
+		msgs = append(r.replica.syncOps(r.docId, p.siteId), r.syncDone(p.siteId))
+	}
+	metrics.IncSlowConsumerResyncs()
+	logger.WithConnAndDoc(p.connID, r.docId).Info("peer_caught_up", "from", from, "to", r.seq, "frames", len(msgs), "full", !ok)
+	if r.syncing(p) {
+		// Its sync_done is still to come from the sync it is waiting on.
+		msgs = msgs[:len(msgs)-1]
+	}
+	r.replay(p, from, msgs)
+	r.flushAcks(p)
+	r.sendRoster(p)
+	r.sendCursors(p)
+	r.resumeSync(p)
+}
@@ -0,0 +1,33 @@
+package room
+
+// A leave is the one command a shard can't drop when a room's queue is full: the
+// connection is gone, and the room would keep relaying to it. So a leave that
+// doesn't fit is handed to the room on the side, with the number of commands
+// the shard had queued before it. The room takes it once it has handled that
+// many, so it still comes after a join for the same connection that was
+// queued first.
+
+type deferredLeave struct {
+	cmd   roomCmd
+	after uint64
+}
+
+// deferLeave runs on the shard goroutine.
+func (r *room) deferLeave(cmd roomCmd, after uint64) {
+	r.leavesMu.Lock()
+	r.leaves = append(r.leaves, deferredLeave{cmd: cmd, after: after})
+	r.leavesMu.Unlock()
+}
+
+func (r *room) takeDeferredLeaves() {
+	r.leavesMu.Lock()
+	var due []roomCmd
+	for len(r.leaves) > 0 && r.leaves[0].after <= r.handled {
+		due = append(due, r.leaves[0].cmd)
+		r.leaves = r.leaves[1:]
+	}
+	r.leavesMu.Unlock()
+	for _, cmd := range due {
+		r.handle(cmd)
+	}
+}
@@ -0,0 +1,143 @@
+package room
+
+import (
+	"time"
+
+	"skepsi/backend/internal/logger"
+	"skepsi/backend/internal/metrics"
+)
+
+// A room with no peers hibernates once it has been empty for the idle TTL: the
+// manager forgets it, the room snapshots to the store and its goroutine exits.
+// The next join for the doc starts a new room that restores from the store.
+//
+// The room can't tell on its own whether a join is already on the way, so it
+// only reports that it is idle, along with how many joins it has handled. Its
+// shard evicts it only if it hasn't routed any join since.
+
+type roomEvent struct {
+	room    *room
+	joins   uint64
+	stopped bool
+	// gone is a connection the room dropped or turned away on its own, which
+	// the shard no longer needs to send a leave.
+	gone uint64
+}
+
+// checkIdle arms the idle timer when the room has emptied and disarms it when
+// someone is back. It runs after everything the room handles.
+func (r *room) checkIdle() {
+	if len(r.peersByConn) > 0 {
+		r.idle = nil
+		return
+	}
+	if r.idle == nil && r.cfg.idleTTL > 0 {
+		r.idle = time.After(r.cfg.idleTTL)
+	}
+}
+
+// reportIdle asks the manager to evict the room. If the manager is busy the
+// room just stays up and asks again after another TTL.
+func (r *room) reportIdle() {
+	select {
+	case r.shard.events <- roomEvent{room: r, joins: r.joins}:
+	default:
+	}
+}
+
+// reportGone tells the shard a connection isn't in the room any more. Like
+// reportIdle it gives up if the shard is busy; the shard then just sends the
+// connection a leave it didn't need when it disconnects.
+func (r *room) reportGone(connID uint64) {
+	select {
+	case r.shard.events <- roomEvent{room: r, joins: r.joins, gone: connID}:
+	default:
+	}
+}
+
+// hibernate runs once the manager has evicted the room. Nothing is routed to
+// it any more, so it saves what it has and stops.
+func (r *room) hibernate() {
+	if r.cfg.store != nil {
+		if r.unsnapped > 0 {
+			r.snapshot()
+		}
+		if err := r.cfg.store.Release(r.docId); err != nil {
+			logger.WithDoc(r.docId).Error("store_release_failed", "error", err)
+		}
+	}
+	logger.WithDoc(r.docId).Info("room_hibernated", "version", r.version)
+	close(r.stopped)
+	select {
+	case r.shard.events <- roomEvent{room: r, stopped: true}:
+	case <-r.shard.done:
+	}
+}
+
+// stop hibernates every room the shard still runs when the manager shuts down
+// and waits until they and those already hibernating have stopped. Events the
+// rooms send meanwhile no longer matter; they are only drained so no room
+// waits on the shard.
+func (s *shard) stop() {
+	s.mu.Lock()
+	rooms := make([]*room, 0, len(s.rooms)+len(s.hibernating))
+	for docId, r := range s.rooms {
+		rooms = append(rooms, r)
+		delete(s.rooms, docId)
+	}
+	s.mu.Unlock()
+	for _, r := range rooms {
+		for sent := false; !sent; {
+			select {
+			case r.commands <- roomCmd{hibernate: true}:
+				sent = true
+			case <-s.events:
+			}
+		}
+	}
+	for _, r := range s.hibernating {
+		rooms = append(rooms, r)
+	}
+	for _, r := range rooms {
+		for stopped := false; !stopped; {
+			select {
+			case <-r.stopped:
+				stopped = true
+			case <-s.events:
+			}
+		}
+	}
+}
+
+func (s *shard) handleEvent(ev roomEvent) {
+	r := ev.room
+	if ev.gone != 0 {
+		// A join routed since might have put the connection back.
+		if docs := s.joined[ev.gone]; docs != nil && r.routedJoins == ev.joins && s.rooms[r.docId] == r {
+			delete(docs, r.docId)
+			if len(docs) == 0 {
+				delete(s.joined, ev.gone)
+			}
+		}
+		return
+	}
+	if ev.stopped {
+		if s.hibernating[r.docId] == r {
+			delete(s.hibernating, r.docId)
+		}
+		return
+	}
+	// Like any command, the hibernate is only queued if it fits. A room whose
+	// queue is full stays up and reports idle again after another TTL.
+	s.mu.Lock()
+	evict := s.rooms[r.docId] == r && r.routedJoins == ev.joins && s.queue(r, roomCmd{hibernate: true})
+	if evict {
+		delete(s.rooms, r.docId)
+	}
+	s.mu.Unlock()
+	if !evict {
+		return
+	}
+	s.hibernating[r.docId] = r
+	metrics.IncRoomsEvicted()
+}
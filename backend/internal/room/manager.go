@@ -2,12 +2,14 @@ package room
 
 import (
 	"context"
-	"math/rand"
+	"encoding/json"
+	"hash/fnv"
 	"sync"
 	"time"
 
 	"skepsi/backend/internal/logger"
 	"skepsi/backend/internal/metrics"
+	"skepsi/backend/internal/protocol"
 )
 
 const (
@@ -18,84 +20,113 @@ const (
 
 type Manager struct {
 	onDrop   func(connID uint64)
+	onRefuse func(docId string, connID uint64)
+	mu       sync.Mutex
+	cfg      config
+	shards   []*shard
+}
+
+// shard owns the rooms of the docs that hash to it. All commands for a doc go
+// through the same shard, so they reach its room in the order they were sent.
+type shard struct {
+	manager  *Manager
 	rooms    map[string]*room
 	commands chan managerCmd
 	mu       sync.Mutex
 	done     chan struct{}
+
+	events      chan roomEvent
+	hibernating map[string]*room
+	// joined indexes the docs each connection has joined on this shard, so
+	// a disconnect only reaches those rooms. Owned by the shard goroutine.
+	joined map[uint64]map[string]bool
 }
 
 type managerCmd struct {
 	ensureJoin *struct {
-		docId   string
-		connID  uint64
-		siteId  string
-		sendCh  chan []byte
+		docId    string
+		connID   uint64
+		siteId   string
+		sendCh   chan *protocol.Frame
+		features protocol.FeatureSet
+	}
+	leaveAll *uint64
+	leave    *struct {
+		docId  string
+		connID uint64
 	}
-	leaveAll  *uint64
 	broadcast *struct {
 		docId   string
+		op      *protocol.Operation
 		raw     []byte
 		exclude uint64
 	}
-	forwardJoinToOnePeer *struct {
-		docId         string
-		excludeConnID uint64
-		raw          []byte
+	broadcastBatch *struct {
+		docId   string
+		batch   *protocol.BatchMessage
+		raw     []byte
+		opRaws  [][]byte
+		exclude uint64
+	}
+	syncJoin *struct {
+		docId   string
+		connID  uint64
+		known   map[string]int
+		epoch   string
+		lastSeq uint64
+		raw     []byte
 	}
 	sendToTarget *struct {
 		docId        string
+		from         uint64
+		msgType      string
 		targetSiteId string
 		raw          []byte
 	}
+	presence *struct {
+		docId  string
+		connID uint64
+		state  json.RawMessage
+	}
 }
 
-const dropAfterFailures = 5
-
-type peer struct {
-	connID       uint64
-	siteId       string
-	ch           chan []byte
-	sendFailures int
-}
-
-type room struct {
-	docId       string
-	peersByConn map[uint64]*peer
-	siteToConn  map[string]uint64
-	commands    chan roomCmd
-	manager     *Manager
-}
-
-type roomCmd struct {
-	join     *struct {
-		connID uint64
-		siteId string
-		ch     chan []byte
+func NewManager(onDrop func(connID uint64), opts ...Option) *Manager {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
 	}
-	leave    *uint64
-	broadcast *struct {
-		raw     []byte
-		exclude uint64
+	if cfg.store != nil {
+		metrics.SetSnapshotSchedule(uint64(cfg.snapshotEveryOps), uint64(cfg.snapshotInterval/time.Second))
 	}
-	forwardJoinToOnePeer *struct {
-		excludeConnID uint64
-		raw          []byte
+	m := &Manager{
+		onDrop: onDrop,
+		cfg:    cfg,
+		shards: make([]*shard, cfg.shards),
 	}
-	sendToTarget *struct {
-		targetSiteId string
-		raw          []byte
+	for i := range m.shards {
+		s := &shard{
+			manager:  m,
+			rooms:    make(map[string]*room),
+			commands: make(chan managerCmd, managerCommandBuffer),
+			done:     make(chan struct{}),
+
+			events:      make(chan roomEvent, managerCommandBuffer),
+			hibernating: make(map[string]*room),
+			joined:      make(map[uint64]map[string]bool),
+		}
+		m.shards[i] = s
+		go s.run()
 	}
+	return m
 }
 
-func NewManager(onDrop func(connID uint64)) *Manager {
-	m := &Manager{
-		onDrop:   onDrop,
-		rooms:    make(map[string]*room),
-		commands: make(chan managerCmd, managerCommandBuffer),
-		done:     make(chan struct{}),
+func (m *Manager) shardFor(docId string) *shard {
+	if len(m.shards) == 1 {
+		return m.shards[0]
 	}
-	go m.run()
-	return m
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(docId))
+	return m.shards[h.Sum32()%uint32(len(m.shards))]
 }
 
 func (m *Manager) SetDropCallback(fn func(connID uint64)) {
@@ -113,205 +144,260 @@ func (m *Manager) Drop(connID uint64) {
 	}
 }
 
-func (m *Manager) run() {
-	defer close(m.done)
-	for cmd := range m.commands {
-		if cmd.ensureJoin != nil {
-			e := cmd.ensureJoin
-			m.mu.Lock()
-			r, ok := m.rooms[e.docId]
+// SetRefuseCallback sets what is told when a room turns a connection away,
+// so its subscription can be forgotten.
+func (m *Manager) SetRefuseCallback(fn func(docId string, connID uint64)) {
+	m.mu.Lock()
+	m.onRefuse = fn
+	m.mu.Unlock()
+}
+
+func (m *Manager) Refuse(docId string, connID uint64) {
+	m.mu.Lock()
+	fn := m.onRefuse
+	m.mu.Unlock()
+	if fn != nil {
+		fn(docId, connID)
+	}
+}
+
+func (s *shard) run() {
+	defer close(s.done)
+	for {
+		select {
+		case cmd, ok := <-s.commands:
 			if !ok {
-				r = newRoom(e.docId, m)
-				m.rooms[e.docId] = r
-				go r.run()
-			}
-			m.mu.Unlock()
-			r.commands <- roomCmd{
-				join: &struct {
-					connID uint64
-					siteId string
-					ch     chan []byte
-				}{e.connID, e.siteId, e.sendCh},
+				s.stop()
+				return
 			}
+			s.handle(cmd)
+		case ev := <-s.events:
+			s.handleEvent(ev)
 		}
-		if cmd.leaveAll != nil {
-			connID := *cmd.leaveAll
-			m.mu.Lock()
-			for _, r := range m.rooms {
-				r.commands <- roomCmd{leave: &connID}
-			}
-			m.mu.Unlock()
+	}
+}
+
+func (s *shard) handle(cmd managerCmd) {
+	if cmd.ensureJoin != nil {
+		e := cmd.ensureJoin
+		s.mu.Lock()
+		r, ok := s.rooms[e.docId]
+		if !ok {
+			r = newRoom(e.docId, s)
+			r.prev = s.hibernating[e.docId]
+			delete(s.hibernating, e.docId)
+			s.rooms[e.docId] = r
+			metrics.IncRoomsCreated()
+			go r.run()
 		}
-		if cmd.broadcast != nil {
-			b := cmd.broadcast
-			m.mu.Lock()
-			r, ok := m.rooms[b.docId]
-			m.mu.Unlock()
-			if ok {
-				select {
-				case r.commands <- roomCmd{
-					broadcast: &struct {
-						raw     []byte
-						exclude uint64
-					}{b.raw, b.exclude},
-				}:
-				default:
-				}
+		s.mu.Unlock()
+		joined := s.deliver(r, e.connID, roomCmd{
+			join: &struct {
+				connID   uint64
+				siteId   string
+				ch       chan *protocol.Frame
+				features protocol.FeatureSet
+			}{e.connID, e.siteId, e.sendCh, e.features},
+		})
+		if joined {
+			// Only a join the room will see holds off its eviction.
+			r.routedJoins++
+			docs := s.joined[e.connID]
+			if docs == nil {
+				docs = make(map[string]bool)
+				s.joined[e.connID] = docs
 			}
+			docs[e.docId] = true
 		}
-		if cmd.forwardJoinToOnePeer != nil {
-			f := cmd.forwardJoinToOnePeer
-			m.mu.Lock()
-			r, ok := m.rooms[f.docId]
-			m.mu.Unlock()
+	}
+	if cmd.leaveAll != nil {
+		connID := *cmd.leaveAll
+		for docId := range s.joined[connID] {
+			s.mu.Lock()
+			r, ok := s.rooms[docId]
+			s.mu.Unlock()
 			if ok {
-				select {
-				case r.commands <- roomCmd{
-					forwardJoinToOnePeer: &struct {
-						excludeConnID uint64
-						raw          []byte
-					}{f.excludeConnID, f.raw},
-				}:
-				default:
-				}
+				s.leave(r, connID, protocol.LeftDisconnected)
 			}
 		}
-		if cmd.sendToTarget != nil {
-			s := cmd.sendToTarget
-			m.mu.Lock()
-			r, ok := m.rooms[s.docId]
-			m.mu.Unlock()
+		delete(s.joined, connID)
+	}
+	if cmd.leave != nil {
+		l := cmd.leave
+		if docs := s.joined[l.connID]; docs[l.docId] {
+			delete(docs, l.docId)
+			if len(docs) == 0 {
+				delete(s.joined, l.connID)
+			}
+			s.mu.Lock()
+			r, ok := s.rooms[l.docId]
+			s.mu.Unlock()
 			if ok {
-				select {
-				case r.commands <- roomCmd{
-					sendToTarget: &struct {
-						targetSiteId string
-						raw          []byte
-					}{s.targetSiteId, s.raw},
-				}:
-				default:
-				}
+				s.leave(r, l.connID, protocol.LeftUnsubscribed)
 			}
 		}
 	}
+	if cmd.broadcast != nil {
+		b := cmd.broadcast
+		s.mu.Lock()
+		r, ok := s.rooms[b.docId]
+		s.mu.Unlock()
+		if ok {
+			s.deliver(r, b.exclude, roomCmd{
+				broadcast: &struct {
+					op      *protocol.Operation
+					raw     []byte
+					exclude uint64
+				}{b.op, b.raw, b.exclude},
+			})
+		}
+	}
+	if cmd.broadcastBatch != nil {
+		b := cmd.broadcastBatch
+		s.mu.Lock()
+		r, ok := s.rooms[b.docId]
+		s.mu.Unlock()
+		if ok {
+			s.deliver(r, b.exclude, roomCmd{
+				broadcastBatch: &struct {
+					batch   *protocol.BatchMessage
+					raw     []byte
+					opRaws  [][]byte
+					exclude uint64
+				}{b.batch, b.raw, b.opRaws, b.exclude},
+			})
+		}
+	}
+	if cmd.syncJoin != nil {
+		sj := cmd.syncJoin
+		s.mu.Lock()
+		r, ok := s.rooms[sj.docId]
+		s.mu.Unlock()
+		if ok {
+			s.deliver(r, sj.connID, roomCmd{
+				syncJoin: &struct {
+					connID  uint64
+					known   map[string]int
+					epoch   string
+					lastSeq uint64
+					raw     []byte
+				}{sj.connID, sj.known, sj.epoch, sj.lastSeq, sj.raw},
+			})
+		}
+	}
+	if cmd.presence != nil {
+		pr := cmd.presence
+		s.mu.Lock()
+		r, ok := s.rooms[pr.docId]
+		s.mu.Unlock()
+		if ok {
+			s.deliver(r, pr.connID, roomCmd{
+				presence: &struct {
+					connID uint64
+					state  json.RawMessage
+				}{pr.connID, pr.state},
+			})
+		}
+	}
+	if cmd.sendToTarget != nil {
+		st := cmd.sendToTarget
+		s.mu.Lock()
+		r, ok := s.rooms[st.docId]
+		s.mu.Unlock()
+		if ok {
+			s.deliver(r, st.from, roomCmd{
+				sendToTarget: &struct {
+					from         uint64
+					msgType      string
+					targetSiteId string
+					raw          []byte
+				}{st.from, st.msgType, st.targetSiteId, st.raw},
+			})
+		}
+	}
 }
 
-func newRoom(docId string, manager *Manager) *room {
-	return &room{
-		docId:       docId,
-		peersByConn: make(map[uint64]*peer),
-		siteToConn:  make(map[string]uint64),
-		commands:    make(chan roomCmd, roomCommandBuffer),
-		manager:     manager,
+// deliver queues cmd, sent by connection from, for r. The shard never waits
+// on a room: a command that doesn't fit in the room's queue is counted and
+// dropped at once, and so is its sender, which reconnects and resyncs instead
+// of going on without a join, an op or a sync frame it thinks went through.
+// Presence is only counted: the next update replaces it. One stuck room thus
+// costs its own senders their connections but doesn't hold up the other docs
+// on its shard. It reports whether cmd was queued.
+func (s *shard) deliver(r *room, from uint64, cmd roomCmd) bool {
+	if s.queue(r, cmd) {
+		return true
 	}
+	s.dropCommand(r, from, cmd)
+	return false
 }
 
-func safeSend(ch chan []byte, msg []byte) (ok bool) {
-	defer func() {
-		if recover() != nil {
-			ok = false
-		}
-	}()
+// queue puts cmd in r's queue if there is room for it.
+func (s *shard) queue(r *room, cmd roomCmd) bool {
 	select {
-	case ch <- msg:
+	case r.commands <- cmd:
+		r.queued++
 		return true
 	default:
 		return false
 	}
 }
 
-func sendWithFailureTracking(p *peer, raw []byte) (shouldDrop bool) {
-	if safeSend(p.ch, raw) {
-		p.sendFailures = 0
-		return false
+func (s *shard) dropCommand(r *room, from uint64, cmd roomCmd) {
+	metrics.IncRoomCommandDrops()
+	if cmd.presence != nil {
+		return
 	}
-	p.sendFailures++
-	metrics.IncSendSkips()
-	return p.sendFailures >= dropAfterFailures
+	logger.WithConnAndDoc(from, r.docId).Warn("room_queue_overflow", "action", "overload_drop_conn", "queued", len(r.commands))
+	s.manager.Drop(from)
 }
 
-func (r *room) run() {
-	for cmd := range r.commands {
-		if cmd.join != nil {
-			j := cmd.join
-			p := &peer{connID: j.connID, siteId: j.siteId, ch: j.ch}
-			r.peersByConn[j.connID] = p
-			r.siteToConn[j.siteId] = j.connID
-		}
-		if cmd.leave != nil {
-			connID := *cmd.leave
-			if p, ok := r.peersByConn[connID]; ok {
-				delete(r.siteToConn, p.siteId)
-				delete(r.peersByConn, connID)
-			}
-		}
-		if cmd.broadcast != nil {
-			b := cmd.broadcast
-			for id, p := range r.peersByConn {
-				if id == b.exclude {
-					continue
-				}
-				if sendWithFailureTracking(p, b.raw) {
-					delete(r.siteToConn, p.siteId)
-					delete(r.peersByConn, id)
-					r.manager.Drop(id)
-				}
-			}
-		}
-		if cmd.forwardJoinToOnePeer != nil {
-			f := cmd.forwardJoinToOnePeer
-			var candidates []*peer
-			for id, p := range r.peersByConn {
-				if id != f.excludeConnID {
-					candidates = append(candidates, p)
-				}
-			}
-			if len(candidates) > 0 {
-				p := candidates[rand.Intn(len(candidates))]
-				if sendWithFailureTracking(p, f.raw) {
-					delete(r.siteToConn, p.siteId)
-					delete(r.peersByConn, p.connID)
-					r.manager.Drop(p.connID)
-				}
-			}
-		}
-		if cmd.sendToTarget != nil {
-			s := cmd.sendToTarget
-			connID, ok := r.siteToConn[s.targetSiteId]
-			if !ok {
-				continue
-			}
-			p := r.peersByConn[connID]
-			if p == nil {
-				continue
-			}
-			if sendWithFailureTracking(p, s.raw) {
-				delete(r.siteToConn, p.siteId)
-				delete(r.peersByConn, p.connID)
-				r.manager.Drop(p.connID)
-			}
-		}
+// leave queues a leave like deliver, but never drops it, since a lost leave
+// would keep a ghost peer in the room. One that doesn't fit is deferred: the
+// room takes it once it has handled everything queued before it.
+func (s *shard) leave(r *room, connID uint64, reason string) {
+	cmd := roomCmd{
+		leave: &struct {
+			connID uint64
+			reason string
+		}{connID, reason},
+	}
+	if s.queue(r, cmd) {
+		return
+	}
+	logger.WithConnAndDoc(connID, r.docId).Warn("room_leave_deferred", "queued", len(r.commands))
+	r.deferLeave(cmd, r.queued)
+	// If the queue drained in the meantime, an empty command makes sure the
+	// room gets to the leave.
+	select {
+	case r.commands <- roomCmd{}:
+		r.queued++
+	default:
 	}
 }
 
 func (m *Manager) Stats() (rooms uint64, peers uint64) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	for _, r := range m.rooms {
-		peers += uint64(len(r.peersByConn))
+	for _, s := range m.shards {
+		s.mu.Lock()
+		for _, r := range s.rooms {
+			peers += r.peerCount.Load()
+		}
+		rooms += uint64(len(s.rooms))
+		s.mu.Unlock()
 	}
-	return uint64(len(m.rooms)), peers
+	return rooms, peers
 }
 
-func (m *Manager) EnsureJoin(docId string, connID uint64, siteId string, sendCh chan []byte) bool {
+func (m *Manager) EnsureJoin(docId string, connID uint64, siteId string, sendCh chan *protocol.Frame, features protocol.FeatureSet) bool {
 	select {
-	case m.commands <- managerCmd{
+	case m.shardFor(docId).commands <- managerCmd{
 		ensureJoin: &struct {
-			docId   string
-			connID  uint64
-			siteId  string
-			sendCh  chan []byte
-		}{docId, connID, siteId, sendCh},
+			docId    string
+			connID   uint64
+			siteId   string
+			sendCh   chan *protocol.Frame
+			features protocol.FeatureSet
+		}{docId, connID, siteId, sendCh, features},
 	}:
 		return true
 	case <-time.After(managerCommandTimeout):
@@ -321,21 +407,37 @@ func (m *Manager) EnsureJoin(docId string, connID uint64, siteId string, sendCh
 	}
 }
 
+// LeaveAll removes the connection from every doc it joined, on every shard. It
+// waits for room in the shards' queues rather than give up: a lost leave would
+// keep a ghost peer in the room.
 func (m *Manager) LeaveAll(connID uint64) {
-	select {
-	case m.commands <- managerCmd{leaveAll: &connID}:
-	default:
+	for _, s := range m.shards {
+		s.commands <- managerCmd{leaveAll: &connID}
+	}
+}
+
+// Leave takes the connection out of one doc, which the rest of the doc sees
+// as the site unsubscribing. Like LeaveAll it never gives up.
+func (m *Manager) Leave(docId string, connID uint64) {
+	m.shardFor(docId).commands <- managerCmd{
+		leave: &struct {
+			docId  string
+			connID uint64
+		}{docId, connID},
 	}
 }
 
-func (m *Manager) Broadcast(docId string, raw []byte, excludeConnID uint64) bool {
+// Broadcast relays op to every peer in the doc except the sender, then acks
+// it to the sender. raw is op's canonical encoding.
+func (m *Manager) Broadcast(docId string, op *protocol.Operation, raw []byte, excludeConnID uint64) bool {
 	select {
-	case m.commands <- managerCmd{
+	case m.shardFor(docId).commands <- managerCmd{
 		broadcast: &struct {
 			docId   string
+			op      *protocol.Operation
 			raw     []byte
 			exclude uint64
-		}{docId, raw, excludeConnID},
+		}{docId, op, raw, excludeConnID},
 	}:
 		return true
 	case <-time.After(managerCommandTimeout):
@@ -345,31 +447,63 @@ func (m *Manager) Broadcast(docId string, raw []byte, excludeConnID uint64) bool
 	}
 }
 
-func (m *Manager) ForwardJoinToOnePeer(docId string, excludeConnID uint64, raw []byte) bool {
+// BroadcastBatch fans a batch of operations out to every peer but the sender
+// in a single room command. Peers that negotiated batching get the batch frame,
+// everyone else gets the operations one by one, in order.
+func (m *Manager) BroadcastBatch(docId string, batch *protocol.BatchMessage, raw []byte, opRaws [][]byte, excludeConnID uint64) bool {
 	select {
-	case m.commands <- managerCmd{
-		forwardJoinToOnePeer: &struct {
-			docId         string
-			excludeConnID uint64
-			raw           []byte
-		}{docId, excludeConnID, raw},
+	case m.shardFor(docId).commands <- managerCmd{
+		broadcastBatch: &struct {
+			docId   string
+			batch   *protocol.BatchMessage
+			raw     []byte
+			opRaws  [][]byte
+			exclude uint64
+		}{docId, batch, raw, opRaws, excludeConnID},
 	}:
 		return true
 	case <-time.After(managerCommandTimeout):
 		metrics.IncBackpressure()
-		logger.WithDoc(docId).Warn("room_forward_join_backpressure_drop")
+		logger.WithDoc(docId).Warn("room_broadcast_batch_backpressure_drop")
 		return false
 	}
 }
 
-func (m *Manager) SendToTarget(docId string, targetSiteId string, raw []byte) bool {
+// SyncJoin gets a joiner the doc's content. known is the highest counter per
+// site the joiner says it already has, and lastSeq the last room seq it saw in
+// epoch; raw is its join frame.
+func (m *Manager) SyncJoin(docId string, connID uint64, known map[string]int, epoch string, lastSeq uint64, raw []byte) bool {
 	select {
-	case m.commands <- managerCmd{
+	case m.shardFor(docId).commands <- managerCmd{
+		syncJoin: &struct {
+			docId   string
+			connID  uint64
+			known   map[string]int
+			epoch   string
+			lastSeq uint64
+			raw     []byte
+		}{docId, connID, known, epoch, lastSeq, raw},
+	}:
+		return true
+	case <-time.After(managerCommandTimeout):
+		metrics.IncBackpressure()
+		logger.WithDoc(docId).Warn("room_sync_join_backpressure_drop")
+		return false
+	}
+}
+
+// SendToTarget relays a sync_op or sync_done from connection from to the site
+// it is addressed to. msgType is the frame's type.
+func (m *Manager) SendToTarget(docId string, from uint64, msgType, targetSiteId string, raw []byte) bool {
+	select {
+	case m.shardFor(docId).commands <- managerCmd{
 		sendToTarget: &struct {
 			docId        string
+			from         uint64
+			msgType      string
 			targetSiteId string
 			raw          []byte
-		}{docId, targetSiteId, raw},
+		}{docId, from, msgType, targetSiteId, raw},
 	}:
 		return true
 	case <-time.After(managerCommandTimeout):
@@ -379,10 +513,37 @@ func (m *Manager) SendToTarget(docId string, targetSiteId string, raw []byte) bo
 	}
 }
 
-func (m *Manager) Shutdown(ctx context.Context) {
-	close(m.commands)
+// UpdatePresence stores a peer's ephemeral state and relays it to the rest of
+// the doc. The peer must already have joined.
+func (m *Manager) UpdatePresence(docId string, connID uint64, state json.RawMessage) bool {
 	select {
-	case <-m.done:
-	case <-ctx.Done():
+	case m.shardFor(docId).commands <- managerCmd{
+		presence: &struct {
+			docId  string
+			connID uint64
+			state  json.RawMessage
+		}{docId, connID, state},
+	}:
+		return true
+	case <-time.After(managerCommandTimeout):
+		metrics.IncBackpressure()
+		logger.WithDoc(docId).Warn("room_presence_backpressure_drop")
+		return false
+	}
+}
+
+// Shutdown stops every room, each saving a snapshot to the store first, and
+// waits for them until ctx is done. Nothing may be sent to the manager once it
+// is called, so the hub has to have stopped; the store can be closed after.
+func (m *Manager) Shutdown(ctx context.Context) {
+	for _, s := range m.shards {
+		close(s.commands)
+	}
+	for _, s := range m.shards {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
@@ -0,0 +1,154 @@
+package room
+
+import (
+	"runtime"
+	"time"
+
+	"skepsi/backend/internal/store"
+)
+
+const (
+	defaultCursorFlushInterval = 50 * time.Millisecond
+	defaultSnapshotEveryOps    = 1000
+	defaultSnapshotInterval    = 5 * time.Minute
+	defaultIdleTTL             = 10 * time.Minute
+	defaultSyncTimeout         = 600 * time.Millisecond
+	defaultSyncAttempts        = 3
+	defaultResumeBuffer        = 1024
+)
+
+type config struct {
+	cursorFlushInterval time.Duration
+	store               store.Store
+	snapshotEveryOps    int
+	snapshotInterval    time.Duration
+	idleTTL             time.Duration
+	syncTimeout         time.Duration
+	syncAttempts        int
+	resumeBuffer        int
+	maxPeers            int
+	maxObservers        int
+	slowConsumer        SlowConsumerPolicy
+	shards              int
+}
+
+func defaultConfig() config {
+	return config{
+		cursorFlushInterval: defaultCursorFlushInterval,
+		snapshotEveryOps:    defaultSnapshotEveryOps,
+		snapshotInterval:    defaultSnapshotInterval,
+		idleTTL:             defaultIdleTTL,
+		syncTimeout:         defaultSyncTimeout,
+		syncAttempts:        defaultSyncAttempts,
+		resumeBuffer:        defaultResumeBuffer,
+		slowConsumer:        SlowConsumerResync,
+		shards:              runtime.GOMAXPROCS(0),
+	}
+}
+
+// Option configures a Manager.
+type Option func(*config)
+
+// WithCursorFlushInterval sets how often a room sends out the latest cursor
+// of each site. Zero relays every cursor update as it arrives.
+func WithCursorFlushInterval(d time.Duration) Option {
+	return func(c *config) {
+		if d >= 0 {
+			c.cursorFlushInterval = d
+		}
+	}
+}
+
+// WithStore makes rooms record every accepted insert and delete in s, and load
+// the doc from it when a room is created again.
+func WithStore(s store.Store) Option {
+	return func(c *config) {
+		c.store = s
+	}
+}
+
+// WithSnapshotEvery sets when a room with a store snapshots its replica: after
+// ops accepted ops, or interval after the first op since the last snapshot,
+// whichever comes first. Zero disables that trigger.
+func WithSnapshotEvery(ops int, interval time.Duration) Option {
+	return func(c *config) {
+		if ops >= 0 {
+			c.snapshotEveryOps = ops
+		}
+		if interval >= 0 {
+			c.snapshotInterval = interval
+		}
+	}
+}
+
+// WithIdleTTL sets how long a room stays up after its last peer leaves. After
+// that it snapshots to the store, if there is one, and stops; the next join
+// starts it again from the store. Zero keeps empty rooms forever.
+func WithIdleTTL(d time.Duration) Option {
+	return func(c *config) {
+		if d >= 0 {
+			c.idleTTL = d
+		}
+	}
+}
+
+// WithSyncTimeout sets how long a peer asked to sync a joiner may stay silent
+// before the room asks another one, and how many peers it asks in all before
+// giving up.
+func WithSyncTimeout(d time.Duration, attempts int) Option {
+	return func(c *config) {
+		if d > 0 {
+			c.syncTimeout = d
+		}
+		if attempts > 0 {
+			c.syncAttempts = attempts
+		}
+	}
+}
+
+// WithResumeBuffer sets how many of its latest ops a room keeps for clients
+// that rejoin with the last seq they saw. Zero keeps none, so every rejoin is
+// a full sync.
+func WithResumeBuffer(n int) Option {
+	return func(c *config) {
+		if n >= 0 {
+			c.resumeBuffer = n
+		}
+	}
+}
+
+// WithMaxPeers caps how many connections can be in one doc. Past that, up to
+// observers more can join as read-only observers if they ask to. Zero peers
+// leaves docs uncapped.
+func WithMaxPeers(peers, observers int) Option {
+	return func(c *config) {
+		if peers >= 0 {
+			c.maxPeers = peers
+		}
+		if observers >= 0 {
+			c.maxObservers = observers
+		}
+	}
+}
+
+// WithSlowConsumer sets what a room does with a peer whose send queue is full.
+func WithSlowConsumer(p SlowConsumerPolicy) Option {
+	return func(c *config) {
+		if p == SlowConsumerResync || p == SlowConsumerDrop {
+			c.slowConsumer = p
+		}
+	}
+}
+
+// WithShards sets how many goroutines the manager spreads docs across. Zero
+// uses one per CPU.
+func WithShards(n int) Option {
+	return func(c *config) {
+		switch {
+		case n > 0:
+			c.shards = n
+		case n == 0:
+			c.shards = runtime.GOMAXPROCS(0)
+		}
+	}
+}
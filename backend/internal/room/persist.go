@@ -0,0 +1,172 @@
+package room
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+
+	"skepsi/backend/internal/logger"
+	"skepsi/backend/internal/metrics"
+	"skepsi/backend/internal/protocol"
+	"skepsi/backend/internal/store"
+)
+
+// restore loads the doc from the manager's store, if it has one, before the
+// room handles any command: the latest snapshot first, then the ops logged
+// after it. The snapshot's counters come first, so ops it dropped as
+// superseded still count as seen. Seqs carry on from the highest one
+// restored, and the logged ops refill the resume ring.
+func (r *room) restore() {
+	if r.cfg.store == nil {
+		return
+	}
+	r.complete = true
+	snap, err := r.cfg.store.LoadSnapshot(r.docId)
+	if err != nil {
+		logger.WithDoc(r.docId).Error("store_load_snapshot_failed", "error", err)
+	}
+	if snap != nil {
+		var ops []protocol.Operation
+		if err := json.Unmarshal(snap.Data, &ops); err != nil {
+			logger.WithDoc(r.docId).Error("store_snapshot_invalid", "version", snap.Version, "error", err)
+		} else {
+			for site, contiguous := range snap.Clock {
+				r.counters[site] = restoredCounters(snap.Floor[site], contiguous, snap.Seen[site])
+			}
+			for i := range ops {
+				r.restoreOp(&ops[i])
+			}
+			r.version = snap.Version
+			r.epoch = snap.Epoch
+		}
+	}
+	recs, err := r.cfg.store.LoadSince(r.docId, r.version)
+	if err != nil {
+		logger.WithDoc(r.docId).Error("store_load_failed", "error", err)
+	}
+	for _, rec := range recs {
+		r.version = rec.Version
+		var op protocol.Operation
+		if err := json.Unmarshal(rec.Op, &op); err != nil || !tracked(&op) {
+			logger.WithDoc(r.docId).Warn("store_record_skipped", "version", rec.Version)
+			continue
+		}
+		r.restoreOp(&op)
+		if op.Seq > 0 {
+			r.recent.push(&op)
+		}
+	}
+	if r.version > 0 {
+		metrics.IncRoomsWoken()
+		logger.WithDoc(r.docId).Info("room_restored", "version", r.version, "tail", len(recs))
+	}
+	r.unsnapped = len(recs)
+	r.scheduleSnapshot()
+}
+
+func (r *room) restoreOp(op *protocol.Operation) {
+	site, c := op.OpId.Site, op.OpId.Counter
+	if sc, ok := r.counters[site]; ok {
+		sc.add(c)
+	} else {
+		r.counters[site] = newSiteCounters(c)
+	}
+	r.replica.apply(op)
+	r.seq = max(r.seq, op.Seq)
+}
+
+// persist appends an accepted op to the store. An op it fails to append must
+// not go out: the sender would take it as accepted. One it appends is written
+// but not yet fsynced, and is acked right away; the log fsyncs in batches, so
+// an acked op can still be lost to a crash within one sync interval. The
+// caller schedules the next snapshot once the op is in the replica.
+func (r *room) persist(raw []byte) error {
+	if r.cfg.store == nil {
+		return nil
+	}
+	v, err := r.cfg.store.AppendOp(r.docId, raw)
+	if err != nil {
+		logger.WithDoc(r.docId).Error("store_append_failed", "error", err)
+		return protocol.ErrStoreUnavailable
+	}
+	r.version = v
+	r.unsnapped++
+	return nil
+}
+
+// refuseOps answers ops the room couldn't accept with err, one error per op,
+// if their sender asked for acks.
+func (r *room) refuseOps(connID uint64, err error, opIds ...protocol.OpId) {
+	p, ok := r.peersByConn[connID]
+	if !ok || !p.features.Has(protocol.FeatureAcks) {
+		return
+	}
+	for i := range opIds {
+		raw, rerr := protocol.NewError(err, r.docId, &opIds[i])
+		if rerr != nil || !r.send(p, raw) {
+			return
+		}
+	}
+}
+
+func (r *room) scheduleSnapshot() {
+	if r.unsnapped == 0 {
+		return
+	}
+	if r.cfg.snapshotEveryOps > 0 && r.unsnapped >= r.cfg.snapshotEveryOps {
+		r.snapshot()
+		return
+	}
+	if r.snapshotDue == nil && r.cfg.snapshotInterval > 0 {
+		r.snapshotDue = time.After(r.cfg.snapshotInterval)
+	}
+}
+
+// snapshot saves the replica as of r.version, with the counters of every site
+// the room has seen, and lets the store drop the ops it covers.
+func (r *room) snapshot() {
+	if r.cfg.store == nil || r.unsnapped == 0 {
+		return
+	}
+	data, err := json.Marshal(r.replica.ops())
+	if err != nil {
+		metrics.IncSnapshotFailures()
+		logger.WithDoc(r.docId).Error("snapshot_failed", "error", err)
+		return
+	}
+	snap := store.Snapshot{
+		Version: r.version,
+		Epoch:   r.epoch,
+		Clock:   make(map[string]int, len(r.counters)),
+		Floor:   make(map[string]int),
+		Seen:    make(map[string][]int),
+		Data:    data,
+	}
+	for site, sc := range r.counters {
+		snap.Clock[site] = sc.contiguous
+		if sc.floor != 0 {
+			snap.Floor[site] = sc.floor
+		}
+		if above := sc.above(); above != nil {
+			snap.Seen[site] = above
+		}
+	}
+	if err := r.cfg.store.SaveSnapshot(r.docId, snap); err != nil {
+		metrics.IncSnapshotFailures()
+		logger.WithDoc(r.docId).Error("snapshot_failed", "version", r.version, "error", err)
+		return
+	}
+	metrics.IncSnapshots()
+	r.unsnapped = 0
+	r.snapshotDue = nil
+}
+
+func withoutOps(opIds, drop []protocol.OpId) []protocol.OpId {
+	out := make([]protocol.OpId, 0, len(opIds))
+	for _, id := range opIds {
+		if !slices.Contains(drop, id) {
+			out = append(out, id)
+		}
+	}
+	return out
+}
@@ -0,0 +1,101 @@
+package room
+
+import (
+	"encoding/json"
+
+	"skepsi/backend/internal/protocol"
+)
+
+// Presence is announced per site: a site with two connections in the same doc
+// joins once and leaves when its last connection goes. Only peers that
+// negotiated the presence feature hear about it.
+
+func (r *room) siteOnline(siteId string, except uint64) bool {
+	for id, p := range r.peersByConn {
+		if id != except && p.siteId == siteId && !p.observer {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *room) sendPresence(v interface{}, exclude uint64) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	for id, p := range r.peersByConn {
+		if id == exclude || !p.features.Has(protocol.FeaturePresence) {
+			continue
+		}
+		r.send(p, raw)
+	}
+}
+
+func (r *room) sendRoster(joiner *peer) {
+	if !joiner.features.Has(protocol.FeaturePresence) {
+		return
+	}
+	roster := protocol.RosterMessage{Type: protocol.TypeRoster, DocId: r.docId, Peers: []protocol.RosterEntry{}}
+	seen := map[string]bool{joiner.siteId: true}
+	for _, p := range r.peersByConn {
+		if seen[p.siteId] || p.observer {
+			continue
+		}
+		seen[p.siteId] = true
+		roster.Peers = append(roster.Peers, protocol.RosterEntry{SiteId: p.siteId, State: r.siteState(p.siteId)})
+	}
+	raw, err := json.Marshal(roster)
+	if err != nil {
+		return
+	}
+	r.send(joiner, raw)
+}
+
+// siteState returns the most recent presence state any connection of the
+// site has set.
+func (r *room) siteState(siteId string) json.RawMessage {
+	if connID, ok := r.siteToConn[siteId]; ok {
+		if p := r.peersByConn[connID]; p != nil && p.presence != nil {
+			return p.presence
+		}
+	}
+	for _, p := range r.peersByConn {
+		if p.siteId == siteId && p.presence != nil {
+			return p.presence
+		}
+	}
+	return nil
+}
+
+func (r *room) announceJoin(p *peer) {
+	r.sendRoster(p)
+	if p.observer || r.siteOnline(p.siteId, p.connID) {
+		return
+	}
+	r.sendPresence(protocol.NewPeerJoined(r.docId, p.siteId), p.connID)
+}
+
+// announceLeave runs after p has been removed from the room. A site that
+// went offline also loses its cursor.
+func (r *room) announceLeave(p *peer, reason string) {
+	if p.observer || r.siteOnline(p.siteId, 0) {
+		return
+	}
+	r.dropCursor(p.siteId)
+	r.sendPresence(protocol.NewPeerLeft(r.docId, p.siteId, reason), 0)
+}
+
+func (r *room) updatePresence(connID uint64, state json.RawMessage) {
+	p, ok := r.peersByConn[connID]
+	if !ok || p.observer {
+		return
+	}
+	p.presence = state
+	r.sendPresence(protocol.PresenceMessage{
+		Type:   protocol.TypePresence,
+		DocId:  r.docId,
+		SiteId: p.siteId,
+		State:  state,
+	}, connID)
+}
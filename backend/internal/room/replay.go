@@ -0,0 +1,110 @@
+package room
+
+import (
+	"time"
+
+	"skepsi/backend/internal/logger"
+	"skepsi/backend/internal/metrics"
+	"skepsi/backend/internal/protocol"
+)
+
+// A replay is what a peer is owed before anything live: the ops it missed
+// while away or lagging, or the whole doc from the replica. It can be bigger than the
+// peer's queue, so the room feeds it in as the queue drains, and whatever else
+// it sends the peer meanwhile waits behind it. The peer never sees a live op
+// ahead of one it is still being replayed, and acks wait until the replay is
+// through. A peer that takes none of its replay for replayTimeout is dropped.
+//
+// Live frames pile up behind the replay for as long as the peer takes to get
+// through it, so only maxReplayLive of them are kept. Past that the replay is
+// given up and the peer lags from the seq it was at when the replay started,
+// to be caught up once its queue drains like any other lagging peer. Under the
+// drop policy it is dropped instead.
+
+const (
+	replayInterval = 10 * time.Millisecond
+	replayTimeout  = 5 * time.Second
+	maxReplayLive  = 1024
+)
+
+// replay queues msgs, which bring p up from seq from, behind anything it is
+// still owed. A from of zero means msgs are the whole doc.
+func (r *room) replay(p *peer, from uint64, msgs [][]byte) {
+	if len(p.replay) == 0 {
+		p.replayedAt = time.Now()
+		p.replayFrom = from
+	} else {
+		p.replayFrom = min(p.replayFrom, from)
+	}
+	p.replay = append(p.replay, msgs...)
+	r.feedReplay(p)
+}
+
+// feedReplay moves as much of p's replay into its queue as fits.
+func (r *room) feedReplay(p *peer) {
+	n := 0
+	for n < len(p.replay) && safeSend(p.ch, r.frame(p.replay[n])) {
+		n++
+	}
+	if n > 0 {
+		p.replayedAt = time.Now()
+	}
+	if n == len(p.replay) {
+		p.replay = nil
+		p.replayLive = 0
+		r.flushAcks(p)
+		return
+	}
+	p.replay = p.replay[n:]
+	if r.replayTick == nil {
+		r.replayTick = time.After(replayInterval)
+	}
+}
+
+// checkReplays feeds every unfinished replay and drops the peers that have
+// taken none of theirs for too long.
+func (r *room) checkReplays() {
+	for _, p := range r.peersByConn {
+		if len(p.replay) == 0 {
+			continue
+		}
+		r.feedReplay(p)
+		if len(p.replay) > 0 && time.Since(p.replayedAt) > replayTimeout {
+			logger.WithConnAndDoc(p.connID, r.docId).Warn("replay_stalled", "left", len(p.replay))
+			r.dropPeer(p)
+		}
+	}
+}
+
+// overrunReplay gives up on the replay of a peer that has fallen too far behind
+// it, along with the live frames queued behind it, and reports whether the peer
+// is still in the room. A sync it was waiting on lost its frames too, so it is
+// asked for again once the peer has caught up.
+func (r *room) overrunReplay(p *peer) bool {
+	logger.WithConnAndDoc(p.connID, r.docId).Warn("replay_overrun", "left", len(p.replay), "from", p.replayFrom)
+	p.replay = nil
+	p.replayLive = 0
+	if r.cfg.slowConsumer != SlowConsumerResync {
+		r.dropPeer(p)
+		return false
+	}
+	metrics.IncSendSkips()
+	r.lag(p, p.replayFrom)
+	if ps := r.syncs[p.siteId]; ps != nil && ps.joiner == p.connID {
+		r.syncLagged(ps, true)
+	}
+	return true
+}
+
+// flushAcks sends p the acks saved up for it, once it is neither lagging nor
+// being replayed.
+func (r *room) flushAcks(p *peer) {
+	if p.lagging || len(p.replay) > 0 || len(p.lagAcks) == 0 {
+		return
+	}
+	acks := p.lagAcks
+	p.lagAcks = nil
+	if raw, err := protocol.NewAck(r.docId, acks...); err == nil {
+		r.send(p, raw)
+	}
+}
@@ -0,0 +1,188 @@
+package room
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	collab "skepsi/backend"
+	"skepsi/backend/internal/protocol"
+)
+
+// replicaEntry holds the ops for one position: the insert that created it and
+// the latest op since, by seq. Undo and redo delete and re-insert the same
+// position, so the latest op says whether it is visible.
+type replicaEntry struct {
+	insert *protocol.Operation
+	last   *protocol.Operation
+}
+
+// replica is the room's own copy of the document. The engine keeps positions in
+// order; the ops that created and deleted them are kept too, so a joiner gets
+// the same ops, with their original ids, a peer would have sent.
+type replica struct {
+	engine  *collab.Engine
+	entries map[string]*replicaEntry
+}
+
+func newReplica() *replica {
+	return &replica{engine: collab.NewEngine(), entries: make(map[string]*replicaEntry)}
+}
+
+func positionKey(pos []int) string {
+	var b strings.Builder
+	for i, n := range pos {
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+func (rp *replica) entry(pos []int) *replicaEntry {
+	key := positionKey(pos)
+	e, ok := rp.entries[key]
+	if !ok {
+		e = &replicaEntry{}
+		rp.entries[key] = e
+	}
+	return e
+}
+
+func (rp *replica) empty() bool {
+	return len(rp.entries) == 0
+}
+
+// apply records a validated insert or delete. A delete can arrive before the
+// insert it targets; it is kept and applied once the insert shows up. An insert
+// at a position that already exists undeletes it.
+func (rp *replica) apply(op *protocol.Operation) {
+	cp := *op
+	switch op.Type {
+	case protocol.TypeInsert:
+		p, err := op.InsertPayload()
+		if err != nil {
+			return
+		}
+		e := rp.entry(p.Position)
+		if e.insert == nil {
+			e.insert = &cp
+			value, _ := utf8.DecodeRuneInString(p.Value)
+			rp.engine.ApplyRemote(p.Position, value, false)
+			if e.last != nil {
+				rp.engine.ApplyRemote(p.Position, value, true)
+			}
+			return
+		}
+		if e.stale(op) {
+			return
+		}
+		e.last = &cp
+		if el := rp.engine.ElementAt(p.Position); el != nil {
+			el.Deleted = false
+		}
+	case protocol.TypeDelete:
+		p, err := op.DeletePayload()
+		if err != nil {
+			return
+		}
+		e := rp.entry(p.Position)
+		if e.stale(op) {
+			return
+		}
+		e.last = &cp
+		rp.engine.ApplyRemote(p.Position, 0, true)
+	}
+}
+
+// stale reports whether op is older than the latest op the entry has.
+func (e *replicaEntry) stale(op *protocol.Operation) bool {
+	return e.last != nil && op.Seq < e.last.Seq
+}
+
+// ops returns every op the replica holds: inserts in document order, each
+// followed by the latest op at its position, then deletes whose insert never
+// arrived.
+func (rp *replica) ops() []*protocol.Operation {
+	var out []*protocol.Operation
+	for _, el := range rp.engine.Elements() {
+		e, ok := rp.entries[positionKey(el.Position)]
+		if !ok || e.insert == nil {
+			continue
+		}
+		out = append(out, e.insert)
+		if e.last != nil {
+			out = append(out, e.last)
+		}
+	}
+	for _, e := range rp.entries {
+		if e.insert == nil && e.last != nil {
+			out = append(out, e.last)
+		}
+	}
+	return out
+}
+
+// syncOps returns the sync_op frames that rebuild the document for target.
+func (rp *replica) syncOps(docId, target string) [][]byte {
+	var out [][]byte
+	for _, op := range rp.ops() {
+		raw, err := json.Marshal(protocol.SyncOpMessage{Type: protocol.TypeSyncOp, DocId: docId, Target: target, Op: *op})
+		if err == nil {
+			out = append(out, raw)
+		}
+	}
+	return out
+}
+
+// syncDone ends a sync the room answered, with the seq and epoch it brings
+// target up to.
+func (r *room) syncDone(target string) []byte {
+	raw, _ := json.Marshal(protocol.SyncDoneMessage{Type: protocol.TypeSyncDone, DocId: r.docId, Target: target, Seq: r.seq, Epoch: r.epoch})
+	return raw
+}
+
+// syncJoiner answers a join from the recent ops if it carries a lastSeq they
+// cover (see seq.go), or else from the replica once it is complete. Otherwise
+// another peer is asked (see syncer.go), which sends only the ops past the
+// joiner's known vector. A joiner that is alone is told right away that there
+// is nothing to sync; if it is the room's first joiner and holds nothing
+// either, the doc starts here and the room follows it from its first op.
+func (r *room) syncJoiner(connID uint64, known map[string]int, epoch string, lastSeq uint64, raw []byte) {
+	joiner, ok := r.peersByConn[connID]
+	if !ok {
+		return
+	}
+	for site, counter := range known {
+		joiner.know(protocol.OpId{Site: site, Counter: counter})
+	}
+	r.syncJoins++
+	if (epoch != "" || lastSeq > 0) && r.resume(joiner, epoch, lastSeq) {
+		return
+	}
+	if r.complete && !r.replica.empty() {
+		r.replay(joiner, 0, append(r.replica.syncOps(r.docId, joiner.siteId), r.syncDone(joiner.siteId)))
+		return
+	}
+	if !r.requestSync(joiner, len(known) == 0, raw) && len(known) == 0 && r.syncJoins == 1 && r.replica.empty() {
+		r.complete = true
+	}
+}
+
+// learn takes a peer's answer to a sync into the replica, so the room can
+// answer joins itself once it has a whole doc.
+func (r *room) learn(raw []byte) {
+	var msg protocol.SyncOpMessage
+	if err := json.Unmarshal(raw, &msg); err != nil || !tracked(&msg.Op) {
+		return
+	}
+	site, c := msg.Op.OpId.Site, msg.Op.OpId.Counter
+	if sc, ok := r.counters[site]; ok {
+		sc.add(c)
+	} else {
+		r.counters[site] = newSiteCounters(c)
+	}
+	r.replica.apply(&msg.Op)
+}
@@ -0,0 +1,434 @@
+package room
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"skepsi/backend/internal/metrics"
+	"skepsi/backend/internal/protocol"
+)
+
+const dropAfterFailures = 5
+
+type peer struct {
+	connID       uint64
+	siteId       string
+	ch           chan *protocol.Frame
+	features     protocol.FeatureSet
+	presence     json.RawMessage
+	sendFailures int
+	// known is the version vector the peer is known to hold: the one it
+	// joined with, raised by its own ops the room accepted.
+	known      map[string]int
+	lastActive time.Time
+	observer   bool
+	// lagging is set under the resync policy while the peer's queue drains;
+	// it is caught up from lagSeq. lagAcks are the acks saved up for it
+	// meanwhile, or while it is being replayed.
+	lagging  bool
+	lagSeq   uint64
+	laggedAt time.Time
+	lagAcks  []protocol.OpId
+	// replay holds the frames the peer is owed ahead of anything else, and
+	// replayedAt when it last took some. replayFrom is the seq the peer was
+	// at when the replay started, and replayLive counts the live frames
+	// queued behind it.
+	replay     [][]byte
+	replayedAt time.Time
+	replayFrom uint64
+	replayLive int
+}
+
+// know raises the peer's known counter for id's site to id's.
+func (p *peer) know(id protocol.OpId) {
+	if p.known == nil {
+		p.known = make(map[string]int)
+	}
+	p.known[id.Site] = max(p.known[id.Site], id.Counter)
+}
+
+// holds is how many ops the peer is known to hold, going by its counters.
+func (p *peer) holds() int {
+	n := 0
+	for _, counter := range p.known {
+		n += counter
+	}
+	return n
+}
+
+type room struct {
+	docId       string
+	peersByConn map[uint64]*peer
+	siteToConn  map[string]uint64
+	commands    chan roomCmd
+	manager     *Manager
+	shard       *shard
+	cfg         config
+	cursors     map[string]*cursor
+	cursorFlush <-chan time.Time
+	counters    map[string]*siteCounters
+	replica     *replica
+	// complete is set once the replica is known to hold the whole doc: it was
+	// restored from the store, or the room has followed the doc from its first
+	// op or from a peer's full answer. Until then joins go to peers.
+	complete    bool
+	syncJoins   uint64
+	version     uint64
+	epoch       string
+	seq         uint64
+	recent      *opRing
+	unsnapped   int
+	snapshotDue <-chan time.Time
+	idle        <-chan time.Time
+	joins       uint64
+	// routedJoins and queued are owned by the shard goroutine.
+	routedJoins uint64
+	queued      uint64
+	handled     uint64
+	leavesMu    sync.Mutex
+	leaves      []deferredLeave
+	prev        *room
+	stopped     chan struct{}
+	syncs       map[string]*pendingSync
+	syncTimer   <-chan time.Time
+	lagCheck    <-chan time.Time
+	replayTick  <-chan time.Time
+	observers   int
+	// relayFrom is the seq before whatever the room is handling now.
+	relayFrom uint64
+	// frames are the frames sent while handling it, so a frame fanned out to
+	// many peers is one Frame and is encoded once for all of them.
+	frames map[frameKey]*protocol.Frame
+	// peerCount mirrors len(peersByConn) and observerCount observers, for
+	// Manager.Stats and Manager.Full.
+	peerCount     atomic.Uint64
+	observerCount atomic.Uint64
+}
+
+type roomCmd struct {
+	join *struct {
+		connID   uint64
+		siteId   string
+		ch       chan *protocol.Frame
+		features protocol.FeatureSet
+	}
+	leave *struct {
+		connID uint64
+		reason string
+	}
+	broadcast *struct {
+		op      *protocol.Operation
+		raw     []byte
+		exclude uint64
+	}
+	broadcastBatch *struct {
+		batch   *protocol.BatchMessage
+		raw     []byte
+		opRaws  [][]byte
+		exclude uint64
+	}
+	syncJoin *struct {
+		connID  uint64
+		known   map[string]int
+		epoch   string
+		lastSeq uint64
+		raw     []byte
+	}
+	sendToTarget *struct {
+		from         uint64
+		msgType      string
+		targetSiteId string
+		raw          []byte
+	}
+	presence *struct {
+		connID uint64
+		state  json.RawMessage
+	}
+	hibernate bool
+}
+
+func newRoom(docId string, s *shard) *room {
+	manager := s.manager
+	return &room{
+		docId:       docId,
+		peersByConn: make(map[uint64]*peer),
+		siteToConn:  make(map[string]uint64),
+		commands:    make(chan roomCmd, roomCommandBuffer),
+		manager:     manager,
+		shard:       s,
+		cfg:         manager.cfg,
+		cursors:     make(map[string]*cursor),
+		counters:    make(map[string]*siteCounters),
+		replica:     newReplica(),
+		recent:      newOpRing(manager.cfg.resumeBuffer),
+		stopped:     make(chan struct{}),
+		syncs:       make(map[string]*pendingSync),
+		frames:      make(map[frameKey]*protocol.Frame),
+	}
+}
+
+// frameKey tells frames apart by their backing array, which is never changed
+// once a frame is sent.
+type frameKey struct {
+	data *byte
+	n    int
+}
+
+// frame wraps raw for the peers' queues, giving every peer the same Frame
+// for the same raw bytes while the room handles one thing.
+func (r *room) frame(raw []byte) *protocol.Frame {
+	if len(raw) == 0 {
+		return protocol.NewFrame(raw)
+	}
+	key := frameKey{&raw[0], len(raw)}
+	f, ok := r.frames[key]
+	if !ok {
+		f = protocol.NewFrame(raw)
+		r.frames[key] = f
+	}
+	return f
+}
+
+func safeSend(ch chan *protocol.Frame, msg *protocol.Frame) bool {
+	select {
+	case ch <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *room) sendWithFailureTracking(p *peer, raw []byte) (shouldDrop bool) {
+	if safeSend(p.ch, r.frame(raw)) {
+		p.sendFailures = 0
+		return false
+	}
+	p.sendFailures++
+	metrics.IncSendSkips()
+	return p.sendFailures >= dropAfterFailures
+}
+
+// send delivers raw to p, unless p is lagging, or queues it behind p's
+// replay. A peer that can't take it starts lagging under the resync policy,
+// and is dropped once it has failed too many consecutive sends under the drop
+// policy. It reports whether the peer is still in the room.
+func (r *room) send(p *peer, raw []byte) bool {
+	if p.lagging {
+		return true
+	}
+	if len(p.replay) > 0 {
+		if p.replayLive < maxReplayLive {
+			p.replay = append(p.replay, raw)
+			p.replayLive++
+			return true
+		}
+		return r.overrunReplay(p)
+	}
+	if r.cfg.slowConsumer == SlowConsumerResync {
+		if !safeSend(p.ch, r.frame(raw)) {
+			metrics.IncSendSkips()
+			r.lag(p, r.relayFrom)
+		}
+		return true
+	}
+	if r.sendWithFailureTracking(p, raw) {
+		r.dropPeer(p)
+		return false
+	}
+	return true
+}
+
+func (r *room) dropPeer(p *peer) {
+	r.removePeer(p)
+	r.reportGone(p.connID)
+	r.manager.Drop(p.connID)
+	r.announceLeave(p, protocol.LeftDropped)
+}
+
+func (r *room) removePeer(p *peer) {
+	if r.siteToConn[p.siteId] == p.connID {
+		delete(r.siteToConn, p.siteId)
+	}
+	delete(r.peersByConn, p.connID)
+	if p.observer {
+		r.observers--
+	}
+	r.syncPeerGone(p)
+}
+
+// ack confirms relayed operations to their sender, if it asked for acks. With
+// a store the ops are in the log by then, but its fsync may still be pending
+// (see persist).
+func (r *room) ack(connID uint64, opIds ...protocol.OpId) {
+	p, ok := r.peersByConn[connID]
+	if !ok || !p.features.Has(protocol.FeatureAcks) || len(opIds) == 0 {
+		return
+	}
+	if p.lagging || len(p.replay) > 0 {
+		p.lagAcks = append(p.lagAcks, opIds...)
+		return
+	}
+	raw, err := protocol.NewAck(r.docId, opIds...)
+	if err != nil {
+		return
+	}
+	r.send(p, raw)
+}
+
+func (r *room) run() {
+	if r.prev != nil {
+		<-r.prev.stopped
+		r.prev = nil
+	}
+	r.restore()
+	r.startEpoch()
+	for {
+		r.relayFrom = r.seq
+		clear(r.frames)
+		select {
+		case cmd, ok := <-r.commands:
+			if !ok {
+				return
+			}
+			r.handled++
+			if cmd.hibernate {
+				r.hibernate()
+				return
+			}
+			r.noteActivity(cmd)
+			r.handle(cmd)
+			r.takeDeferredLeaves()
+		case <-r.cursorFlush:
+			r.cursorFlush = nil
+			r.flushCursors()
+		case <-r.snapshotDue:
+			r.snapshotDue = nil
+			r.snapshot()
+		case <-r.syncTimer:
+			r.syncTimer = nil
+			r.checkSyncs()
+		case <-r.lagCheck:
+			r.lagCheck = nil
+			r.checkLagging()
+		case <-r.replayTick:
+			r.replayTick = nil
+			r.checkReplays()
+		case <-r.idle:
+			r.idle = nil
+			r.reportIdle()
+		}
+		r.peerCount.Store(uint64(len(r.peersByConn)))
+		r.observerCount.Store(uint64(r.observers))
+		r.checkIdle()
+	}
+}
+
+func (r *room) handle(cmd roomCmd) {
+	if cmd.join != nil {
+		j := cmd.join
+		r.joins++
+		existing, ok := r.peersByConn[j.connID]
+		if !ok || existing.siteId != j.siteId {
+			admitted, observer := true, false
+			if ok {
+				observer = existing.observer
+				r.removePeer(existing)
+				r.announceLeave(existing, protocol.LeftDisconnected)
+			} else {
+				admitted, observer = r.admit(j.features)
+			}
+			if !admitted {
+				r.refuse(j.connID, j.ch, j.features)
+				return
+			}
+			p := &peer{connID: j.connID, siteId: j.siteId, ch: j.ch, features: j.features, lastActive: time.Now(), observer: observer}
+			r.peersByConn[j.connID] = p
+			r.siteToConn[j.siteId] = j.connID
+			if observer {
+				r.observers++
+				metrics.IncObserverJoins()
+			}
+			r.announceJoin(p)
+			r.sendCursors(p)
+		}
+	}
+	if cmd.leave != nil {
+		if p, ok := r.peersByConn[cmd.leave.connID]; ok {
+			r.removePeer(p)
+			r.announceLeave(p, cmd.leave.reason)
+		}
+	}
+	if cmd.presence != nil {
+		r.updatePresence(cmd.presence.connID, cmd.presence.state)
+	}
+	if cmd.broadcast != nil {
+		b := cmd.broadcast
+		if !r.canWrite(b.exclude, b.op.OpId) {
+			return
+		}
+		if b.op.Type == protocol.TypeCursor {
+			r.setCursor(b.exclude, b.op.SiteId, b.raw)
+			r.ack(b.exclude, b.op.OpId)
+			return
+		}
+		raw, ok, err := r.accept(b.exclude, b.op, b.raw)
+		if err != nil {
+			r.refuseOps(b.exclude, err, b.op.OpId)
+			return
+		}
+		if !ok {
+			r.ack(b.exclude, b.op.OpId)
+			return
+		}
+		for id, p := range r.peersByConn {
+			if id == b.exclude {
+				continue
+			}
+			r.send(p, raw)
+		}
+		r.ack(b.exclude, b.op.OpId)
+	}
+	if cmd.broadcastBatch != nil {
+		b := cmd.broadcastBatch
+		opIds := make([]protocol.OpId, len(b.batch.Ops))
+		for i, op := range b.batch.Ops {
+			opIds[i] = op.OpId
+		}
+		if !r.canWrite(b.exclude, opIds...) {
+			return
+		}
+		raw, opRaws, failed := r.acceptBatch(b.exclude, b.batch, b.raw, b.opRaws)
+		if len(failed) > 0 {
+			r.refuseOps(b.exclude, protocol.ErrStoreUnavailable, failed...)
+			opIds = withoutOps(opIds, failed)
+		}
+		if len(opRaws) == 0 {
+			r.ack(b.exclude, opIds...)
+			return
+		}
+		for id, p := range r.peersByConn {
+			if id == b.exclude {
+				continue
+			}
+			if p.features.Has(protocol.FeatureBatch) {
+				r.send(p, raw)
+				continue
+			}
+			for _, opRaw := range opRaws {
+				if !r.send(p, opRaw) {
+					break
+				}
+			}
+		}
+		r.ack(b.exclude, opIds...)
+	}
+	if cmd.syncJoin != nil {
+		r.syncJoiner(cmd.syncJoin.connID, cmd.syncJoin.known, cmd.syncJoin.epoch, cmd.syncJoin.lastSeq, cmd.syncJoin.raw)
+	}
+	if cmd.sendToTarget != nil {
+		s := cmd.sendToTarget
+		r.relaySync(s.from, s.msgType, s.targetSiteId, s.raw)
+	}
+}
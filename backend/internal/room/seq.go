@@ -0,0 +1,131 @@
+package room
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+
+	"skepsi/backend/internal/metrics"
+	"skepsi/backend/internal/protocol"
+)
+
+// Every insert and delete a room accepts gets the room's next sequence number,
+// stamped into the frames it relays and logs. The latest ops stay in a ring,
+// so a client that comes back with the last seq it saw is sent just what it
+// missed, without a full sync and without asking another peer.
+//
+// Seqs belong to the room's epoch, which sync_done carries along with the seq.
+// A room restored from a snapshot keeps the epoch saved in it; any other room
+// starts a new one. Either way seqs carry on from the highest one restored, if
+// any. A lastSeq is only trusted in the epoch it came from, so one from an
+// earlier room is always a miss and the joiner gets a full sync.
+
+// startEpoch gives the room a new epoch unless it restored one.
+func (r *room) startEpoch() {
+	if r.epoch != "" {
+		return
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	r.epoch = hex.EncodeToString(b[:])
+}
+
+// opRing holds the most recent ops in seq order, with no gaps.
+type opRing struct {
+	ops   []*protocol.Operation
+	start int
+	n     int
+}
+
+func newOpRing(size int) *opRing {
+	return &opRing{ops: make([]*protocol.Operation, size)}
+}
+
+func (rg *opRing) at(i int) *protocol.Operation {
+	return rg.ops[(rg.start+i)%len(rg.ops)]
+}
+
+// push adds op, overwriting the oldest one once the ring is full. An op that
+// doesn't follow the newest one starts the ring over.
+func (rg *opRing) push(op *protocol.Operation) {
+	if len(rg.ops) == 0 {
+		return
+	}
+	if rg.n > 0 && op.Seq != rg.at(rg.n-1).Seq+1 {
+		rg.start, rg.n = 0, 0
+	}
+	if rg.n < len(rg.ops) {
+		rg.ops[(rg.start+rg.n)%len(rg.ops)] = op
+		rg.n++
+		return
+	}
+	rg.ops[rg.start] = op
+	rg.start = (rg.start + 1) % len(rg.ops)
+}
+
+// since returns the ops after seq up to latest, and false if the ring no
+// longer holds all of them.
+func (rg *opRing) since(seq, latest uint64) ([]*protocol.Operation, bool) {
+	if seq > latest {
+		return nil, false
+	}
+	if seq == latest {
+		return nil, true
+	}
+	if rg.n == 0 || rg.at(rg.n-1).Seq != latest || rg.at(0).Seq > seq+1 {
+		return nil, false
+	}
+	out := make([]*protocol.Operation, 0, latest-seq)
+	for i := 0; i < rg.n; i++ {
+		if op := rg.at(i); op.Seq > seq {
+			out = append(out, op)
+		}
+	}
+	return out, true
+}
+
+// stamp gives an accepted op the next seq and returns the frame to relay.
+func (r *room) stamp(op *protocol.Operation, raw []byte) []byte {
+	r.seq++
+	op.Seq = r.seq
+	out, err := json.Marshal(op)
+	if err != nil {
+		return raw
+	}
+	return out
+}
+
+// resume answers a join that carries lastSeq from the ring. It reports false
+// when lastSeq is from another epoch or the ring can't cover it, and the
+// joiner needs a full sync.
+func (r *room) resume(joiner *peer, epoch string, lastSeq uint64) bool {
+	var msgs [][]byte
+	ok := epoch == r.epoch
+	if ok {
+		msgs, ok = r.syncSince(joiner.siteId, lastSeq)
+	}
+	if !ok {
+		metrics.IncResumeMisses()
+		return false
+	}
+	metrics.IncResumes()
+	r.replay(joiner, lastSeq, msgs)
+	return true
+}
+
+// syncSince builds the sync_op frames for the ops after seq, and the sync_done,
+// from the ring. It reports false if the ring no longer holds them all.
+func (r *room) syncSince(target string, seq uint64) ([][]byte, bool) {
+	ops, ok := r.recent.since(seq, r.seq)
+	if !ok {
+		return nil, false
+	}
+	msgs := make([][]byte, 0, len(ops)+1)
+	for _, op := range ops {
+		raw, err := json.Marshal(protocol.SyncOpMessage{Type: protocol.TypeSyncOp, DocId: r.docId, Target: target, Op: *op})
+		if err == nil {
+			msgs = append(msgs, raw)
+		}
+	}
+	return append(msgs, r.syncDone(target)), true
+}
@@ -0,0 +1,281 @@
+package room
+
+import (
+	"time"
+
+	"skepsi/backend/internal/logger"
+	"skepsi/backend/internal/metrics"
+	"skepsi/backend/internal/protocol"
+)
+
+// A join the replica can't answer is forwarded to another peer, and the room
+// follows it until that peer's sync_done comes through. A responder that stays
+// silent for the sync timeout, or leaves, is replaced by a peer that hasn't
+// been asked yet. Once the attempts run out the joiner gets a sync_done anyway
+// so it can go live with what it has. A joiner that lags meanwhile misses
+// frames, so the sync is put on hold and asked for again once it has caught
+// up. Joiners that negotiated sync_status hear about each step.
+
+// responderActiveWindow is how recently a peer must have sent something to
+// count as active when picking a responder.
+const responderActiveWindow = time.Minute
+
+type pendingSync struct {
+	joiner    uint64
+	raw       []byte
+	responder uint64
+	tried     map[uint64]bool
+	ops       int
+	deadline  time.Time
+	// lagged is set when the joiner missed a frame by lagging; the sync
+	// waits for it to catch up and starts over.
+	lagged bool
+	// draining is the responder whose answer the joiner lagged through.
+	// Its frames are dropped up to its sync_done, so the rest of that answer
+	// isn't taken for the answer to the join asked again.
+	draining uint64
+	// full is set when the joiner holds nothing, so the answer is the whole
+	// doc and completes the replica.
+	full bool
+}
+
+// requestSync asks a peer to answer joiner and reports whether there was one
+// to ask; if not the joiner gets sync_done right away.
+func (r *room) requestSync(joiner *peer, full bool, raw []byte) bool {
+	ps := &pendingSync{joiner: joiner.connID, raw: raw, tried: make(map[uint64]bool), full: full}
+	r.syncs[joiner.siteId] = ps
+	if r.forwardSync(joiner, ps) {
+		r.sendSyncStatus(joiner, ps, protocol.SyncRequested)
+		return true
+	}
+	delete(r.syncs, joiner.siteId)
+	r.send(joiner, r.syncDone(joiner.siteId))
+	return false
+}
+
+// forwardSync hands the join to a peer that hasn't had it yet and reports
+// whether there was one.
+func (r *room) forwardSync(joiner *peer, ps *pendingSync) bool {
+	for len(ps.tried) < r.cfg.syncAttempts {
+		p := r.pickResponder(joiner, ps.tried)
+		if p == nil {
+			return false
+		}
+		ps.tried[p.connID] = true
+		ps.responder = p.connID
+		if !r.send(p, ps.raw) {
+			continue
+		}
+		ps.deadline = time.Now().Add(r.cfg.syncTimeout)
+		r.armSyncTimer()
+		return true
+	}
+	return false
+}
+
+// pickResponder chooses the peer most likely to hold the whole doc: one that
+// isn't waiting on a sync of its own, preferably active lately, known to hold
+// the most ops. The latest activity breaks ties.
+func (r *room) pickResponder(joiner *peer, tried map[uint64]bool) *peer {
+	now := time.Now()
+	var best *peer
+	for id, p := range r.peersByConn {
+		if id == joiner.connID || p.siteId == joiner.siteId || p.observer || p.lagging || tried[id] {
+			continue
+		}
+		if best == nil || r.betterResponder(p, best, now) {
+			best = p
+		}
+	}
+	return best
+}
+
+func (r *room) betterResponder(a, b *peer, now time.Time) bool {
+	if sa, sb := r.syncing(a), r.syncing(b); sa != sb {
+		return !sa
+	}
+	aActive := now.Sub(a.lastActive) < responderActiveWindow
+	bActive := now.Sub(b.lastActive) < responderActiveWindow
+	if aActive != bActive {
+		return aActive
+	}
+	if ha, hb := a.holds(), b.holds(); ha != hb {
+		return ha > hb
+	}
+	return a.lastActive.After(b.lastActive)
+}
+
+func (r *room) syncing(p *peer) bool {
+	ps := r.syncs[p.siteId]
+	return ps != nil && ps.joiner == p.connID
+}
+
+// noteActivity records that the sender of cmd is alive.
+func (r *room) noteActivity(cmd roomCmd) {
+	var connID uint64
+	switch {
+	case cmd.broadcast != nil:
+		connID = cmd.broadcast.exclude
+	case cmd.broadcastBatch != nil:
+		connID = cmd.broadcastBatch.exclude
+	case cmd.syncJoin != nil:
+		connID = cmd.syncJoin.connID
+	case cmd.presence != nil:
+		connID = cmd.presence.connID
+	case cmd.sendToTarget != nil:
+		connID = cmd.sendToTarget.from
+	default:
+		return
+	}
+	p, ok := r.peersByConn[connID]
+	if !ok {
+		return
+	}
+	p.lastActive = time.Now()
+}
+
+// relaySync passes a sync_op or sync_done on to its target. Only frames from
+// the responder the target is waiting on get through, and each one gives it
+// another timeout; anything else answers no join and is dropped.
+func (r *room) relaySync(from uint64, msgType, target string, raw []byte) {
+	p := r.peersByConn[r.siteToConn[target]]
+	if p == nil {
+		return
+	}
+	q := r.peersByConn[from]
+	if q != nil && q.observer {
+		return
+	}
+	ps := r.syncs[target]
+	if ps == nil || ps.joiner != p.connID {
+		return
+	}
+	if from == ps.draining {
+		if msgType == protocol.TypeSyncDone {
+			ps.draining = 0
+		}
+		return
+	}
+	if from != ps.responder || ps.lagged {
+		return
+	}
+	if msgType == protocol.TypeSyncDone {
+		delete(r.syncs, target)
+		if ps.full {
+			r.complete = true
+		}
+	} else {
+		ps.ops++
+		ps.deadline = time.Now().Add(r.cfg.syncTimeout)
+		r.learn(raw)
+	}
+	if !r.send(p, raw) {
+		return
+	}
+	if p.lagging {
+		r.syncLagged(ps, msgType != protocol.TypeSyncDone)
+		r.syncs[target] = ps
+	}
+}
+
+// syncLagged puts ps on hold because its joiner lagged. If the responder is
+// still answering, the rest of its answer is drained.
+func (r *room) syncLagged(ps *pendingSync, answering bool) {
+	if ps.lagged {
+		return
+	}
+	ps.lagged = true
+	if answering {
+		ps.draining = ps.responder
+	}
+}
+
+// resumeSync asks again for the sync of a joiner that lagged through it,
+// now that it has caught up.
+func (r *room) resumeSync(joiner *peer) {
+	ps := r.syncs[joiner.siteId]
+	if ps == nil || ps.joiner != joiner.connID || !ps.lagged {
+		return
+	}
+	ps.lagged = false
+	ps.ops = 0
+	clear(ps.tried)
+	if r.forwardSync(joiner, ps) {
+		metrics.IncSyncRetries()
+		r.sendSyncStatus(joiner, ps, protocol.SyncRetrying)
+		return
+	}
+	delete(r.syncs, joiner.siteId)
+	r.send(joiner, r.syncDone(joiner.siteId))
+}
+
+// checkSyncs runs when the earliest deadline passes and moves every overdue
+// request on to its next responder, or gives up on it.
+func (r *room) checkSyncs() {
+	now := time.Now()
+	for site, ps := range r.syncs {
+		if ps.lagged || now.Before(ps.deadline) {
+			continue
+		}
+		joiner, ok := r.peersByConn[ps.joiner]
+		if !ok {
+			delete(r.syncs, site)
+			continue
+		}
+		metrics.IncSyncTimeouts()
+		logger.WithConnAndDoc(ps.responder, r.docId).Warn("sync_responder_timeout", "joiner", site, "attempt", len(ps.tried), "ops", ps.ops)
+		if r.forwardSync(joiner, ps) {
+			metrics.IncSyncRetries()
+			r.sendSyncStatus(joiner, ps, protocol.SyncRetrying)
+			continue
+		}
+		delete(r.syncs, site)
+		metrics.IncSyncFailures()
+		logger.WithConnAndDoc(ps.joiner, r.docId).Warn("sync_failed", "attempts", len(ps.tried), "ops", ps.ops)
+		r.sendSyncStatus(joiner, ps, protocol.SyncFailed)
+		r.send(joiner, r.syncDone(site))
+	}
+	r.armSyncTimer()
+}
+
+func (r *room) armSyncTimer() {
+	var next time.Time
+	for _, ps := range r.syncs {
+		if ps.lagged {
+			continue
+		}
+		if next.IsZero() || ps.deadline.Before(next) {
+			next = ps.deadline
+		}
+	}
+	if next.IsZero() {
+		r.syncTimer = nil
+		return
+	}
+	r.syncTimer = time.After(time.Until(next))
+}
+
+// syncPeerGone forgets the syncs of a joiner that left and moves those it was
+// answering on without waiting for the timeout.
+func (r *room) syncPeerGone(p *peer) {
+	if ps := r.syncs[p.siteId]; ps != nil && ps.joiner == p.connID {
+		delete(r.syncs, p.siteId)
+	}
+	for _, ps := range r.syncs {
+		if ps.responder == p.connID {
+			ps.deadline = time.Now()
+			r.syncTimer = time.After(0)
+		}
+	}
+}
+
+func (r *room) sendSyncStatus(joiner *peer, ps *pendingSync, state string) {
+	if !joiner.features.Has(protocol.FeatureSyncStatus) {
+		return
+	}
+	raw, err := protocol.NewSyncStatus(r.docId, state, len(ps.tried), ps.ops)
+	if err != nil {
+		return
+	}
+	r.send(joiner, raw)
+}
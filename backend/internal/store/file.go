@@ -0,0 +1,126 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"skepsi/backend/internal/metrics"
+	"skepsi/backend/internal/wal"
+)
+
+const snapshotFile = "snapshot.json"
+
+// FileStore keeps each doc's ops in a wal.Log and its snapshot in a file next
+// to the log segments. Saving a snapshot deletes the segments it covers.
+type FileStore struct {
+	wal *wal.Dir
+}
+
+func OpenFileStore(path string, opts wal.Options) (*FileStore, error) {
+	d, err := wal.Open(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{wal: d}, nil
+}
+
+func (s *FileStore) AppendOp(docId string, op []byte) (uint64, error) {
+	l, err := s.wal.Log(docId)
+	if err != nil {
+		return 0, err
+	}
+	return l.Append(op)
+}
+
+func (s *FileStore) LoadSince(docId string, version uint64) ([]Record, error) {
+	l, err := s.wal.Existing(docId)
+	if err != nil || l == nil {
+		return nil, err
+	}
+	var recs []Record
+	err = l.Replay(version+1, func(seq uint64, data []byte) error {
+		recs = append(recs, Record{Version: seq, Op: data})
+		return nil
+	})
+	return recs, err
+}
+
+func (s *FileStore) SaveSnapshot(docId string, snap Snapshot) error {
+	l, err := s.wal.Log(docId)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err := writeAtomic(filepath.Join(l.Path(), snapshotFile), data); err != nil {
+		return err
+	}
+	n, err := l.TruncateBefore(snap.Version + 1)
+	metrics.AddLogSegmentsTruncated(uint64(n))
+	return err
+}
+
+func (s *FileStore) LoadSnapshot(docId string) (*Snapshot, error) {
+	l, err := s.wal.Existing(docId)
+	if err != nil || l == nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(l.Path(), snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+func (s *FileStore) Release(docId string) error {
+	return s.wal.Release(docId)
+}
+
+func (s *FileStore) ListDocs() ([]string, error) {
+	return s.wal.Docs()
+}
+
+func (s *FileStore) Close() error {
+	return s.wal.Close()
+}
+
+// writeAtomic replaces path with data so that a crash leaves either the old or
+// the new file, never a partial one.
+func writeAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
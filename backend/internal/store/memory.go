@@ -0,0 +1,121 @@
+package store
+
+import (
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+)
+
+type memoryDoc struct {
+	ops      []Record
+	next     uint64
+	snapshot *Snapshot
+}
+
+type MemoryStore struct {
+	mu     sync.Mutex
+	docs   map[string]*memoryDoc
+	closed bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{docs: make(map[string]*memoryDoc)}
+}
+
+func (s *MemoryStore) doc(docId string) *memoryDoc {
+	d, ok := s.docs[docId]
+	if !ok {
+		d = &memoryDoc{next: 1}
+		s.docs[docId] = d
+	}
+	return d
+}
+
+func (s *MemoryStore) AppendOp(docId string, op []byte) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, ErrClosed
+	}
+	d := s.doc(docId)
+	v := d.next
+	d.ops = append(d.ops, Record{Version: v, Op: append([]byte(nil), op...)})
+	d.next++
+	return v, nil
+}
+
+func (s *MemoryStore) LoadSince(docId string, version uint64) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	d, ok := s.docs[docId]
+	if !ok {
+		return nil, nil
+	}
+	i := sort.Search(len(d.ops), func(i int) bool { return d.ops[i].Version > version })
+	return append([]Record(nil), d.ops[i:]...), nil
+}
+
+func (s *MemoryStore) SaveSnapshot(docId string, snap Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	snap.Data = append([]byte(nil), snap.Data...)
+	snap.Clock = maps.Clone(snap.Clock)
+	snap.Floor = maps.Clone(snap.Floor)
+	seen := make(map[string][]int, len(snap.Seen))
+	for site, cs := range snap.Seen {
+		seen[site] = slices.Clone(cs)
+	}
+	snap.Seen = seen
+	d := s.doc(docId)
+	d.snapshot = &snap
+	i := sort.Search(len(d.ops), func(i int) bool { return d.ops[i].Version > snap.Version })
+	d.ops = append([]Record(nil), d.ops[i:]...)
+	return nil
+}
+
+func (s *MemoryStore) LoadSnapshot(docId string) (*Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	d, ok := s.docs[docId]
+	if !ok || d.snapshot == nil {
+		return nil, nil
+	}
+	snap := *d.snapshot
+	return &snap, nil
+}
+
+func (s *MemoryStore) ListDocs() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	docs := make([]string, 0, len(s.docs))
+	for id := range s.docs {
+		docs = append(docs, id)
+	}
+	sort.Strings(docs)
+	return docs, nil
+}
+
+// Release does nothing: a MemoryStore holds nothing but memory.
+func (s *MemoryStore) Release(docId string) error {
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,47 @@
+// Package store defines where rooms keep their documents: an op log per doc
+// plus an optional snapshot. MemoryStore is meant for tests; FileStore keeps
+// everything on local disk.
+package store
+
+import "errors"
+
+var ErrClosed = errors.New("store: closed")
+
+// Record is one op as stored, numbered by its position in the doc's log.
+type Record struct {
+	Version uint64
+	Op      []byte
+}
+
+// Snapshot is an opaque encoding of a document as of Version, along with the
+// op counters of every site it takes in, including those of ops Data no longer
+// holds: each counter from Floor (0 if absent) through Clock, and those in Seen
+// past a gap. Epoch is the room epoch the seqs of the doc's ops belong to.
+type Snapshot struct {
+	Version uint64           `json:"version"`
+	Epoch   string           `json:"epoch,omitempty"`
+	Clock   map[string]int   `json:"clock"`
+	Floor   map[string]int   `json:"floor,omitempty"`
+	Seen    map[string][]int `json:"seen,omitempty"`
+	Data    []byte           `json:"data"`
+}
+
+// Store is safe for concurrent use by many rooms.
+type Store interface {
+	// AppendOp adds op to the end of docId's log and returns its version.
+	AppendOp(docId string, op []byte) (uint64, error)
+	// LoadSince returns the ops of docId with a version above version, oldest
+	// first.
+	LoadSince(docId string, version uint64) ([]Record, error)
+	// SaveSnapshot replaces the snapshot of docId. Ops up to snap.Version may
+	// be discarded afterwards; LoadSince will only return what follows.
+	SaveSnapshot(docId string, snap Snapshot) error
+	// LoadSnapshot returns the latest snapshot of docId, or nil if it has none.
+	LoadSnapshot(docId string) (*Snapshot, error)
+	// ListDocs returns every doc with stored ops or a snapshot.
+	ListDocs() ([]string, error)
+	// Release lets go of whatever the store keeps open for docId, such as
+	// file handles, until it is next used.
+	Release(docId string) error
+	Close() error
+}
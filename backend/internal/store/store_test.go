@@ -0,0 +1,108 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+
+	"skepsi/backend/internal/wal"
+)
+
+func testStore(t *testing.T, s Store) {
+	for i := 1; i <= 5; i++ {
+		v, err := s.AppendOp("a", []byte(fmt.Sprintf(`{"n":%d}`, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != uint64(i) {
+			t.Fatalf("append %d returned version %d", i, v)
+		}
+	}
+	if _, err := s.AppendOp("b", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := s.LoadSince("a", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || recs[0].Version != 4 || string(recs[1].Op) != `{"n":5}` {
+		t.Errorf("LoadSince(3) = %+v", recs)
+	}
+	if recs, err := s.LoadSince("a", 0); err != nil || len(recs) != 5 {
+		t.Errorf("LoadSince(0) = %d records, %v", len(recs), err)
+	}
+
+	if snap, err := s.LoadSnapshot("a"); err != nil || snap != nil {
+		t.Errorf("expected no snapshot yet, got %+v %v", snap, err)
+	}
+	want := Snapshot{Version: 4, Clock: map[string]int{"s1": 3}, Floor: map[string]int{"s1": 1},
+		Seen: map[string][]int{"s1": {5, 6}}, Data: []byte("state")}
+	if err := s.SaveSnapshot("a", want); err != nil {
+		t.Fatal(err)
+	}
+	want.Clock["s1"] = 99
+	want.Seen["s1"][0] = 99
+	snap, err := s.LoadSnapshot("a")
+	if err != nil || snap == nil {
+		t.Fatalf("LoadSnapshot: %+v %v", snap, err)
+	}
+	if snap.Version != 4 || snap.Clock["s1"] != 3 || snap.Floor["s1"] != 1 || len(snap.Seen["s1"]) != 2 ||
+		snap.Seen["s1"][0] != 5 || string(snap.Data) != "state" {
+		t.Errorf("unexpected snapshot %+v", snap)
+	}
+
+	// Reading a doc that was never written leaves it unwritten.
+	if recs, err := s.LoadSince("c", 0); err != nil || len(recs) != 0 {
+		t.Errorf("LoadSince of a new doc = %d records, %v", len(recs), err)
+	}
+	if snap, err := s.LoadSnapshot("c"); err != nil || snap != nil {
+		t.Errorf("LoadSnapshot of a new doc = %+v %v", snap, err)
+	}
+
+	if err := s.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	if recs, err := s.LoadSince("a", 4); err != nil || len(recs) != 1 {
+		t.Errorf("LoadSince after Release = %d records, %v", len(recs), err)
+	}
+
+	docs, err := s.ListDocs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 || docs[0] != "a" || docs[1] != "b" {
+		t.Errorf("ListDocs = %q", docs)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	defer s.Close()
+	testStore(t, s)
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenFileStore(dir, wal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenFileStore(dir, wal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	recs, err := s.LoadSince("a", 0)
+	if err != nil || len(recs) != 5 {
+		t.Fatalf("after reopen: %d records, %v", len(recs), err)
+	}
+	snap, err := s.LoadSnapshot("a")
+	if err != nil || snap == nil || snap.Version != 4 {
+		t.Errorf("after reopen: snapshot %+v %v", snap, err)
+	}
+}
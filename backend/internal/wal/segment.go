@@ -0,0 +1,65 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// scanSegment reads the records of one segment, which must be numbered
+// consecutively from first, passing each to fn if it is not nil. It returns the
+// offset just past the last good record and the sequence number that follows
+// it. A torn or corrupt record stops the scan with an error wrapping
+// ErrCorrupt; everything before it is still reported.
+func scanSegment(path string, first uint64, fn func(seq uint64, data []byte) error) (good int64, next uint64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, first, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	next = first
+	var header [headerSize]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return good, next, nil
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return good, next, fmt.Errorf("%w: torn header at offset %d", ErrCorrupt, good)
+			}
+			return good, next, err
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		sum := binary.LittleEndian.Uint32(header[4:8])
+		seq := binary.LittleEndian.Uint64(header[8:16])
+		if length > MaxRecordBytes {
+			return good, next, fmt.Errorf("%w: bad length %d at offset %d", ErrCorrupt, length, good)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return good, next, fmt.Errorf("%w: torn record at offset %d", ErrCorrupt, good)
+			}
+			return good, next, err
+		}
+		crc := crc32.Update(crc32.Checksum(header[8:16], crcTable), crcTable, data)
+		if crc != sum {
+			return good, next, fmt.Errorf("%w: checksum mismatch at offset %d", ErrCorrupt, good)
+		}
+		if seq != next {
+			return good, next, fmt.Errorf("%w: sequence %d at offset %d, expected %d", ErrCorrupt, seq, good, next)
+		}
+		if fn != nil {
+			if err := fn(seq, data); err != nil {
+				return good, next, err
+			}
+		}
+		good += int64(headerSize) + int64(length)
+		next++
+	}
+}
@@ -0,0 +1,496 @@
+// Package wal is an append-only, per-document write-ahead log on local disk.
+//
+// Each document gets its own directory of segment files named after the
+// sequence number of their first record. A record is
+//
+//	length uint32 | crc32c(seq, data) uint32 | seq uint64 | data
+//
+// in little endian. Appends go straight to the file and are fsynced in batches
+// by a background loop, so a crash loses at most one sync interval. Opening a
+// log checks every record and cuts off a torn or corrupt tail left by a crash
+// in the middle of a write.
+package wal
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"skepsi/backend/internal/logger"
+)
+
+const (
+	DefaultSegmentBytes = 4 << 20
+	DefaultSyncInterval = 10 * time.Millisecond
+	MaxRecordBytes      = 16 << 20
+
+	headerSize    = 16
+	segmentSuffix = ".log"
+	docIdFile     = "doc"
+)
+
+var (
+	ErrClosed         = errors.New("wal: log is closed")
+	ErrCorrupt        = errors.New("wal: corrupt record")
+	ErrRecordTooLarge = errors.New("wal: record too large")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type Options struct {
+	SegmentBytes int64
+	SyncInterval time.Duration
+}
+
+// Dir holds the logs of every document under one directory and runs the
+// batched fsync loop for all of them.
+type Dir struct {
+	path   string
+	opts   Options
+	mu     sync.Mutex
+	logs   map[string]*Log
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func Open(path string, opts Options) (*Dir, error) {
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = DefaultSegmentBytes
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, err
+	}
+	d := &Dir{
+		path: path,
+		opts: opts,
+		logs: make(map[string]*Log),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go d.syncLoop()
+	return d, nil
+}
+
+// docDir maps a doc id to a directory name that is safe on any filesystem; the
+// id itself is kept in a file inside it.
+func (d *Dir) docDir(docId string) string {
+	sum := sha256.Sum256([]byte(docId))
+	return filepath.Join(d.path, hex.EncodeToString(sum[:16]))
+}
+
+// Log opens the log of docId, creating it if needed. The same *Log is returned
+// until the Dir is closed.
+func (d *Dir) Log(docId string) (*Log, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	if l, ok := d.logs[docId]; ok {
+		return l, nil
+	}
+	dir := d.docDir(docId)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	idFile := filepath.Join(dir, docIdFile)
+	if _, err := os.Stat(idFile); errors.Is(err, os.ErrNotExist) {
+		if err := writeFileSync(idFile, []byte(docId)); err != nil {
+			return nil, err
+		}
+	}
+	return d.open(docId, dir)
+}
+
+// Existing opens the log of docId like Log, but only if it has been created
+// before. For any other doc it returns nil and leaves the disk alone, so
+// reading a doc that was never written doesn't create it.
+func (d *Dir) Existing(docId string) (*Log, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	if l, ok := d.logs[docId]; ok {
+		return l, nil
+	}
+	dir := d.docDir(docId)
+	_, err := os.Stat(filepath.Join(dir, docIdFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.open(docId, dir)
+}
+
+// Release syncs and closes the log of docId, if it is open, and forgets it.
+// The next Log or Existing call for the doc opens it again.
+func (d *Dir) Release(docId string) error {
+	d.mu.Lock()
+	l, ok := d.logs[docId]
+	if d.closed || !ok {
+		d.mu.Unlock()
+		return nil
+	}
+	delete(d.logs, docId)
+	d.mu.Unlock()
+	return l.Close()
+}
+
+// open must be called with d.mu held.
+func (d *Dir) open(docId, dir string) (*Log, error) {
+	l, err := openLog(docId, dir, d.opts.SegmentBytes)
+	if err != nil {
+		return nil, err
+	}
+	d.logs[docId] = l
+	return l, nil
+}
+
+// Docs lists every document that has a log.
+func (d *Dir) Docs() ([]string, error) {
+	entries, err := os.ReadDir(d.path)
+	if err != nil {
+		return nil, err
+	}
+	var docs []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		id, err := os.ReadFile(filepath.Join(d.path, e.Name(), docIdFile))
+		if err != nil {
+			continue
+		}
+		docs = append(docs, string(id))
+	}
+	sort.Strings(docs)
+	return docs, nil
+}
+
+func (d *Dir) syncLoop() {
+	defer close(d.done)
+	t := time.NewTicker(d.opts.SyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-t.C:
+			d.mu.Lock()
+			logs := make([]*Log, 0, len(d.logs))
+			for _, l := range d.logs {
+				logs = append(logs, l)
+			}
+			d.mu.Unlock()
+			for _, l := range logs {
+				if err := l.Sync(); err != nil && !errors.Is(err, ErrClosed) {
+					logger.WithDoc(l.docId).Error("wal_sync_failed", "error", err)
+				}
+			}
+		}
+	}
+}
+
+// Close stops the sync loop and syncs and closes every open log.
+func (d *Dir) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	d.mu.Unlock()
+	close(d.stop)
+	<-d.done
+	var first error
+	for _, l := range d.logs {
+		if err := l.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Log is the write-ahead log of one document. Records are numbered from 1.
+type Log struct {
+	docId    string
+	dir      string
+	segBytes int64
+
+	mu       sync.Mutex
+	segments []uint64
+	f        *os.File
+	size     int64
+	next     uint64
+	dirty    bool
+	closed   bool
+}
+
+func segmentName(first uint64) string {
+	return fmt.Sprintf("%020d%s", first, segmentSuffix)
+}
+
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, first)
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	return segs, nil
+}
+
+func openLog(docId, dir string, segBytes int64) (*Log, error) {
+	segs, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{docId: docId, dir: dir, segBytes: segBytes, segments: segs, next: 1}
+	if len(segs) == 0 {
+		if err := l.createSegment(); err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+	l.next = segs[0]
+	for i, first := range segs {
+		path := filepath.Join(dir, segmentName(first))
+		if first != l.next {
+			return nil, fmt.Errorf("%w: %s starts at %d, expected %d", ErrCorrupt, path, first, l.next)
+		}
+		good, next, err := scanSegment(path, first, nil)
+		if err != nil && !errors.Is(err, ErrCorrupt) {
+			return nil, err
+		}
+		l.next = next
+		if err == nil {
+			continue
+		}
+		if i != len(segs)-1 {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		logger.WithDoc(docId).Warn("wal_tail_truncated", "segment", path, "offset", good, "error", err)
+		if err := os.Truncate(path, good); err != nil {
+			return nil, err
+		}
+	}
+	last := filepath.Join(dir, segmentName(segs[len(segs)-1]))
+	f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.f, l.size = f, info.Size()
+	return l, nil
+}
+
+func (l *Log) createSegment() error {
+	path := filepath.Join(l.dir, segmentName(l.next))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(l.dir); err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, 0
+	l.segments = append(l.segments, l.next)
+	return nil
+}
+
+// Append writes one record and returns its sequence number. The record is
+// durable after the next Sync, which the owning Dir runs periodically.
+func (l *Log) Append(data []byte) (uint64, error) {
+	if len(data) > MaxRecordBytes {
+		return 0, ErrRecordTooLarge
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+	if l.size > 0 && l.size+int64(headerSize+len(data)) > l.segBytes {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	seq := l.next
+	buf := make([]byte, headerSize+len(data))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint64(buf[8:16], seq)
+	copy(buf[headerSize:], data)
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(buf[8:], crcTable))
+	if n, err := l.f.Write(buf); err != nil {
+		if n > 0 {
+			l.f.Truncate(l.size)
+		}
+		return 0, err
+	}
+	l.size += int64(len(buf))
+	l.next++
+	l.dirty = true
+	return seq, nil
+}
+
+func (l *Log) rotate() error {
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.dirty = false
+	return l.createSegment()
+}
+
+// Sync flushes appended records to disk if there are any.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if !l.dirty {
+		return nil
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+// Path is the directory holding this log's segments. Callers may keep their
+// own files there as long as they don't end in .log.
+func (l *Log) Path() string {
+	return l.dir
+}
+
+// LastSeq is the sequence number of the newest record, 0 if the log is empty.
+func (l *Log) LastSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.next - 1
+}
+
+// TruncateBefore deletes the segments that only hold records below seq and
+// returns how many it deleted. The segment being appended to is always kept.
+func (l *Log) TruncateBefore(seq uint64) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+	n := 0
+	for len(l.segments) > 1 && l.segments[1] <= seq {
+		if err := os.Remove(filepath.Join(l.dir, segmentName(l.segments[0]))); err != nil {
+			return n, err
+		}
+		l.segments = l.segments[1:]
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, syncDir(l.dir)
+}
+
+// Replay calls fn for every record with a sequence number of at least from, in
+// order.
+func (l *Log) Replay(from uint64, fn func(seq uint64, data []byte) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	for i, first := range l.segments {
+		if i+1 < len(l.segments) && l.segments[i+1] <= from {
+			continue
+		}
+		_, _, err := scanSegment(filepath.Join(l.dir, segmentName(first)), first, func(seq uint64, data []byte) error {
+			if seq < from {
+				return nil
+			}
+			return fn(seq, data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if err := l.f.Sync(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,330 @@
+package wal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func record(i uint64) []byte {
+	return []byte(fmt.Sprintf(`{"type":"insert","opId":{"site":"s","counter":%d}}`, i))
+}
+
+func appendN(t *testing.T, l *Log, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		want := l.LastSeq() + 1
+		seq, err := l.Append(record(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != want {
+			t.Fatalf("append returned seq %d, want %d", seq, want)
+		}
+	}
+}
+
+func replayAll(t *testing.T, l *Log, from uint64) []uint64 {
+	t.Helper()
+	var seqs []uint64
+	err := l.Replay(from, func(seq uint64, data []byte) error {
+		if string(data) != string(record(seq)) {
+			t.Errorf("record %d has data %s", seq, data)
+		}
+		seqs = append(seqs, seq)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seqs
+}
+
+func checkConsecutive(t *testing.T, seqs []uint64, from, to uint64) {
+	t.Helper()
+	if uint64(len(seqs)) != to-from+1 {
+		t.Fatalf("expected records %d..%d, got %d records", from, to, len(seqs))
+	}
+	for i, seq := range seqs {
+		if seq != from+uint64(i) {
+			t.Fatalf("record %d has seq %d", i, seq)
+		}
+	}
+}
+
+func TestAppendReplayAcrossSegments(t *testing.T) {
+	path := t.TempDir()
+	d, err := Open(path, Options{SegmentBytes: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := d.Log("doc/with:odd chars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, 40)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = Open(path, Options{SegmentBytes: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	l, err = d.Log("doc/with:odd chars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.segments) < 2 {
+		t.Fatalf("expected several segments, got %d", len(l.segments))
+	}
+	checkConsecutive(t, replayAll(t, l, 1), 1, 40)
+	checkConsecutive(t, replayAll(t, l, 33), 33, 40)
+	appendN(t, l, 1)
+	checkConsecutive(t, replayAll(t, l, 1), 1, 41)
+
+	docs, err := d.Docs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0] != "doc/with:odd chars" {
+		t.Errorf("unexpected docs %q", docs)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	d, err := Open(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	l, err := d.Log("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, 3)
+	if err := d.Release("doc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Append(record(4)); err != ErrClosed {
+		t.Errorf("append to a released log: %v, want ErrClosed", err)
+	}
+	if len(d.logs) != 0 {
+		t.Errorf("released log is still open")
+	}
+	l, err = d.Existing("doc")
+	if err != nil || l == nil {
+		t.Fatalf("reopening a released log: %v", err)
+	}
+	appendN(t, l, 1)
+	checkConsecutive(t, replayAll(t, l, 1), 1, 4)
+}
+
+func TestTruncateBefore(t *testing.T) {
+	path := t.TempDir()
+	d, err := Open(path, Options{SegmentBytes: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := d.Log("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, 40)
+	segs := len(l.segments)
+	n, err := l.TruncateBefore(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || len(l.segments) != segs-n {
+		t.Fatalf("removed %d of %d segments, %d left", n, segs, len(l.segments))
+	}
+	first := l.segments[0]
+	if first > 20 {
+		t.Fatalf("record 20 was removed, log now starts at %d", first)
+	}
+	if n, _ := l.TruncateBefore(1000); len(l.segments) != 1 {
+		t.Fatalf("active segment must stay, removed %d and left %d", n, len(l.segments))
+	}
+	last := l.segments[0]
+	d.Close()
+
+	d, l = reopen(t, path)
+	defer d.Close()
+	if l.LastSeq() != 40 {
+		t.Fatalf("LastSeq after reopen %d, want 40", l.LastSeq())
+	}
+	checkConsecutive(t, replayAll(t, l, 1), last, 40)
+}
+
+// writeLog creates a log with n records and returns the path of its only
+// segment and the offset where the last record starts.
+func writeLog(t *testing.T, path string, n int) (string, int64) {
+	t.Helper()
+	d, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := d.Log("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, n-1)
+	lastStart := l.size
+	appendN(t, l, 1)
+	seg := filepath.Join(l.dir, segmentName(1))
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return seg, lastStart
+}
+
+func reopen(t *testing.T, path string) (*Dir, *Log) {
+	t.Helper()
+	d, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := d.Log("doc")
+	if err != nil {
+		d.Close()
+		t.Fatal(err)
+	}
+	return d, l
+}
+
+func TestRecoverFromTornWrite(t *testing.T) {
+	path := t.TempDir()
+	seg, lastStart := writeLog(t, path, 5)
+	full, err := os.ReadFile(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cut := lastStart + 1; cut < int64(len(full)); cut++ {
+		if err := os.WriteFile(seg, full[:cut], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		d, l := reopen(t, path)
+		if got := l.LastSeq(); got != 4 {
+			t.Fatalf("cut at %d: LastSeq %d, want 4", cut, got)
+		}
+		appendN(t, l, 1)
+		checkConsecutive(t, replayAll(t, l, 1), 1, 5)
+		d.Close()
+	}
+}
+
+func TestRecoverFromCorruptTail(t *testing.T) {
+	path := t.TempDir()
+	seg, lastStart := writeLog(t, path, 5)
+	full, err := os.ReadFile(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string][]byte{
+		"flipped data byte": func() []byte {
+			b := append([]byte(nil), full...)
+			b[len(b)-2] ^= 0xff
+			return b
+		}(),
+		"garbage after last record": append(append([]byte(nil), full...), 0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13),
+		"zeroed header": func() []byte {
+			b := append([]byte(nil), full...)
+			for i := lastStart; i < lastStart+headerSize; i++ {
+				b[i] = 0
+			}
+			return b
+		}(),
+	}
+	for name, data := range cases {
+		if err := os.WriteFile(seg, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		d, l := reopen(t, path)
+		want := uint64(4)
+		if name == "garbage after last record" {
+			want = 5
+		}
+		if got := l.LastSeq(); got != want {
+			t.Errorf("%s: LastSeq %d, want %d", name, got, want)
+		}
+		checkConsecutive(t, replayAll(t, l, 1), 1, want)
+		d.Close()
+	}
+}
+
+// TestHelperWriter is run as a child process by TestRecoverAfterKill; it
+// appends records until it is killed.
+func TestHelperWriter(t *testing.T) {
+	path := os.Getenv("WAL_HELPER_DIR")
+	if path == "" {
+		t.Skip("helper process")
+	}
+	d, err := Open(path, Options{SegmentBytes: 64 << 10, SyncInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := d.Log("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	for {
+		seq, err := l.Append(record(l.LastSeq() + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq%100 == 0 {
+			fmt.Fprintln(out, seq)
+			out.Flush()
+		}
+	}
+}
+
+func TestRecoverAfterKill(t *testing.T) {
+	if testing.Short() {
+		t.Skip("spawns a writer process")
+	}
+	path := t.TempDir()
+	for round := 0; round < 3; round++ {
+		before := uint64(0)
+		if round > 0 {
+			d, l := reopen(t, path)
+			before = l.LastSeq()
+			d.Close()
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperWriter$")
+		cmd.Env = append(os.Environ(), "WAL_HELPER_DIR="+path)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		lines := bufio.NewScanner(stdout)
+		var reported uint64
+		for reported < before+1000 && lines.Scan() {
+			reported, _ = strconv.ParseUint(lines.Text(), 10, 64)
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+		if reported == 0 {
+			t.Fatal("writer reported no progress")
+		}
+
+		d, l := reopen(t, path)
+		last := l.LastSeq()
+		if last < before {
+			t.Fatalf("round %d: lost records, LastSeq %d < %d", round, last, before)
+		}
+		checkConsecutive(t, replayAll(t, l, 1), 1, last)
+		d.Close()
+	}
+}
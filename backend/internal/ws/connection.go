@@ -2,53 +2,96 @@ package ws
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"sync"
 	"time"
 
 	"skepsi/backend/internal/logger"
+	"skepsi/backend/internal/protocol"
 
 	"github.com/gorilla/websocket"
 )
 
 const (
-	WriteWait       = 10 * time.Second
-	PongWait        = 60 * time.Second
-	PingPeriod      = (PongWait * 9) / 10
-	MaxMessageBytes = 1 << 20
+	WriteWait  = 10 * time.Second
+	PongWait   = 60 * time.Second
+	PingPeriod = (PongWait * 9) / 10
+	// MaxMessageBytes is the socket's read limit. It is set above the
+	// protocol's so a message that is only somewhat too large is still read
+	// and answered with payload_too_large instead of closing the socket.
+	MaxMessageBytes = protocol.MaxPayloadBytes + 64<<10
 	SendBufferSize  = 2048
 )
 
 type Connection struct {
-	conn   *websocket.Conn
-	ID     uint64
-	SiteId string
-	Send   chan []byte
-	closed chan struct{}
-	once   sync.Once
-	log    *slog.Logger
+	ID       uint64
+	SiteId   string
+	Version  int
+	Features protocol.FeatureSet
+	Send     chan *protocol.Frame
+	greeted  bool
+	// subs maps the docs the connection has joined, explicitly or by sending
+	// to them, to the site it joined each with. Owned by the hub goroutine.
+	subs map[string]string
+	// session state, also owned by the hub goroutine; token is empty unless
+	// the client negotiated sessions.
+	token      string
+	suspended  bool
+	resuming   bool
+	suspension uint64
+	closed     chan struct{}
+	once       sync.Once
+	log        *slog.Logger
+	// ip, limiter, throttled and the rest belong to the read goroutine, which
+	// notes from the hello whether throttled messages get an error reply, and
+	// from each join the site whose limits apply.
+	ip        string
+	site      string
+	limiter   *limiter
+	throttled int
+	helloRead bool
+	acks      bool
+
+	// mu guards the socket, which a resumed session swaps out, and the outbox.
+	mu     sync.Mutex
+	sock   *socket
+	outbox *outbox
 }
 
 func NewConnection(conn *websocket.Conn, id uint64) *Connection {
-	conn.SetReadLimit(MaxMessageBytes)
+	return newConnection(conn, id, SendBufferSize)
+}
+
+func newConnection(conn *websocket.Conn, id uint64, sendBuffer int) *Connection {
 	return &Connection{
-		conn:   conn,
-		ID:     id,
-		Send:   make(chan []byte, SendBufferSize),
-		closed: make(chan struct{}),
-		log:    logger.WithConn(id),
+		ID:      id,
+		Version: 1,
+		Send:    make(chan *protocol.Frame, sendBuffer),
+		subs:    make(map[string]string),
+		closed:  make(chan struct{}),
+		log:     logger.WithConn(id),
+		sock:    newSocket(conn, nil),
 	}
 }
 
+func (c *Connection) socket() *socket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sock
+}
+
 func (c *Connection) ReadPump(ctx context.Context, onMessage func([]byte), onClosed func()) {
+	s := c.socket()
 	defer func() {
 		if onClosed != nil {
 			onClosed()
 		}
+		s.pumps.Done()
 	}()
-	c.conn.SetReadDeadline(time.Now().Add(PongWait))
-	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(PongWait))
+	s.conn.SetReadDeadline(time.Now().Add(PongWait))
+	s.conn.SetPongHandler(func(string) error {
+		s.conn.SetReadDeadline(time.Now().Add(PongWait))
 		return nil
 	})
 	for {
@@ -57,56 +100,105 @@ func (c *Connection) ReadPump(ctx context.Context, onMessage func([]byte), onClo
 			return
 		case <-c.closed:
 			return
+		case <-s.gone:
+			return
 		default:
 		}
-		_, raw, err := c.conn.ReadMessage()
+		mt, raw, err := s.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				c.log.Warn("read_error", "error", err)
 			}
 			return
 		}
+		if mt == websocket.BinaryMessage {
+			decoded, err := s.codec.Decode(raw)
+			switch {
+			case errors.Is(err, protocol.ErrPayloadTooLarge):
+				// Passed on as is, so the hub turns it down as too large.
+			case err != nil:
+				c.log.Warn("decode_error", "codec", s.codec.Name(), "error", err)
+				continue
+			default:
+				raw = decoded
+			}
+		}
 		onMessage(raw)
 	}
 }
 
+// WritePump writes the socket's replay, if it took over a session, then
+// everything sent to the connection. It closes the socket when it stops so the
+// read side notices too.
 func (c *Connection) WritePump(ctx context.Context) {
+	s := c.socket()
+	defer s.pumps.Done()
+	defer s.conn.Close()
 	ticker := time.NewTicker(PingPeriod)
 	defer ticker.Stop()
 
+	for _, msg := range s.replay {
+		if !c.write(s, msg) {
+			return
+		}
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-c.closed:
 			return
-		case msg, ok := <-c.Send:
-			if !ok {
-				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-			c.conn.SetWriteDeadline(time.Now().Add(WriteWait))
-			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-				c.log.Warn("write_error", "error", err)
+		case <-s.gone:
+			return
+		case msg := <-c.Send:
+			c.record(msg)
+			if !c.write(s, msg) {
 				return
 			}
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(WriteWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			s.conn.SetWriteDeadline(time.Now().Add(WriteWait))
+			if err := s.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
 		}
 	}
 }
 
+// write reports whether the socket is still usable. A frame the codec can't
+// encode is skipped.
+func (c *Connection) write(s *socket, msg *protocol.Frame) bool {
+	frame, err := msg.Encode(s.codec)
+	if err != nil {
+		c.log.Warn("encode_error", "codec", s.codec.Name(), "error", err)
+		return true
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(WriteWait))
+	if err := s.conn.WriteMessage(s.frameType(), frame); err != nil {
+		c.log.Warn("write_error", "error", err)
+		return false
+	}
+	return true
+}
+
+func (c *Connection) Codec() protocol.Codec {
+	return c.socket().codec
+}
+
 func (c *Connection) Close() {
 	c.once.Do(func() {
 		close(c.closed)
-		close(c.Send)
-		_ = c.conn.Close()
+		_ = c.socket().conn.Close()
 	})
 }
 
+// CloseWithReason sends a close frame carrying an application close code
+// before tearing the connection down.
+func (c *Connection) CloseWithReason(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	_ = c.socket().conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(WriteWait))
+	c.Close()
+}
+
 func (c *Connection) Closed() bool {
 	select {
 	case <-c.closed:
@@ -118,7 +210,7 @@ func (c *Connection) Closed() bool {
 
 func (c *Connection) SendNonBlocking(msg []byte) bool {
 	select {
-	case c.Send <- msg:
+	case c.Send <- protocol.NewFrame(msg):
 		return true
 	default:
 		return false
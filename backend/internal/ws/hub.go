@@ -2,6 +2,7 @@ package ws
 
 import (
 	"context"
+	"encoding/json"
 	"sync/atomic"
 	"time"
 
@@ -13,34 +14,117 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-const incomingSendTimeout = 10 * time.Second
+const (
+	incomingSendTimeout     = 10 * time.Second
+	DefaultMaxSubscriptions = 64
+)
 
 type Hub struct {
 	connIDGen  atomic.Uint64
-	conns      map[uint64]*Connection
+	conns      *registry
 	register   chan *Connection
 	unregister chan *Connection
 	incoming   chan incomingMsg
 	rooms      *room.Manager
 	done       chan struct{}
+	sessions   map[string]*Connection
+	resume     chan resumeReq
+	attach     chan attachReq
+	expired    chan suspension
+	drops      chan *Connection
+	refusals   chan refusal
+
+	maxSubscriptions  int
+	maxConns          int
+	sendBuffer        int
+	sessionGrace      time.Duration
+	connLimits        Limits
+	sites             *limiterGroup
+	ips               *limiterGroup
+	trustForwardedFor bool
+}
+
+// Option configures a Hub.
+type Option func(*Hub)
+
+// WithMaxSubscriptions caps how many docs one connection can be in at once.
+func WithMaxSubscriptions(n int) Option {
+	return func(h *Hub) {
+		if n > 0 {
+			h.maxSubscriptions = n
+		}
+	}
+}
+
+// WithSessionGrace sets how long a connection with a session stays in its
+// rooms after its socket closes, waiting to be resumed. Zero turns sessions
+// off.
+func WithSessionGrace(d time.Duration) Option {
+	return func(h *Hub) {
+		if d >= 0 {
+			h.sessionGrace = d
+		}
+	}
+}
+
+// WithSendBuffer sets how many frames can be queued for a connection. A room
+// counts a connection whose queue is full as a slow consumer.
+func WithSendBuffer(n int) Option {
+	return func(h *Hub) {
+		if n > 0 {
+			h.sendBuffer = n
+		}
+	}
 }
 
+// WithMaxConns caps how many connections the process holds, suspended
+// sessions included. Zero leaves it uncapped.
+func WithMaxConns(n int) Option {
+	return func(h *Hub) {
+		if n >= 0 {
+			h.maxConns = n
+		}
+	}
+}
+
+// incomingMsg carries a message as the read goroutine decoded it, or the
+// error it got doing so.
 type incomingMsg struct {
 	connID uint64
 	raw    []byte
+	msg    *protocol.Message
+	err    error
 }
 
-const incomingBufferSize = 8192
+const (
+	incomingBufferSize = 8192
+	dropBufferSize     = 1024
+)
 
-func NewHub(roomManager *room.Manager) *Hub {
-	return &Hub{
-		conns:      make(map[uint64]*Connection),
+func NewHub(roomManager *room.Manager, opts ...Option) *Hub {
+	h := &Hub{
+		conns:      newRegistry(),
 		register:   make(chan *Connection),
 		unregister: make(chan *Connection),
 		incoming:   make(chan incomingMsg, incomingBufferSize),
 		rooms:      roomManager,
 		done:       make(chan struct{}),
+		sessions:   make(map[string]*Connection),
+		resume:     make(chan resumeReq),
+		attach:     make(chan attachReq),
+		expired:    make(chan suspension),
+		drops:      make(chan *Connection, dropBufferSize),
+		refusals:   make(chan refusal, dropBufferSize),
+
+		maxSubscriptions: DefaultMaxSubscriptions,
+		sendBuffer:       SendBufferSize,
+		sessionGrace:     DefaultSessionGrace,
+		connLimits:       DefaultConnLimits,
+	}
+	for _, opt := range opts {
+		opt(h)
 	}
+	return h
 }
 
 func (h *Hub) Run(ctx context.Context) {
@@ -50,79 +134,185 @@ func (h *Hub) Run(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case c := <-h.register:
-			h.conns[c.ID] = c
+			total := h.conns.add(c)
 			metrics.IncConnections()
-			metrics.SetActiveConns(uint64(len(h.conns)))
-			logger.Log.Info("client_connected", "conn_id", c.ID, "total", len(h.conns))
+			metrics.SetActiveConns(uint64(total))
+			logger.Log.Info("client_connected", "conn_id", c.ID, "total", total)
 		case c := <-h.unregister:
-			if _, ok := h.conns[c.ID]; !ok {
+			if h.conns.get(c.ID) != c {
 				continue
 			}
-			delete(h.conns, c.ID)
-			metrics.SetActiveConns(uint64(len(h.conns)))
-			h.rooms.LeaveAll(c.ID)
-			c.Close()
-			logger.Log.Info("client_disconnected", "conn_id", c.ID, "total", len(h.conns))
+			if (c.resuming || c.suspended) && !c.Closed() {
+				continue
+			}
+			if h.suspend(c) {
+				continue
+			}
+			h.remove(c)
 		case m := <-h.incoming:
-			h.handleMessage(ctx, m.connID, m.raw)
+			h.handleMessage(ctx, m)
+		case req := <-h.resume:
+			h.takeOver(req)
+		case req := <-h.attach:
+			h.attachSocket(req)
+		case s := <-h.expired:
+			h.expire(s)
+		case c := <-h.drops:
+			if h.conns.get(c.ID) == c {
+				h.remove(c)
+			}
+		case rf := <-h.refusals:
+			if c := h.conns.get(rf.connID); c != nil {
+				delete(c.subs, rf.docId)
+			}
 		}
 	}
 }
 
-func (h *Hub) handleMessage(ctx context.Context, connID uint64, raw []byte) {
-	msgType, err := protocol.ParseMessageType(raw)
+func (h *Hub) remove(c *Connection) {
+	total := h.conns.remove(c)
+	if c.token != "" {
+		delete(h.sessions, c.token)
+	}
+	metrics.SetActiveConns(uint64(total))
+	h.rooms.LeaveAll(c.ID)
+	c.Close()
+	logger.Log.Info("client_disconnected", "conn_id", c.ID, "total", total)
+}
+
+func (h *Hub) handleMessage(ctx context.Context, m incomingMsg) {
+	connID, raw, msg, err := m.connID, m.raw, m.msg, m.err
+	c := h.conns.get(connID)
+	if c == nil {
+		return
+	}
 	if err != nil {
 		logger.WithConn(connID).Warn("invalid_message_type", "error", err)
+		h.replyError(c, err, nil)
 		return
 	}
-	c, ok := h.conns[connID]
-	if !ok {
+	if msg.Type == protocol.TypeHello {
+		h.handleHello(c, msg)
 		return
 	}
-	switch msgType {
-	case protocol.TypeJoin:
-		j, err := protocol.ValidateJoin(raw)
+	c.greeted = true
+	if (msg.Type == protocol.TypeSubscribe || msg.Type == protocol.TypeUnsubscribe) && !c.Features.Has(protocol.FeatureSubscriptions) {
+		logger.WithConn(connID).Warn("subscriptions_not_negotiated", "type", msg.Type)
+		h.replyError(c, protocol.ErrInvalidType, msg)
+		return
+	}
+	switch msg.Type {
+	case protocol.TypeJoin, protocol.TypeSubscribe:
+		var j *protocol.JoinMessage
+		if msg.Type == protocol.TypeJoin {
+			j, err = msg.Join()
+		} else {
+			var s *protocol.SubscribeMessage
+			if s, err = msg.Subscribe(); err == nil {
+				j = s.Join()
+				raw, err = json.Marshal(j)
+			}
+		}
 		if err != nil {
 			logger.WithConn(connID).Warn("invalid_join", "error", err)
+			h.replyError(c, err, msg)
 			return
 		}
 		c.SiteId = j.SiteId
-		if !h.rooms.EnsureJoin(j.DocId, connID, j.SiteId, c.Send) {
-			logger.WithConn(connID).Warn("overload_drop_conn", "doc", j.DocId)
-			h.DropClient(connID)
+		if !h.subscribe(c, msg, j.DocId, j.SiteId) {
 			return
 		}
-		if !h.rooms.ForwardJoinToOnePeer(j.DocId, connID, raw) {
+		if !h.rooms.SyncJoin(j.DocId, connID, j.Known, j.Epoch, j.LastSeq, raw) {
 			logger.WithConn(connID).Warn("overload_drop_conn", "doc", j.DocId)
 			h.DropClient(connID)
 			return
 		}
 		return
+	case protocol.TypeUnsubscribe:
+		u, err := msg.Unsubscribe()
+		if err != nil {
+			logger.WithConn(connID).Warn("invalid_unsubscribe", "error", err)
+			h.replyError(c, err, msg)
+			return
+		}
+		if _, ok := c.subs[u.DocId]; ok {
+			delete(c.subs, u.DocId)
+			h.rooms.Leave(u.DocId, connID)
+		}
+		return
 	case protocol.TypeSyncOp, protocol.TypeSyncDone:
-		docId, target, err := protocol.ParseTargetedMessage(raw)
+		docId, target, err := msg.Targeted()
 		if err != nil {
 			logger.WithConn(connID).Warn("invalid_targeted_message", "error", err)
+			h.replyError(c, err, msg)
 			return
 		}
-		if !h.rooms.SendToTarget(docId, target, raw) {
+		if !h.rooms.SendToTarget(docId, connID, msg.Type, target, raw) {
 			logger.WithConn(connID).Warn("overload_drop_conn", "doc", docId)
 			h.DropClient(connID)
 			return
 		}
 		return
+	case protocol.TypeBatch:
+		b, err := msg.Batch()
+		if err != nil {
+			logger.WithConn(connID).Warn("invalid_batch", "error", err)
+			h.replyError(c, err, msg)
+			return
+		}
+		batchRaw, err := json.Marshal(b)
+		if err != nil {
+			logger.WithConn(connID).Warn("invalid_batch", "error", err)
+			return
+		}
+		ops := make([][]byte, 0, len(b.Ops))
+		for i := range b.Ops {
+			opRaw, err := json.Marshal(&b.Ops[i])
+			if err != nil {
+				logger.WithConn(connID).Warn("invalid_batch", "error", err)
+				return
+			}
+			ops = append(ops, opRaw)
+		}
+		metrics.IncBatchesProcessed()
+		metrics.AddOpsProcessed(uint64(len(ops)))
+		if !h.subscribe(c, msg, b.DocId, b.SiteId) {
+			return
+		}
+		if !h.rooms.BroadcastBatch(b.DocId, b, batchRaw, ops, connID) {
+			logger.WithConn(connID).Warn("overload_drop_conn", "doc", b.DocId)
+			h.DropClient(connID)
+			return
+		}
+		return
+	case protocol.TypePresence:
+		pr, err := msg.Presence()
+		if err != nil {
+			logger.WithConn(connID).Warn("invalid_presence", "error", err)
+			h.replyError(c, err, msg)
+			return
+		}
+		if !h.subscribe(c, msg, pr.DocId, pr.SiteId) {
+			return
+		}
+		if !h.rooms.UpdatePresence(pr.DocId, connID, pr.State) {
+			logger.WithConn(connID).Warn("overload_drop_conn", "doc", pr.DocId)
+			h.DropClient(connID)
+			return
+		}
+		return
 	default:
-		op, err := protocol.ValidateOperation(raw)
+		op, err := msg.Operation()
 		if err != nil {
 			logger.WithConn(connID).Warn("invalid_message", "error", err)
+			h.replyError(c, err, msg)
 			return
 		}
 		metrics.IncOpsProcessed()
-		if !h.rooms.EnsureJoin(op.DocId, connID, op.SiteId, c.Send) {
-			logger.WithConn(connID).Warn("overload_drop_conn", "doc", op.DocId)
-			h.DropClient(connID)
+		if !h.subscribe(c, msg, op.DocId, op.SiteId) {
 			return
 		}
-		if !h.rooms.Broadcast(op.DocId, raw, connID) {
+		if !h.rooms.Broadcast(op.DocId, op, raw, connID) {
 			logger.WithConn(connID).Warn("overload_drop_conn", "doc", op.DocId)
 			h.DropClient(connID)
 			return
@@ -130,9 +320,104 @@ func (h *Hub) handleMessage(ctx context.Context, connID uint64, raw []byte) {
 	}
 }
 
+// subscribe puts c in docId unless it is already there, up to the connection's
+// subscription limit. Once c is in the doc, only a join or subscribe may change
+// the site it speaks for there. It reports whether msg can go on to the room;
+// if not, c has been told why or dropped.
+func (h *Hub) subscribe(c *Connection, msg *protocol.Message, docId, siteId string) bool {
+	site, joined := c.subs[docId]
+	explicit := msg.Type == protocol.TypeJoin || msg.Type == protocol.TypeSubscribe
+	if joined && !explicit && site != siteId {
+		logger.WithConn(c.ID).Warn("site_changed", "doc", docId, "site", siteId, "joined_as", site)
+		h.replyError(c, protocol.ErrSiteChanged, msg)
+		return false
+	}
+	if !joined && len(c.subs) >= h.maxSubscriptions {
+		metrics.IncSubscriptionsRejected()
+		logger.WithConn(c.ID).Warn("subscription_limit", "doc", docId, "subscriptions", len(c.subs))
+		h.replyError(c, protocol.ErrTooManySubscriptions, msg)
+		return false
+	}
+	if !h.rooms.EnsureJoin(docId, c.ID, siteId, c.Send, c.Features) {
+		logger.WithConn(c.ID).Warn("overload_drop_conn", "doc", docId)
+		h.DropClient(c.ID)
+		return false
+	}
+	c.subs[docId] = siteId
+	return true
+}
+
+// replyError tells the client why its message was rejected, if it negotiated
+// acks. msg is nil when the frame could not be decoded at all.
+func (h *Hub) replyError(c *Connection, err error, msg *protocol.Message) {
+	if !c.Features.Has(protocol.FeatureAcks) {
+		return
+	}
+	var docId string
+	var opId *protocol.OpId
+	if msg != nil {
+		docId = msg.DocId
+		if msg.OpId.Site != "" {
+			opId = &msg.OpId
+		}
+	}
+	reply, err := protocol.NewError(err, docId, opId)
+	if err != nil {
+		return
+	}
+	c.SendNonBlocking(reply)
+}
+
+// handleHello negotiates version and features. Hello must be the first message
+// on a connection; clients that skip it keep the version 1 defaults.
+func (h *Hub) handleHello(c *Connection, msg *protocol.Message) {
+	if c.greeted {
+		// A client resuming a session sends hello before it knows it has
+		// been resumed.
+		if c.token == "" {
+			logger.WithConn(c.ID).Warn("late_hello_ignored")
+		}
+		return
+	}
+	c.greeted = true
+	version, features, err := msg.Hello()
+	if err != nil {
+		logger.WithConn(c.ID).Warn("handshake_refused", "error", err, "client_version", msg.Version)
+		c.CloseWithReason(protocol.CloseUnsupportedVersion, err.Error())
+		return
+	}
+	c.Version = version
+	c.Features = features
+	hello := protocol.NewServerHello()
+	if features.Has(protocol.FeatureSessions) && h.sessionGrace > 0 {
+		hello.Session = h.startSession(c)
+	}
+	reply, err := json.Marshal(hello)
+	if err != nil {
+		return
+	}
+	c.SendNonBlocking(reply)
+	logger.WithConn(c.ID).Info("handshake", "version", version, "features", features.Names())
+}
+
+// Admit reports whether a websocket asking for docId should be upgraded: not
+// if the process is at its connection cap, or if the doc, when the request
+// names one, can't take another connection. Callers answer a refusal with 503
+// before upgrading.
+func (h *Hub) Admit(docId string) bool {
+	live := h.conns.len()
+	full := h.maxConns > 0 && live >= h.maxConns
+	if !full && (docId == "" || !h.rooms.Full(docId)) {
+		return true
+	}
+	metrics.IncConnectionsRefused()
+	logger.Log.Info("connection_refused", "doc", docId, "total", live)
+	return false
+}
+
 func (h *Hub) Register(conn *websocket.Conn) *Connection {
 	id := h.connIDGen.Add(1)
-	c := NewConnection(conn, id)
+	c := newConnection(conn, id, h.sendBuffer)
 	h.register <- c
 	return c
 }
@@ -141,13 +426,46 @@ func (h *Hub) Unregister(c *Connection) {
 	h.unregister <- c
 }
 
-func (h *Hub) Incoming(connID uint64, raw []byte) {
+// Incoming decodes a message read from c and queues it for the hub, unless it
+// is over the rate limits. It runs on c's read goroutine.
+func (h *Hub) Incoming(c *Connection, raw []byte) {
+	msg, err := protocol.DecodeMessage(raw)
+	if err == nil && (msg.Type == protocol.TypeJoin || msg.Type == protocol.TypeSubscribe) && msg.SiteId != "" {
+		c.site = msg.SiteId
+	}
+	if !h.allow(c, msg, len(raw)) {
+		h.throttle(c, msg, len(raw))
+		return
+	}
+	c.throttled = 0
+	if msg != nil && msg.Type == protocol.TypeHello && !c.helloRead {
+		c.helloRead = true
+		c.acks = protocol.ParseFeatures(msg.Features).Has(protocol.FeatureAcks)
+	}
 	select {
-	case h.incoming <- incomingMsg{connID: connID, raw: raw}:
+	case h.incoming <- incomingMsg{connID: c.ID, raw: raw, msg: msg, err: err}:
 	case <-time.After(incomingSendTimeout):
 		metrics.IncBackpressure()
-		logger.WithConn(connID).Warn("router_backpressure_drop", "action", "overload_drop_conn")
-		h.DropClient(connID)
+		logger.WithConn(c.ID).Warn("router_backpressure_drop", "action", "overload_drop_conn")
+		h.DropClient(c.ID)
+	}
+}
+
+// refusal is a room turning a connection away.
+type refusal struct {
+	docId  string
+	connID uint64
+}
+
+// RefuseSubscription forgets that a connection is in a doc whose room turned
+// it away, so the refusal doesn't count towards its subscriptions. Rooms call
+// it from their own goroutines, so like DropClient it never blocks. Should a
+// stale refusal land after a later join was let in, the next message the
+// connection sends to the doc subscribes it again.
+func (h *Hub) RefuseSubscription(docId string, connID uint64) {
+	select {
+	case h.refusals <- refusal{docId: docId, connID: connID}:
+	default:
 	}
 }
 
@@ -155,12 +473,18 @@ func (h *Hub) Done() <-chan struct{} {
 	return h.done
 }
 
+// DropClient closes a connection and has the hub remove it. Rooms call it
+// from their own goroutines, so it never blocks: if the hub is too busy to
+// take the drop, the connection's read pump unregisters it once it sees the
+// close.
 func (h *Hub) DropClient(connID uint64) {
-	if c, ok := h.conns[connID]; ok {
-		c.Close()
-		select {
-		case h.unregister <- c:
-		default:
-		}
+	c := h.conns.get(connID)
+	if c == nil {
+		return
+	}
+	c.Close()
+	select {
+	case h.drops <- c:
+	default:
 	}
 }
@@ -0,0 +1,274 @@
+package ws
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"skepsi/backend/internal/logger"
+	"skepsi/backend/internal/metrics"
+	"skepsi/backend/internal/protocol"
+)
+
+// Incoming traffic is metered per connection, per site and per remote IP
+// before it reaches the hub, so one client flooding the server is turned away
+// on its own read goroutine instead of filling the hub's queue for everyone.
+// A throttled message is dropped and, for clients with acks, answered with a
+// rate_limited error. A connection that keeps at it is closed.
+
+// Limits caps the sustained rate of what clients send. Bursts of up to a
+// second's worth of ops and bytes, and a minute's worth of joins, go through.
+// Zero leaves a limit off.
+type Limits struct {
+	OpsPerSecond   float64
+	BytesPerSecond float64
+	JoinsPerMinute float64
+}
+
+var DefaultConnLimits = Limits{OpsPerSecond: 500, BytesPerSecond: 2 << 20, JoinsPerMinute: 120}
+
+// throttleCloseAfter is how many messages in a row a connection can have
+// throttled before it is closed.
+const throttleCloseAfter = 100
+
+// WithConnLimits sets the limits for each connection.
+func WithConnLimits(l Limits) Option {
+	return func(h *Hub) {
+		h.connLimits = l
+	}
+}
+
+// WithSiteLimits sets the limits shared by every connection of a site. Sites
+// are whatever clients join as, not an identity the server checks, so a client
+// that joins as another site spends that site's limits too; per connection and
+// per IP limits are the ones a client can't get around.
+func WithSiteLimits(l Limits) Option {
+	return func(h *Hub) {
+		h.sites = newLimiterGroup(l)
+	}
+}
+
+// WithIPLimits sets the limits shared by every connection from one address.
+func WithIPLimits(l Limits) Option {
+	return func(h *Hub) {
+		h.ips = newLimiterGroup(l)
+	}
+}
+
+// WithTrustForwardedFor takes the client address from X-Forwarded-For, as set
+// by the proxy. Only turn it on when clients can't reach the server directly.
+func WithTrustForwardedFor(trust bool) Option {
+	return func(h *Hub) {
+		h.trustForwardedFor = trust
+	}
+}
+
+func (l Limits) off() bool {
+	return l.OpsPerSecond <= 0 && l.BytesPerSecond <= 0 && l.JoinsPerMinute <= 0
+}
+
+// bucket holds up to capacity tokens and refills them over window.
+type bucket struct {
+	capacity float64
+	perSec   float64
+	tokens   float64
+	last     time.Time
+}
+
+func newBucket(capacity float64, window time.Duration, now time.Time) *bucket {
+	if capacity <= 0 {
+		return nil
+	}
+	return &bucket{capacity: capacity, perSec: capacity / window.Seconds(), tokens: capacity, last: now}
+}
+
+// fits refills b and reports whether it can pay for n. A full bucket pays for
+// anything, going into debt, so a batch bigger than the burst isn't refused
+// forever.
+func (b *bucket) fits(n float64, now time.Time) bool {
+	if b == nil || n == 0 {
+		return true
+	}
+	b.tokens = min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.perSec)
+	b.last = now
+	return b.tokens >= n || b.tokens == b.capacity
+}
+
+func (b *bucket) spend(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+// cost is what one message spends.
+type cost struct {
+	ops, bytes, joins float64
+}
+
+type limiter struct {
+	ops   *bucket
+	bytes *bucket
+	joins *bucket
+	used  time.Time
+}
+
+func newLimiter(l Limits, now time.Time) *limiter {
+	return &limiter{
+		ops:   newBucket(l.OpsPerSecond, time.Second, now),
+		bytes: newBucket(l.BytesPerSecond, time.Second, now),
+		joins: newBucket(l.JoinsPerMinute, time.Minute, now),
+		used:  now,
+	}
+}
+
+func (l *limiter) fits(c cost, now time.Time) bool {
+	l.used = now
+	return l.ops.fits(c.ops, now) && l.bytes.fits(c.bytes, now) && l.joins.fits(c.joins, now)
+}
+
+func (l *limiter) spend(c cost) {
+	l.ops.spend(c.ops)
+	l.bytes.spend(c.bytes)
+	l.joins.spend(c.joins)
+}
+
+// limiterGroup keeps one limiter per key, shared by the read goroutines of
+// every connection with that key.
+type limiterGroup struct {
+	limits  Limits
+	mu      sync.Mutex
+	byKey   map[string]*limiter
+	sweepAt int
+}
+
+const minSweepAt = 1024
+
+func newLimiterGroup(l Limits) *limiterGroup {
+	if l.off() {
+		return nil
+	}
+	return &limiterGroup{limits: l, byKey: make(map[string]*limiter), sweepAt: minSweepAt}
+}
+
+// get must be called with g.mu held. Limiters unused for a minute have long
+// refilled and are dropped once the group has grown.
+func (g *limiterGroup) get(key string, now time.Time) *limiter {
+	if l, ok := g.byKey[key]; ok {
+		return l
+	}
+	if len(g.byKey) >= g.sweepAt {
+		for k, l := range g.byKey {
+			if now.Sub(l.used) > time.Minute {
+				delete(g.byKey, k)
+			}
+		}
+		g.sweepAt = max(minSweepAt, 2*len(g.byKey))
+	}
+	l := newLimiter(g.limits, now)
+	g.byKey[key] = l
+	return l
+}
+
+// messageCost is what msg spends. A message that couldn't be decoded costs
+// an op.
+func messageCost(msg *protocol.Message, size int) cost {
+	c := cost{bytes: float64(size), ops: 1}
+	if msg == nil {
+		return c
+	}
+	switch msg.Type {
+	case protocol.TypeJoin, protocol.TypeSubscribe:
+		c.ops, c.joins = 0, 1
+	case protocol.TypeBatch:
+		c.ops = float64(len(msg.Ops))
+	case protocol.TypeHello, protocol.TypeUnsubscribe:
+		c.ops = 0
+	}
+	return c
+}
+
+// allow meters msg against every limit that applies to c. Site limits go by
+// the site c last joined with, whatever site a message claims. It runs on c's
+// read goroutine.
+func (h *Hub) allow(c *Connection, msg *protocol.Message, size int) bool {
+	cst := messageCost(msg, size)
+	now := time.Now()
+	if c.limiter == nil {
+		c.limiter = newLimiter(h.connLimits, now)
+	}
+	var site, ip *limiter
+	if h.sites != nil && c.site != "" {
+		h.sites.mu.Lock()
+		defer h.sites.mu.Unlock()
+		site = h.sites.get(c.site, now)
+	}
+	if h.ips != nil && c.ip != "" {
+		h.ips.mu.Lock()
+		defer h.ips.mu.Unlock()
+		ip = h.ips.get(c.ip, now)
+	}
+	ok := c.limiter.fits(cst, now) && (site == nil || site.fits(cst, now)) && (ip == nil || ip.fits(cst, now))
+	if !ok {
+		return false
+	}
+	c.limiter.spend(cst)
+	if site != nil {
+		site.spend(cst)
+	}
+	if ip != nil {
+		ip.spend(cst)
+	}
+	return true
+}
+
+// throttle turns away a message over the limits: it gets an error reply if
+// the client asked for acks, and the connection is closed once too many in a
+// row have been turned away.
+func (h *Hub) throttle(c *Connection, msg *protocol.Message, size int) {
+	metrics.IncThrottledMessages()
+	metrics.AddThrottledBytes(uint64(size))
+	c.throttled++
+	if c.throttled >= throttleCloseAfter {
+		metrics.IncRateLimitCloses()
+		logger.WithConn(c.ID).Warn("rate_limit_close", "ip", c.ip, "site", c.site)
+		c.CloseWithReason(protocol.CloseRateLimited, protocol.ErrRateLimited.Error())
+		return
+	}
+	if c.throttled == 1 {
+		logger.WithConn(c.ID).Warn("rate_limited", "ip", c.ip, "site", c.site)
+	}
+	if !c.acks {
+		return
+	}
+	var docId string
+	var opId *protocol.OpId
+	if msg != nil {
+		docId = msg.DocId
+		if msg.OpId.Site != "" {
+			opId = &msg.OpId
+		}
+	}
+	reply, err := protocol.NewError(protocol.ErrRateLimited, docId, opId)
+	if err != nil {
+		return
+	}
+	c.SendNonBlocking(reply)
+}
+
+// clientIP is the address limits are kept per: the connecting peer, or the
+// first X-Forwarded-For entry when the hub trusts the proxy in front of it.
+func (h *Hub) clientIP(r *http.Request) string {
+	if h.trustForwardedFor {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
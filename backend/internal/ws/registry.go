@@ -0,0 +1,46 @@
+package ws
+
+import "sync"
+
+// registry holds the hub's connections. Only the hub goroutine adds and
+// removes them, but rooms and read goroutines look connections up to drop
+// them, so every access goes through the lock.
+type registry struct {
+	mu    sync.RWMutex
+	conns map[uint64]*Connection
+}
+
+func newRegistry() *registry {
+	return &registry{conns: make(map[uint64]*Connection)}
+}
+
+func (r *registry) get(id uint64) *Connection {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.conns[id]
+}
+
+// add returns how many connections there are now.
+func (r *registry) add(c *Connection) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[c.ID] = c
+	return len(r.conns)
+}
+
+// remove deletes c unless another connection has taken its id, and returns
+// how many connections are left.
+func (r *registry) remove(c *Connection) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns[c.ID] == c {
+		delete(r.conns, c.ID)
+	}
+	return len(r.conns)
+}
+
+func (r *registry) len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.conns)
+}
@@ -0,0 +1,237 @@
+package ws
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"skepsi/backend/internal/logger"
+	"skepsi/backend/internal/metrics"
+	"skepsi/backend/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// A client that negotiates sessions gets a token in the server hello. When its
+// socket closes the connection is only suspended: it stays in its rooms, which
+// keep sending to it, for the session grace period. A new socket that comes
+// back with ?session=<token>&received=<frames> takes the connection over. It is
+// sent a hello with resumed set, then the frames the client missed: those the
+// old socket wrote after the ones it received, kept in the outbox, and those
+// queued while nobody was connected. received counts every frame the client
+// got on the session, the first hello included, and resumed hellos not.
+
+const (
+	DefaultSessionGrace = 30 * time.Second
+	// outboxFrames is how many written frames a session keeps for a resume.
+	// Frames still queued are kept by Send itself.
+	outboxFrames = 256
+)
+
+// socket is one websocket a connection has been using.
+type socket struct {
+	conn   *websocket.Conn
+	codec  protocol.Codec
+	replay []*protocol.Frame
+	// gone is closed when the connection has let go of the socket.
+	gone     chan struct{}
+	goneOnce sync.Once
+	pumps    sync.WaitGroup
+}
+
+func newSocket(conn *websocket.Conn, replay []*protocol.Frame) *socket {
+	conn.SetReadLimit(MaxMessageBytes)
+	s := &socket{conn: conn, codec: protocol.CodecFor(conn.Subprotocol()), replay: replay, gone: make(chan struct{})}
+	s.pumps.Add(2)
+	return s
+}
+
+func (s *socket) frameType() int {
+	if s.codec.Binary() {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+func (s *socket) detach() {
+	s.goneOnce.Do(func() {
+		close(s.gone)
+		_ = s.conn.Close()
+	})
+}
+
+// outbox keeps the last frames written for a session, numbered from 1.
+type outbox struct {
+	frames  []*protocol.Frame
+	written uint64
+}
+
+// since returns the frames after the first received ones, and false if some
+// of them are gone.
+func (o *outbox) since(received uint64) ([]*protocol.Frame, bool) {
+	oldest := o.written - uint64(len(o.frames))
+	if received > o.written || received < oldest {
+		return nil, false
+	}
+	out := make([]*protocol.Frame, 0, o.written-received)
+	return append(out, o.frames[received-oldest:]...), true
+}
+
+func (c *Connection) record(msg *protocol.Frame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.outbox == nil {
+		return
+	}
+	c.outbox.written++
+	if len(c.outbox.frames) == outboxFrames {
+		c.outbox.frames = append(c.outbox.frames[:0], c.outbox.frames[1:]...)
+	}
+	c.outbox.frames = append(c.outbox.frames, msg)
+}
+
+// startSession gives c a token and starts keeping its frames. It runs before
+// the hello carrying the token is queued, so that hello is frame 1.
+func (h *Hub) startSession(c *Connection) string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	c.token = hex.EncodeToString(b[:])
+	c.mu.Lock()
+	c.outbox = &outbox{frames: make([]*protocol.Frame, 0, outboxFrames)}
+	c.mu.Unlock()
+	h.sessions[c.token] = c
+	return c.token
+}
+
+// suspend keeps c in its rooms after its socket closed, if it has a session.
+func (h *Hub) suspend(c *Connection) bool {
+	if c.token == "" || c.Closed() || h.sessionGrace <= 0 {
+		return false
+	}
+	c.suspended = true
+	c.suspension++
+	c.socket().detach()
+	s := suspension{c: c, n: c.suspension}
+	time.AfterFunc(h.sessionGrace, func() {
+		select {
+		case h.expired <- s:
+		case <-h.done:
+		}
+	})
+	metrics.IncSessionsSuspended()
+	logger.WithConn(c.ID).Info("session_suspended", "grace", h.sessionGrace)
+	return true
+}
+
+type suspension struct {
+	c *Connection
+	n uint64
+}
+
+func (h *Hub) expire(s suspension) {
+	c := s.c
+	if h.conns.get(c.ID) != c || !c.suspended || c.suspension != s.n {
+		return
+	}
+	metrics.IncSessionsExpired()
+	logger.WithConn(c.ID).Info("session_expired")
+	h.remove(c)
+}
+
+type resumeReq struct {
+	token string
+	reply chan *Connection
+}
+
+type attachReq struct {
+	c        *Connection
+	conn     *websocket.Conn
+	received uint64
+	reply    chan bool
+}
+
+// takeOver lets go of the socket a session is using, whether it is already
+// suspended or still looks alive, and replies with the session's connection.
+// Until it is attached to the new socket the old one's unregister is ignored
+// and nobody else can take it over.
+func (h *Hub) takeOver(req resumeReq) {
+	c := h.sessions[req.token]
+	if c == nil || c.resuming || c.Closed() {
+		req.reply <- nil
+		return
+	}
+	c.resuming = true
+	c.suspended = false
+	c.suspension++
+	c.socket().detach()
+	req.reply <- c
+}
+
+// attachSocket moves c onto the new socket once the old one's pumps have
+// stopped. A session that no longer has every frame the client missed is
+// given up.
+func (h *Hub) attachSocket(req attachReq) {
+	c := req.c
+	c.resuming = false
+	if h.conns.get(c.ID) != c || c.Closed() {
+		req.reply <- false
+		return
+	}
+	hello := protocol.NewServerHello()
+	hello.Session, hello.Resumed = c.token, true
+	greeting, err := json.Marshal(hello)
+	c.mu.Lock()
+	missed, ok := c.outbox.since(req.received)
+	if ok && err == nil {
+		c.sock = newSocket(req.conn, append([]*protocol.Frame{protocol.NewFrame(greeting)}, missed...))
+	}
+	c.mu.Unlock()
+	if !ok || err != nil {
+		metrics.IncSessionsResumeFailed()
+		logger.WithConn(c.ID).Warn("session_resume_failed", "received", req.received)
+		h.remove(c)
+		req.reply <- false
+		return
+	}
+	metrics.IncSessionsResumed()
+	logger.WithConn(c.ID).Info("session_resumed", "replayed", len(missed))
+	req.reply <- true
+}
+
+// Connect registers a new websocket, or hands it to the session it asks to
+// resume. The caller starts the pumps of the connection it gets back either
+// way.
+func (h *Hub) Connect(conn *websocket.Conn, r *http.Request) *Connection {
+	c := h.connect(conn, r)
+	c.ip = h.clientIP(r)
+	return c
+}
+
+func (h *Hub) connect(conn *websocket.Conn, r *http.Request) *Connection {
+	q := r.URL.Query()
+	token := q.Get("session")
+	if token == "" {
+		return h.Register(conn)
+	}
+	received, _ := strconv.ParseUint(q.Get("received"), 10, 64)
+	req := resumeReq{token: token, reply: make(chan *Connection, 1)}
+	h.resume <- req
+	c := <-req.reply
+	if c == nil {
+		metrics.IncSessionsResumeFailed()
+		return h.Register(conn)
+	}
+	c.socket().pumps.Wait()
+	done := make(chan bool, 1)
+	h.attach <- attachReq{c: c, conn: conn, received: received, reply: done}
+	if !<-done {
+		return h.Register(conn)
+	}
+	return c
+}
@@ -1,53 +1,110 @@
 package load
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	collab "skepsi/backend"
 	"skepsi/backend/internal/metrics"
+	"skepsi/backend/internal/protocol"
 	"skepsi/backend/internal/room"
+	"skepsi/backend/internal/store"
+	"skepsi/backend/internal/wal"
 	"skepsi/backend/internal/ws"
 
 	"github.com/gorilla/websocket"
 )
 
-func runTestServer(tb testing.TB) (*httptest.Server, *room.Manager) {
+func runTestServer(tb testing.TB, opts ...room.Option) (*httptest.Server, *room.Manager) {
 	tb.Helper()
-	roomManager := room.NewManager(nil)
-	hub := ws.NewHub(roomManager)
+	return runTestServerWithHub(tb, nil, opts...)
+}
+
+func runTestServerWithHub(tb testing.TB, hubOpts []ws.Option, opts ...room.Option) (*httptest.Server, *room.Manager) {
+	tb.Helper()
+	server, roomManager, _ := newTestServer(context.Background(), hubOpts, opts...)
+	server.Start()
+	return server, roomManager
+}
+
+// tightBuffer is the server's socket send buffer in the slow consumer tests,
+// and tightSendBuffer their connections' send queue. A peer that stops reading
+// there fills up after a few hundred KB, well before the server's write
+// timeout would give up on it.
+const (
+	tightBuffer     = 16 << 10
+	tightSendBuffer = 64
+)
+
+type tightListener struct{ net.Listener }
+
+func (l tightListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetWriteBuffer(tightBuffer)
+	}
+	return conn, err
+}
+
+// runTightServer is runTestServerWithHub with a tight socket send buffer and
+// send queue.
+func runTightServer(tb testing.TB, opts ...room.Option) (*httptest.Server, *room.Manager) {
+	tb.Helper()
+	server, roomManager, _ := newTestServer(context.Background(), []ws.Option{ws.WithConnLimits(ws.Limits{}), ws.WithSendBuffer(tightSendBuffer)}, opts...)
+	server.Listener = tightListener{server.Listener}
+	server.Start()
+	return server, roomManager
+}
+
+// newTestServer wires up a server like cmd/server does. Its hub and
+// connections stop with ctx.
+func newTestServer(ctx context.Context, hubOpts []ws.Option, opts ...room.Option) (*httptest.Server, *room.Manager, *ws.Hub) {
+	roomManager := room.NewManager(nil, opts...)
+	hub := ws.NewHub(roomManager, hubOpts...)
 	roomManager.SetDropCallback(hub.DropClient)
-	go hub.Run(context.Background())
+	roomManager.SetRefuseCallback(hub.RefuseSubscription)
+	go hub.Run(ctx)
 
 	var upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		Subprotocols:    protocol.Subprotocols(),
 		CheckOrigin:     func(*http.Request) bool { return true },
 	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if !hub.Admit(r.URL.Query().Get("doc")) {
+			http.Error(w, "server is full, retry later", http.StatusServiceUnavailable)
+			return
+		}
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			return
 		}
-		c := hub.Register(conn)
-		go c.ReadPump(context.Background(), func(raw []byte) {
-			hub.Incoming(c.ID, raw)
+		c := hub.Connect(conn, r)
+		go c.ReadPump(ctx, func(raw []byte) {
+			hub.Incoming(c, raw)
 		}, func() {
 			hub.Unregister(c)
 		})
-		go c.WritePump(context.Background())
+		go c.WritePump(ctx)
 	})
 
-	return httptest.NewServer(mux), roomManager
+	return httptest.NewUnstartedServer(mux), roomManager, hub
 }
 
 type insertPayload struct {
@@ -70,10 +127,9 @@ func sendInsert(conn *websocket.Conn, docId, siteId string, counter int, positio
 
 func sendJoin(conn *websocket.Conn, docId, siteId string) error {
 	join := map[string]interface{}{
-		"type":       "join",
-		"docId":      docId,
-		"siteId":     siteId,
-		"knownClock": 0,
+		"type":   "join",
+		"docId":  docId,
+		"siteId": siteId,
 	}
 	data, _ := json.Marshal(join)
 	return conn.WriteMessage(websocket.TextMessage, data)
@@ -125,6 +181,62 @@ func BenchmarkLoad(b *testing.B) {
 	}
 }
 
+// BenchmarkManagerShards feeds inserts for 256 docs straight into the room
+// manager from parallel senders, once per shard count, and reports how many
+// reach the other peer in each doc per second. Run it with -cpu to vary the
+// senders too.
+func BenchmarkManagerShards(b *testing.B) {
+	const docs = 256
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(strconv.Itoa(shards)+"_shards", func(b *testing.B) {
+			m := room.NewManager(nil, room.WithShards(shards))
+			defer m.Shutdown(context.Background())
+			var delivered atomic.Uint64
+			stop := make(chan struct{})
+			defer close(stop)
+			drain := func(ch chan *protocol.Frame, count bool) {
+				for {
+					select {
+					case <-ch:
+						if count {
+							delivered.Add(1)
+						}
+					case <-stop:
+						return
+					}
+				}
+			}
+			for d := 0; d < docs; d++ {
+				docId := "shard-doc-" + strconv.Itoa(d)
+				sender, receiver := make(chan *protocol.Frame, ws.SendBufferSize), make(chan *protocol.Frame, ws.SendBufferSize)
+				m.EnsureJoin(docId, uint64(2*d+1), "sender", sender, 0)
+				m.EnsureJoin(docId, uint64(2*d+2), "receiver", receiver, 0)
+				go drain(sender, false)
+				go drain(receiver, true)
+			}
+			var sent atomic.Uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					n := sent.Add(1)
+					d := int(n % docs)
+					docId := "shard-doc-" + strconv.Itoa(d)
+					payload, _ := json.Marshal(insertPayload{Position: []int{int(n)}, Value: "x"})
+					op := &protocol.Operation{Type: protocol.TypeInsert, DocId: docId, SiteId: "sender", OpId: protocol.OpId{Site: "sender", Counter: int(n)}, Payload: payload}
+					raw, _ := json.Marshal(op)
+					m.Broadcast(docId, op, raw, uint64(2*d+1))
+				}
+			})
+			deadline := time.Now().Add(5 * time.Second)
+			for delivered.Load() < sent.Load() && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			b.ReportMetric(float64(delivered.Load())/b.Elapsed().Seconds(), "ops/sec")
+			b.ReportMetric(float64(sent.Load()-delivered.Load()), "lost")
+		})
+	}
+}
+
 func Test400ConcurrentConnections(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping 400-connection test in short mode")
@@ -353,3 +465,2935 @@ func Test400ConcurrentConnectionsAllTyping(t *testing.T) {
 		conn.Close()
 	}
 }
+
+func TestMixedEncodingsShareRoom(t *testing.T) {
+	server, _ := runTestServer(t)
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+
+	jsonConn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jsonConn.Close()
+	cborDialer := websocket.Dialer{Subprotocols: []string{protocol.SubprotocolCBOR}}
+	cborConn, _, err := cborDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cborConn.Close()
+	if cborConn.Subprotocol() != protocol.SubprotocolCBOR {
+		t.Fatalf("negotiated %q, want %q", cborConn.Subprotocol(), protocol.SubprotocolCBOR)
+	}
+
+	docId := "mixed-doc"
+	if err := sendJoin(jsonConn, docId, "json-site"); err != nil {
+		t.Fatal(err)
+	}
+	join, _ := json.Marshal(map[string]interface{}{"type": "join", "docId": docId, "siteId": "cbor-site"})
+	frame, err := protocol.CBORCodec.Encode(join)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cborConn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatal(err)
+	}
+
+	readOp := func(conn *websocket.Conn, wantType int) protocol.Operation {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		for {
+			mt, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mt != wantType {
+				t.Fatalf("frame type %d, want %d", mt, wantType)
+			}
+			if mt == websocket.BinaryMessage {
+				if data, err = protocol.CBORCodec.Decode(data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var op protocol.Operation
+			if err := json.Unmarshal(data, &op); err != nil {
+				t.Fatal(err)
+			}
+			if op.Type == "insert" {
+				return op
+			}
+		}
+	}
+
+	insert, _ := json.Marshal(map[string]interface{}{
+		"type": "insert", "docId": docId, "siteId": "cbor-site",
+		"opId":    map[string]interface{}{"site": "cbor-site", "counter": 0},
+		"payload": insertPayload{Position: []int{32768}, Value: "b"},
+	})
+	if frame, err = protocol.CBORCodec.Encode(insert); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := cborConn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatal(err)
+	}
+	if op := readOp(jsonConn, websocket.TextMessage); op.SiteId != "cbor-site" {
+		t.Errorf("json client got op from %q", op.SiteId)
+	}
+
+	if err := sendInsert(jsonConn, docId, "json-site", 0, []int{16384}, "j"); err != nil {
+		t.Fatal(err)
+	}
+	if op := readOp(cborConn, websocket.BinaryMessage); op.SiteId != "json-site" {
+		t.Errorf("cbor client got op from %q", op.SiteId)
+	}
+}
+
+func TestBatchFanOut(t *testing.T) {
+	server, _ := runTestServer(t)
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+
+	sender, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	docId := "batch-doc"
+	if err := sendJoin(receiver, docId, "receiver"); err != nil {
+		t.Fatal(err)
+	}
+	var done protocol.SyncDoneMessage
+	readUntilType(t, receiver, protocol.TypeSyncDone, &done)
+
+	var ops []map[string]interface{}
+	for i := 0; i < 50; i++ {
+		ops = append(ops, map[string]interface{}{
+			"type":    "insert",
+			"opId":    map[string]interface{}{"site": "sender", "counter": i},
+			"payload": insertPayload{Position: []int{32768, i}, Value: "x"},
+		})
+	}
+	ops = append(ops, ops[0])
+	batch, _ := json.Marshal(map[string]interface{}{"type": "batch", "docId": docId, "siteId": "sender", "ops": ops})
+	if err := sender.WriteMessage(websocket.TextMessage, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		receiver.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, data, err := receiver.ReadMessage()
+		if err != nil {
+			t.Fatalf("after %d ops: %v", i, err)
+		}
+		var op protocol.Operation
+		if err := json.Unmarshal(data, &op); err != nil {
+			t.Fatal(err)
+		}
+		if op.OpId.Counter != i || op.DocId != docId || op.SiteId != "sender" {
+			t.Fatalf("op %d: got %+v", i, op)
+		}
+	}
+	receiver.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, data, err := receiver.ReadMessage(); err == nil {
+		t.Errorf("unexpected extra message %s", data)
+	}
+}
+
+func sendHello(conn *websocket.Conn, version int, features ...string) error {
+	hello := map[string]interface{}{
+		"type":     "hello",
+		"version":  version,
+		"features": features,
+	}
+	data, _ := json.Marshal(hello)
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func TestHelloHandshake(t *testing.T) {
+	server, _ := runTestServer(t)
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := sendHello(conn, protocol.ProtocolVersion, "batch"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var reply protocol.HelloMessage
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != protocol.TypeHello || reply.Version != protocol.ProtocolVersion {
+		t.Errorf("unexpected hello reply %+v", reply)
+	}
+
+	old, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	if err := sendHello(old, protocol.ProtocolVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	old.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, _, err = old.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != protocol.CloseUnsupportedVersion {
+		t.Fatalf("expected close %d, got %v", protocol.CloseUnsupportedVersion, err)
+	}
+	if closeErr.Text == "" {
+		t.Error("close frame should carry a reason")
+	}
+}
+
+func TestBatchFrameForBatchCapablePeer(t *testing.T) {
+	server, _ := runTestServer(t)
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+
+	sender, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	docId := "batch-frame-doc"
+	if err := sendHello(receiver, protocol.ProtocolVersion, "batch"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendJoin(receiver, docId, "receiver"); err != nil {
+		t.Fatal(err)
+	}
+	receiver.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var hello protocol.HelloMessage
+	if err := receiver.ReadJSON(&hello); err != nil {
+		t.Fatal(err)
+	}
+	var done protocol.SyncDoneMessage
+	readUntilType(t, receiver, protocol.TypeSyncDone, &done)
+
+	ops := []map[string]interface{}{
+		{"type": "insert", "opId": map[string]interface{}{"site": "sender", "counter": 0}, "payload": insertPayload{Position: []int{100}, Value: "a"}},
+		{"type": "insert", "opId": map[string]interface{}{"site": "sender", "counter": 1}, "payload": insertPayload{Position: []int{200}, Value: "b"}},
+	}
+	batch, _ := json.Marshal(map[string]interface{}{"type": "batch", "docId": docId, "siteId": "sender", "ops": ops})
+	if err := sender.WriteMessage(websocket.TextMessage, batch); err != nil {
+		t.Fatal(err)
+	}
+	var got protocol.BatchMessage
+	if err := receiver.ReadJSON(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != protocol.TypeBatch || len(got.Ops) != 2 || got.Ops[1].OpId.Counter != 1 {
+		t.Errorf("unexpected batch frame %+v", got)
+	}
+}
+
+func TestAcksAndErrorReplies(t *testing.T) {
+	server, _ := runTestServer(t)
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	docId := "ack-doc"
+	if err := sendHello(conn, protocol.ProtocolVersion, "acks"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var hello protocol.HelloMessage
+	if err := conn.ReadJSON(&hello); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendInsert(conn, docId, "acker", 7, []int{100}, "a"); err != nil {
+		t.Fatal(err)
+	}
+	var ack protocol.AckMessage
+	if err := conn.ReadJSON(&ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.Type != protocol.TypeAck || ack.DocId != docId || len(ack.OpIds) != 1 || ack.OpIds[0].Counter != 7 {
+		t.Errorf("unexpected ack %+v", ack)
+	}
+
+	if err := sendInsert(conn, "", "acker", 8, []int{101}, "b"); err != nil {
+		t.Fatal(err)
+	}
+	var reply protocol.ErrorMessage
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != protocol.TypeError || reply.Code != protocol.CodeMissingDocId || reply.OpId == nil || reply.OpId.Counter != 8 {
+		t.Errorf("unexpected error reply %+v", reply)
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("{not json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Code != protocol.CodeMalformed {
+		t.Errorf("expected malformed, got %+v", reply)
+	}
+
+	if err := sendInsert(conn, docId, "acker", 9, []int{102}, strings.Repeat("x", protocol.MaxPayloadBytes)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("oversized op should get an error reply, not a closed socket: %v", err)
+	}
+	if reply.Code != protocol.CodePayloadTooLarge {
+		t.Errorf("expected payload_too_large, got %+v", reply)
+	}
+
+	ops := []map[string]interface{}{
+		{"type": "insert", "opId": map[string]interface{}{"site": "acker", "counter": 9}, "payload": insertPayload{Position: []int{102}, Value: "c"}},
+		{"type": "delete", "opId": map[string]interface{}{"site": "acker", "counter": 10}, "payload": insertPayload{Position: []int{102}}},
+	}
+	batch, _ := json.Marshal(map[string]interface{}{"type": "batch", "docId": docId, "siteId": "acker", "ops": ops})
+	if err := conn.WriteMessage(websocket.TextMessage, batch); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.ReadJSON(&ack); err != nil {
+		t.Fatal(err)
+	}
+	if len(ack.OpIds) != 2 || ack.OpIds[0].Counter != 9 || ack.OpIds[1].Counter != 10 {
+		t.Errorf("unexpected batch ack %+v", ack)
+	}
+}
+
+func readUntilType(t *testing.T, conn *websocket.Conn, msgType string, v interface{}) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", msgType, err)
+		}
+		var env struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(data, &env); err != nil {
+			t.Fatal(err)
+		}
+		if env.Type == msgType {
+			if err := json.Unmarshal(data, v); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+}
+
+func TestPresenceRosterAndDepartures(t *testing.T) {
+	server, _ := runTestServer(t)
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "presence-doc"
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendHello(alice, protocol.ProtocolVersion, "presence"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	state, _ := json.Marshal(map[string]interface{}{"type": "presence", "docId": docId, "siteId": "alice",
+		"state": map[string]interface{}{"name": "Alice", "color": "#f00"}})
+	if err := alice.WriteMessage(websocket.TextMessage, state); err != nil {
+		t.Fatal(err)
+	}
+	var roster protocol.RosterMessage
+	readUntilType(t, alice, protocol.TypeRoster, &roster)
+	if len(roster.Peers) != 0 {
+		t.Errorf("first joiner should get an empty roster, got %+v", roster.Peers)
+	}
+
+	bob, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendHello(bob, protocol.ProtocolVersion, "presence"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := sendJoin(bob, docId, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	readUntilType(t, bob, protocol.TypeRoster, &roster)
+	if len(roster.Peers) != 1 || roster.Peers[0].SiteId != "alice" || !bytes.Contains(roster.Peers[0].State, []byte("Alice")) {
+		t.Errorf("unexpected roster %+v", roster)
+	}
+
+	var joined protocol.PeerJoined
+	readUntilType(t, alice, protocol.TypePeerJoined, &joined)
+	if joined.SiteId != "bob" {
+		t.Errorf("unexpected peer_joined %+v", joined)
+	}
+
+	bob.Close()
+	var left protocol.PeerLeft
+	readUntilType(t, alice, protocol.TypePeerLeft, &left)
+	if left.SiteId != "bob" || left.Reason != protocol.LeftDisconnected {
+		t.Errorf("unexpected peer_left %+v", left)
+	}
+}
+
+func sendCursor(conn *websocket.Conn, docId, siteId string, counter int, position []int) error {
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":    "cursor",
+		"docId":   docId,
+		"siteId":  siteId,
+		"opId":    map[string]interface{}{"site": siteId, "counter": counter},
+		"payload": map[string]interface{}{"position": position},
+	})
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func TestCursorCoalescing(t *testing.T) {
+	server, _ := runTestServer(t, room.WithCursorFlushInterval(200*time.Millisecond))
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "cursor-doc"
+
+	dial := func(siteId string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sendJoin(conn, docId, siteId); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		return conn
+	}
+	alice := dial("alice")
+	defer alice.Close()
+	bob := dial("bob")
+	defer bob.Close()
+
+	const updates = 20
+	for i := 1; i <= updates; i++ {
+		if err := sendCursor(alice, docId, "alice", i, []int{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var received []protocol.Operation
+	bob.SetReadDeadline(time.Now().Add(700 * time.Millisecond))
+	for {
+		_, data, err := bob.ReadMessage()
+		if err != nil {
+			break
+		}
+		var op protocol.Operation
+		if json.Unmarshal(data, &op) == nil && op.Type == protocol.TypeCursor {
+			received = append(received, op)
+		}
+	}
+	if len(received) == 0 || len(received) >= updates {
+		t.Fatalf("expected coalesced cursor updates, got %d of %d", len(received), updates)
+	}
+	if last := received[len(received)-1]; last.OpId.Counter != updates {
+		t.Errorf("last cursor should be the newest, got counter %d", last.OpId.Counter)
+	}
+
+	carol := dial("carol")
+	defer carol.Close()
+	var current protocol.Operation
+	readUntilType(t, carol, protocol.TypeCursor, &current)
+	if current.SiteId != "alice" || current.OpId.Counter != updates {
+		t.Errorf("joiner should get alice's current cursor, got %+v", current)
+	}
+}
+
+func TestDuplicateSuppressionAndResend(t *testing.T) {
+	server, _ := runTestServer(t)
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "dedup-doc"
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendHello(alice, protocol.ProtocolVersion, "resend"); err != nil {
+		t.Fatal(err)
+	}
+	bob, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendJoin(bob, docId, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	dupsBefore := metrics.DuplicateOpsTotal.Load()
+	gapsBefore := metrics.CounterGapsTotal.Load()
+	for _, counter := range []int{0, 0, 1, 0, 4} {
+		if err := sendInsert(alice, docId, "alice", counter, []int{counter}, "x"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var resend protocol.ResendMessage
+	readUntilType(t, alice, protocol.TypeResend, &resend)
+	if resend.Site != "alice" || resend.From != 2 || resend.To != 3 {
+		t.Errorf("unexpected resend request %+v", resend)
+	}
+
+	var got []int
+	bob.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	for {
+		_, data, err := bob.ReadMessage()
+		if err != nil {
+			break
+		}
+		var op protocol.Operation
+		if json.Unmarshal(data, &op) == nil && op.Type == protocol.TypeInsert {
+			got = append(got, op.OpId.Counter)
+		}
+	}
+	if len(got) != 3 || got[0] != 0 || got[1] != 1 || got[2] != 4 {
+		t.Errorf("bob should see each op once, got counters %v", got)
+	}
+	if d := metrics.DuplicateOpsTotal.Load() - dupsBefore; d != 2 {
+		t.Errorf("expected 2 duplicates counted, got %d", d)
+	}
+	if g := metrics.CounterGapsTotal.Load() - gapsBefore; g != 1 {
+		t.Errorf("expected 1 gap counted, got %d", g)
+	}
+}
+
+// TestSpoofedOpIdRejected has mallory send ops under alice's opIds, both
+// from her own site and claiming alice's. Neither may reach the room, or
+// alice's real op with that counter would be dropped as a duplicate.
+func TestSpoofedOpIdRejected(t *testing.T) {
+	server, _ := runTestServer(t)
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "spoof-doc"
+
+	dial := func(siteId string, features ...string) *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(features) > 0 {
+			if err := sendHello(conn, protocol.ProtocolVersion, features...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := sendJoin(conn, docId, siteId); err != nil {
+			t.Fatal(err)
+		}
+		var done protocol.SyncDoneMessage
+		readUntilType(t, conn, protocol.TypeSyncDone, &done)
+		return conn
+	}
+	mallory := dial("mallory", "acks")
+	defer mallory.Close()
+	alice := dial("alice")
+	defer alice.Close()
+	bob := dial("bob")
+	defer bob.Close()
+
+	forged, _ := json.Marshal(map[string]interface{}{
+		"type":    "insert",
+		"docId":   docId,
+		"siteId":  "mallory",
+		"opId":    map[string]interface{}{"site": "alice", "counter": 0},
+		"payload": insertPayload{Position: []int{1}, Value: "m"},
+	})
+	if err := mallory.WriteMessage(websocket.TextMessage, forged); err != nil {
+		t.Fatal(err)
+	}
+	var reply protocol.ErrorMessage
+	readUntilType(t, mallory, protocol.TypeError, &reply)
+	if reply.Code != protocol.CodeSiteMismatch {
+		t.Errorf("opId of another site: got %+v, want %s", reply, protocol.CodeSiteMismatch)
+	}
+	if err := sendInsert(mallory, docId, "alice", 0, []int{1}, "m"); err != nil {
+		t.Fatal(err)
+	}
+	reply = protocol.ErrorMessage{}
+	readUntilType(t, mallory, protocol.TypeError, &reply)
+	if reply.Code != protocol.CodeSiteChanged {
+		t.Errorf("site other than the one joined with: got %+v, want %s", reply, protocol.CodeSiteChanged)
+	}
+
+	dups := metrics.DuplicateOpsTotal.Load()
+	if err := sendInsert(alice, docId, "alice", 0, []int{1}, "a"); err != nil {
+		t.Fatal(err)
+	}
+	var op protocol.Operation
+	readUntilType(t, bob, protocol.TypeInsert, &op)
+	if p, _ := op.InsertPayload(); op.OpId.Site != "alice" || p.Value != "a" {
+		t.Errorf("bob should get alice's own op, got %+v", op)
+	}
+	if metrics.DuplicateOpsTotal.Load() != dups {
+		t.Error("alice's op was taken for a duplicate of mallory's forgery")
+	}
+}
+
+func TestJoinAnsweredFromReplica(t *testing.T) {
+	server, _ := runTestServer(t)
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "replica-doc"
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var done protocol.SyncDoneMessage
+	readUntilType(t, alice, protocol.TypeSyncDone, &done)
+	if err := sendInsert(alice, docId, "alice", 0, []int{200}, "i"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendInsert(alice, docId, "alice", 1, []int{100}, "h"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendInsert(alice, docId, "alice", 2, []int{300}, "!"); err != nil {
+		t.Fatal(err)
+	}
+	del, _ := json.Marshal(map[string]interface{}{"type": "delete", "docId": docId, "siteId": "alice",
+		"opId": map[string]interface{}{"site": "alice", "counter": 3}, "payload": map[string]interface{}{"position": []int{300}}})
+	if err := alice.WriteMessage(websocket.TextMessage, del); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	alice.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	bob, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if err := sendJoin(bob, docId, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	var text []string
+	var deletes int
+	bob.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		_, data, err := bob.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for sync: %v", err)
+		}
+		var msg protocol.SyncOpMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == protocol.TypeSyncDone {
+			break
+		}
+		if msg.Type != protocol.TypeSyncOp || msg.Target != "bob" {
+			t.Fatalf("unexpected message %s", data)
+		}
+		switch msg.Op.Type {
+		case protocol.TypeInsert:
+			p, err := msg.Op.InsertPayload()
+			if err != nil {
+				t.Fatal(err)
+			}
+			text = append(text, p.Value)
+		case protocol.TypeDelete:
+			deletes++
+		}
+	}
+	if got := strings.Join(text, ""); got != "hi!" || deletes != 1 {
+		t.Errorf("lone joiner should get the document in order, got %q with %d deletes", got, deletes)
+	}
+}
+
+// TestPartialReplicaAsksPeer has alice bring a doc the room never saw. What
+// the room has seen of it since is only part of the doc, so bob's join goes to
+// alice. Her whole answer completes the replica, which then answers carol.
+func TestPartialReplicaAsksPeer(t *testing.T) {
+	server, _ := runTestServer(t)
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "partial-doc"
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendJoinKnowing(alice, docId, "alice", map[string]int{"alice": 1}); err != nil {
+		t.Fatal(err)
+	}
+	var done protocol.SyncDoneMessage
+	readUntilType(t, alice, protocol.TypeSyncDone, &done)
+	if err := sendInsert(alice, docId, "alice", 2, []int{300}, "c"); err != nil {
+		t.Fatal(err)
+	}
+	var asked atomic.Int32
+	go func() {
+		for {
+			var join protocol.JoinMessage
+			if alice.ReadJSON(&join) != nil {
+				return
+			}
+			if join.Type != protocol.TypeJoin {
+				continue
+			}
+			asked.Add(1)
+			for c, ch := range "abc" {
+				payload, _ := json.Marshal(insertPayload{Position: []int{100 * (c + 1)}, Value: string(ch)})
+				op := protocol.Operation{Type: protocol.TypeInsert, DocId: docId, SiteId: "alice",
+					OpId: protocol.OpId{Site: "alice", Counter: c}, Payload: payload}
+				syncOp, _ := json.Marshal(protocol.SyncOpMessage{Type: protocol.TypeSyncOp, DocId: docId, Target: join.SiteId, Op: op})
+				alice.WriteMessage(websocket.TextMessage, syncOp)
+			}
+			done, _ := json.Marshal(protocol.SyncDoneMessage{Type: protocol.TypeSyncDone, DocId: docId, Target: join.SiteId})
+			alice.WriteMessage(websocket.TextMessage, done)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	for _, siteId := range []string{"bob", "carol"} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := sendJoin(conn, docId, siteId); err != nil {
+			t.Fatal(err)
+		}
+		if got := readSyncedDoc(t, conn); got != "abc" {
+			t.Errorf("%s should get the whole doc, got %q", siteId, got)
+		}
+	}
+	if n := asked.Load(); n != 1 {
+		t.Errorf("alice should be asked for bob only, was asked %d times", n)
+	}
+}
+
+// readSyncedDoc applies a sync the way clients do, with an insert at a
+// position that already exists undeleting it, and returns the text.
+func readSyncedDoc(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	doc := collab.NewEngine()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		var msg protocol.SyncOpMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == protocol.TypeSyncDone {
+			return doc.String()
+		}
+		if msg.Type != protocol.TypeSyncOp {
+			continue
+		}
+		switch msg.Op.Type {
+		case protocol.TypeInsert:
+			p, err := msg.Op.InsertPayload()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if el := doc.ElementAt(p.Position); el != nil {
+				el.Deleted = false
+				continue
+			}
+			value, _ := utf8.DecodeRuneInString(p.Value)
+			doc.ApplyRemote(p.Position, value, false)
+		case protocol.TypeDelete:
+			p, err := msg.Op.DeletePayload()
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc.Delete(p.Position)
+		}
+	}
+}
+
+func TestReplicaFollowsUndoRedo(t *testing.T) {
+	server, _ := runTestServer(t)
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "undo-doc"
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var done protocol.SyncDoneMessage
+	readUntilType(t, alice, protocol.TypeSyncDone, &done)
+	sendDelete := func(counter int, position []int) {
+		del, _ := json.Marshal(map[string]interface{}{"type": "delete", "docId": docId, "siteId": "alice",
+			"opId": map[string]interface{}{"site": "alice", "counter": counter}, "payload": map[string]interface{}{"position": position}})
+		if err := alice.WriteMessage(websocket.TextMessage, del); err != nil {
+			t.Fatal(err)
+		}
+	}
+	joinedText := func(siteId string) string {
+		time.Sleep(100 * time.Millisecond)
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := sendJoin(conn, docId, siteId); err != nil {
+			t.Fatal(err)
+		}
+		return readSyncedDoc(t, conn)
+	}
+
+	if err := sendInsert(alice, docId, "alice", 0, []int{100}, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendInsert(alice, docId, "alice", 1, []int{200}, "b"); err != nil {
+		t.Fatal(err)
+	}
+	sendDelete(2, []int{200})
+	// Undo re-inserts the deleted character at the same position.
+	if err := sendInsert(alice, docId, "alice", 3, []int{200}, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := joinedText("bob"); got != "ab" {
+		t.Errorf("joiner after undo got %q, want %q", got, "ab")
+	}
+	// Redo deletes it again.
+	sendDelete(4, []int{200})
+	if got := joinedText("carol"); got != "a" {
+		t.Errorf("joiner after redo got %q, want %q", got, "a")
+	}
+}
+
+func TestRoomRecoversFromLog(t *testing.T) {
+	dir := t.TempDir()
+	docId := "durable-doc"
+
+	docStore, err := store.OpenFileStore(dir, wal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := runTestServer(t, room.WithStore(docStore))
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	for i, ch := range "hey" {
+		if err := sendInsert(alice, docId, "alice", i, []int{100 * (i + 1)}, string(ch)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	alice.Close()
+	server.Close()
+	if err := docStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	docStore, err = store.OpenFileStore(dir, wal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer docStore.Close()
+	server, _ = runTestServer(t, room.WithStore(docStore))
+	defer server.Close()
+	wsURL = "ws" + server.URL[4:] + "/ws"
+	bob, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if err := sendJoin(bob, docId, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	var text strings.Builder
+	bob.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		var msg protocol.SyncOpMessage
+		if err := bob.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == protocol.TypeSyncDone {
+			break
+		}
+		p, err := msg.Op.InsertPayload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		text.WriteString(p.Value)
+	}
+	if text.String() != "hey" {
+		t.Errorf("restarted server should replay the log, joiner got %q", text.String())
+	}
+
+	// A retry of an op from before the restart is still a duplicate.
+	alice, _, err = websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	readSyncedText(t, alice)
+	dups := metrics.DuplicateOpsTotal.Load()
+	if err := sendInsert(alice, docId, "alice", 1, []int{200}, "e"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if metrics.DuplicateOpsTotal.Load() != dups+1 {
+		t.Error("op replayed from the log should be recognised as a duplicate")
+	}
+}
+
+// TestShutdownSnapshotsRooms stops the server the way cmd/server does, right
+// after the last ops, and checks they survive into a snapshot the restarted
+// server serves joiners from.
+func TestShutdownSnapshotsRooms(t *testing.T) {
+	dir := t.TempDir()
+	docId := "shutdown-doc"
+	docStore, err := store.OpenFileStore(dir, wal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, roomManager, hub := newTestServer(ctx, nil, room.WithStore(docStore))
+	server.Start()
+	alice, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendHello(alice, protocol.ProtocolVersion, "acks"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	for i, ch := range "bye" {
+		if err := sendInsert(alice, docId, "alice", i, []int{100 * (i + 1)}, string(ch)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for acked := 0; acked < 3; {
+		var ack protocol.AckMessage
+		readUntilType(t, alice, protocol.TypeAck, &ack)
+		acked += len(ack.OpIds)
+	}
+
+	cancel()
+	server.Close()
+	<-hub.Done()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	roomManager.Shutdown(shutdownCtx)
+	if err := docStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	docStore, err = store.OpenFileStore(dir, wal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer docStore.Close()
+	snap, err := docStore.LoadSnapshot(docId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap == nil || snap.Version != 3 {
+		t.Fatalf("shutdown should snapshot every op, got %+v", snap)
+	}
+	server, _ = runTestServer(t, room.WithStore(docStore))
+	defer server.Close()
+	bob, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if err := sendJoin(bob, docId, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if text := readSyncedText(t, bob); text != "bye" {
+		t.Errorf("restarted server should have the last ops, joiner got %q", text)
+	}
+}
+
+func readSyncedText(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	var text strings.Builder
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		var msg protocol.SyncOpMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == protocol.TypeSyncDone {
+			return text.String()
+		}
+		if msg.Type != protocol.TypeSyncOp || msg.Op.Type != protocol.TypeInsert {
+			continue
+		}
+		p, err := msg.Op.InsertPayload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		text.WriteString(p.Value)
+	}
+}
+
+func TestSnapshotCompaction(t *testing.T) {
+	docStore := store.NewMemoryStore()
+	snapshots := metrics.SnapshotsTotal.Load()
+	server, _ := runTestServer(t, room.WithStore(docStore), room.WithSnapshotEvery(3, 0))
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "snapshot-doc"
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	for i, ch := range "hello" {
+		if err := sendInsert(alice, docId, "alice", i, []int{100 * (i + 1)}, string(ch)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	alice.Close()
+	server.Close()
+
+	if got := metrics.SnapshotsTotal.Load() - snapshots; got != 1 {
+		t.Errorf("expected 1 snapshot after 5 ops, got %d", got)
+	}
+	snap, err := docStore.LoadSnapshot(docId)
+	if err != nil || snap == nil {
+		t.Fatalf("no snapshot saved: %v", err)
+	}
+	if snap.Version != 3 || snap.Clock["alice"] != 2 {
+		t.Errorf("unexpected snapshot version %d clock %v", snap.Version, snap.Clock)
+	}
+	tail, err := docStore.LoadSince(docId, 0)
+	if err != nil || len(tail) != 2 {
+		t.Errorf("log should be compacted to the 2 ops after the snapshot, got %d (%v)", len(tail), err)
+	}
+
+	server, _ = runTestServer(t, room.WithStore(docStore))
+	defer server.Close()
+	bob, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if err := sendJoin(bob, docId, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readSyncedText(t, bob); got != "hello" {
+		t.Errorf("recovery from snapshot plus tail gave %q", got)
+	}
+}
+
+// TestSnapshotRestoreRemembersSupersededOps retries a delete that undo has
+// since superseded, after the room restarted from a snapshot that no longer
+// holds it. The snapshot's counters still mark it seen, so the retry is a
+// duplicate and doesn't delete the character again.
+func TestSnapshotRestoreRemembersSupersededOps(t *testing.T) {
+	docStore := store.NewMemoryStore()
+	docId := "superseded-doc"
+	dial := func(server *httptest.Server, siteId string) *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sendJoin(conn, docId, siteId); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	sendDelete := func(conn *websocket.Conn, counter int) {
+		t.Helper()
+		del, _ := json.Marshal(map[string]interface{}{"type": "delete", "docId": docId, "siteId": "alice",
+			"opId": map[string]interface{}{"site": "alice", "counter": counter}, "payload": map[string]interface{}{"position": []int{5}}})
+		if err := conn.WriteMessage(websocket.TextMessage, del); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server, _ := runTestServer(t, room.WithStore(docStore), room.WithSnapshotEvery(1, 0))
+	alice := dial(server, "alice")
+	var done protocol.SyncDoneMessage
+	readUntilType(t, alice, protocol.TypeSyncDone, &done)
+	if err := sendInsert(alice, docId, "alice", 1, []int{5}, "x"); err != nil {
+		t.Fatal(err)
+	}
+	sendDelete(alice, 2)
+	// Undo re-inserts it, superseding the delete.
+	if err := sendInsert(alice, docId, "alice", 3, []int{5}, "x"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	alice.Close()
+	server.Close()
+
+	server, _ = runTestServer(t, room.WithStore(docStore), room.WithSnapshotEvery(1, 0))
+	defer server.Close()
+	alice = dial(server, "alice")
+	defer alice.Close()
+	readUntilType(t, alice, protocol.TypeSyncDone, &done)
+	dups := metrics.DuplicateOpsTotal.Load()
+	sendDelete(alice, 2)
+	time.Sleep(100 * time.Millisecond)
+	if metrics.DuplicateOpsTotal.Load() != dups+1 {
+		t.Error("the retried delete should be recognised as a duplicate")
+	}
+	bob := dial(server, "bob")
+	defer bob.Close()
+	if got := readSyncedDoc(t, bob); got != "x" {
+		t.Errorf("joiner after the retry got %q, want %q", got, "x")
+	}
+}
+
+func TestSnapshotOnInterval(t *testing.T) {
+	docStore := store.NewMemoryStore()
+	server, _ := runTestServer(t, room.WithStore(docStore), room.WithSnapshotEvery(0, 100*time.Millisecond))
+	defer server.Close()
+	docId := "interval-doc"
+
+	alice, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendInsert(alice, docId, "alice", 0, []int{100}, "x"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	snap, err := docStore.LoadSnapshot(docId)
+	if err != nil || snap == nil || snap.Version != 1 {
+		t.Errorf("expected a timed snapshot at version 1, got %+v (%v)", snap, err)
+	}
+}
+
+// failingStore fails every append while failing is set.
+type failingStore struct {
+	*store.MemoryStore
+	failing atomic.Bool
+}
+
+func (s *failingStore) AppendOp(docId string, op []byte) (uint64, error) {
+	if s.failing.Load() {
+		return 0, errors.New("disk full")
+	}
+	return s.MemoryStore.AppendOp(docId, op)
+}
+
+func TestOpNotRelayedWhenStoreFails(t *testing.T) {
+	docStore := &failingStore{MemoryStore: store.NewMemoryStore()}
+	server, _ := runTestServer(t, room.WithStore(docStore))
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "failing-doc"
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendHello(alice, protocol.ProtocolVersion, "acks"); err != nil {
+		t.Fatal(err)
+	}
+	var hello protocol.HelloMessage
+	readUntilType(t, alice, protocol.TypeHello, &hello)
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var done protocol.SyncDoneMessage
+	readUntilType(t, alice, protocol.TypeSyncDone, &done)
+	bob, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if err := sendJoin(bob, docId, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	readUntilType(t, bob, protocol.TypeSyncDone, &done)
+
+	docStore.failing.Store(true)
+	if err := sendInsert(alice, docId, "alice", 1, []int{100}, "a"); err != nil {
+		t.Fatal(err)
+	}
+	var reply protocol.ErrorMessage
+	readUntilType(t, alice, protocol.TypeError, &reply)
+	if reply.Code != protocol.CodeStoreUnavailable || reply.OpId == nil || reply.OpId.Counter != 1 {
+		t.Errorf("op the store couldn't take should get store_unavailable, got %+v", reply)
+	}
+
+	// Once the store is back the retry goes through instead of counting as a
+	// duplicate, and it is the first op bob sees.
+	docStore.failing.Store(false)
+	if err := sendInsert(alice, docId, "alice", 1, []int{100}, "a"); err != nil {
+		t.Fatal(err)
+	}
+	var ack protocol.AckMessage
+	readUntilType(t, alice, protocol.TypeAck, &ack)
+	if len(ack.OpIds) != 1 || ack.OpIds[0].Counter != 1 {
+		t.Errorf("unexpected ack %+v", ack)
+	}
+	var op protocol.Operation
+	readUntilType(t, bob, protocol.TypeInsert, &op)
+	if op.OpId.Counter != 1 || op.Seq != done.Seq+1 {
+		t.Errorf("bob should get the retried op right after the sync, got counter %d seq %d (synced to %d)", op.OpId.Counter, op.Seq, done.Seq)
+	}
+}
+
+func TestIdleRoomHibernatesAndWakes(t *testing.T) {
+	docStore := store.NewMemoryStore()
+	evicted := metrics.RoomsEvictedTotal.Load()
+	woken := metrics.RoomsWokenTotal.Load()
+	server, roomManager := runTestServer(t,
+		room.WithStore(docStore),
+		room.WithSnapshotEvery(0, 0),
+		room.WithIdleTTL(50*time.Millisecond),
+	)
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "idle-doc"
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	for i, ch := range "zz" {
+		if err := sendInsert(alice, docId, "alice", i, []int{100 * (i + 1)}, string(ch)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if rooms, _ := roomManager.Stats(); rooms != 1 {
+		t.Fatalf("room should stay up while alice is in it, have %d rooms", rooms)
+	}
+	alice.Close()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if rooms, _ := roomManager.Stats(); rooms == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("empty room was not evicted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if metrics.RoomsEvictedTotal.Load() == evicted {
+		t.Error("eviction was not counted")
+	}
+	// The snapshot is taken as the room stops, right after it is evicted.
+	time.Sleep(50 * time.Millisecond)
+	snap, err := docStore.LoadSnapshot(docId)
+	if err != nil || snap == nil || snap.Version != 2 {
+		t.Fatalf("hibernating room should snapshot both ops, got %+v (%v)", snap, err)
+	}
+
+	bob, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if err := sendJoin(bob, docId, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readSyncedText(t, bob); got != "zz" {
+		t.Errorf("woken room synced %q", got)
+	}
+	if metrics.RoomsWokenTotal.Load() == woken {
+		t.Error("restored room was not counted as woken")
+	}
+}
+
+func TestLeaveReachesEveryJoinedDoc(t *testing.T) {
+	// Each of the four docs hashes to a different one of the four shards.
+	server, roomManager := runTestServer(t, room.WithShards(4))
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docs := []string{"leave-doc-a", "leave-doc-b", "leave-doc-c", "leave-doc-d"}
+
+	watchers := make([]*websocket.Conn, len(docs))
+	for i, docId := range docs {
+		w, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		if err := sendHello(w, protocol.ProtocolVersion, "presence"); err != nil {
+			t.Fatal(err)
+		}
+		if err := sendJoin(w, docId, "watcher-"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+		watchers[i] = w
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, docId := range docs {
+		if err := sendJoin(alice, docId, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, w := range watchers {
+		var joined protocol.PeerJoined
+		readUntilType(t, w, protocol.TypePeerJoined, &joined)
+		if joined.SiteId != "alice" {
+			t.Errorf("%s: unexpected peer_joined %+v", docs[i], joined)
+		}
+	}
+
+	alice.Close()
+	for i, w := range watchers {
+		var left protocol.PeerLeft
+		readUntilType(t, w, protocol.TypePeerLeft, &left)
+		if left.SiteId != "alice" {
+			t.Errorf("%s: unexpected peer_left %+v", docs[i], left)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, peers := roomManager.Stats(); peers != uint64(len(watchers)) {
+		t.Errorf("expected only the watchers left, have %d peers", peers)
+	}
+}
+
+func sendSubscription(conn *websocket.Conn, msgType, docId, siteId string) error {
+	msg, _ := json.Marshal(map[string]interface{}{"type": msgType, "docId": docId, "siteId": siteId})
+	return conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+func TestSubscriptionsOnOneConnection(t *testing.T) {
+	server, roomManager := runTestServerWithHub(t, []ws.Option{ws.WithMaxSubscriptions(2)})
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+
+	bob, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if err := sendHello(bob, protocol.ProtocolVersion, "presence"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendJoin(bob, "sub-doc-1", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendHello(alice, protocol.ProtocolVersion, "acks", "subscriptions"); err != nil {
+		t.Fatal(err)
+	}
+	var hello protocol.HelloMessage
+	readUntilType(t, alice, protocol.TypeHello, &hello)
+	for _, docId := range []string{"sub-doc-1", "sub-doc-2"} {
+		if err := sendSubscription(alice, protocol.TypeSubscribe, docId, "alice"); err != nil {
+			t.Fatal(err)
+		}
+		if docId == "sub-doc-1" {
+			// Nothing has been edited yet, so bob is asked to sync alice, with
+			// the plain join frame clients know how to answer.
+			var join protocol.JoinMessage
+			readUntilType(t, bob, protocol.TypeJoin, &join)
+			if join.DocId != docId || join.SiteId != "alice" {
+				t.Errorf("unexpected sync request %+v", join)
+			}
+			done, _ := json.Marshal(protocol.SyncDoneMessage{Type: protocol.TypeSyncDone, DocId: docId, Target: "alice"})
+			if err := bob.WriteMessage(websocket.TextMessage, done); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var done protocol.SyncDoneMessage
+		readUntilType(t, alice, protocol.TypeSyncDone, &done)
+		if done.DocId != docId {
+			t.Errorf("expected sync_done for %s, got %+v", docId, done)
+		}
+	}
+
+	if err := sendSubscription(alice, protocol.TypeSubscribe, "sub-doc-3", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var reply protocol.ErrorMessage
+	readUntilType(t, alice, protocol.TypeError, &reply)
+	if reply.Code != protocol.CodeTooManySubscriptions || reply.DocId != "sub-doc-3" {
+		t.Errorf("unexpected reply to a third subscription %+v", reply)
+	}
+	if err := sendInsert(alice, "sub-doc-3", "alice", 0, []int{100}, "x"); err != nil {
+		t.Fatal(err)
+	}
+	readUntilType(t, alice, protocol.TypeError, &reply)
+	if reply.Code != protocol.CodeTooManySubscriptions {
+		t.Errorf("an op must not subscribe past the limit either, got %+v", reply)
+	}
+
+	if err := sendSubscription(alice, protocol.TypeUnsubscribe, "sub-doc-1", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var left protocol.PeerLeft
+	readUntilType(t, bob, protocol.TypePeerLeft, &left)
+	if left.SiteId != "alice" || left.Reason != protocol.LeftUnsubscribed {
+		t.Errorf("unexpected peer_left %+v", left)
+	}
+
+	if err := sendSubscription(alice, protocol.TypeSubscribe, "sub-doc-3", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var done protocol.SyncDoneMessage
+	readUntilType(t, alice, protocol.TypeSyncDone, &done)
+	if done.DocId != "sub-doc-3" {
+		t.Errorf("expected sync_done for sub-doc-3, got %+v", done)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if rooms, peers := roomManager.Stats(); rooms != 3 || peers != 3 {
+		t.Errorf("expected bob in doc 1 and alice in docs 2 and 3, have %d rooms and %d peers", rooms, peers)
+	}
+
+	// carol didn't negotiate subscriptions, so carol's subscribe is turned away.
+	carol, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer carol.Close()
+	if err := sendHello(carol, protocol.ProtocolVersion, "acks"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendSubscription(carol, protocol.TypeSubscribe, "sub-doc-2", "carol"); err != nil {
+		t.Fatal(err)
+	}
+	readUntilType(t, carol, protocol.TypeError, &reply)
+	if reply.Code != protocol.CodeInvalidType || reply.DocId != "sub-doc-2" {
+		t.Errorf("a subscribe without the subscriptions feature should be rejected, got %+v", reply)
+	}
+	if rooms, peers := roomManager.Stats(); rooms != 3 || peers != 3 {
+		t.Errorf("carol should be in no doc, have %d rooms and %d peers", rooms, peers)
+	}
+}
+
+// syncResponder plays a peer that answers every forwarded join with one op
+// and sync_done, unless it is silent or the join comes from ignore. It joins
+// knowing its own ops up to counter known. asked counts the joins from alice
+// and aliceKnown keeps the counter the last one knew alice up to.
+type syncResponder struct {
+	known      int
+	silent     bool
+	ignore     string
+	asked      atomic.Int32
+	aliceKnown atomic.Int64
+}
+
+func (sr *syncResponder) answer(conn *websocket.Conn, siteId string) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var join protocol.JoinMessage
+		if json.Unmarshal(data, &join) != nil || join.Type != protocol.TypeJoin {
+			continue
+		}
+		if join.SiteId == "alice" {
+			sr.asked.Add(1)
+			sr.aliceKnown.Store(int64(join.Known["alice"]))
+		}
+		if sr.silent || join.SiteId == sr.ignore {
+			continue
+		}
+		done, _ := json.Marshal(protocol.SyncDoneMessage{Type: protocol.TypeSyncDone, DocId: join.DocId, Target: join.SiteId})
+		conn.WriteMessage(websocket.TextMessage, syncOpFrame(join.DocId, siteId, join.SiteId, 0))
+		conn.WriteMessage(websocket.TextMessage, done)
+	}
+}
+
+func syncOpFrame(docId, siteId, target string, counter int) []byte {
+	payload, _ := json.Marshal(insertPayload{Position: []int{100 + counter}, Value: "s"})
+	op := protocol.Operation{Type: protocol.TypeInsert, DocId: docId, SiteId: siteId,
+		OpId: protocol.OpId{Site: siteId, Counter: counter}, Payload: payload}
+	syncOp, _ := json.Marshal(protocol.SyncOpMessage{Type: protocol.TypeSyncOp, DocId: docId, Target: target, Op: op})
+	return syncOp
+}
+
+func sendJoinKnowing(conn *websocket.Conn, docId, siteId string, known map[string]int) error {
+	join, _ := json.Marshal(protocol.JoinMessage{Type: protocol.TypeJoin, DocId: docId, SiteId: siteId, Known: known})
+	return conn.WriteMessage(websocket.TextMessage, join)
+}
+
+// joinResponders connects the responders one after another as
+// responder-0, responder-1, ...
+func joinResponders(t *testing.T, wsURL, docId string, responders ...*syncResponder) {
+	t.Helper()
+	for i, sr := range responders {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		siteId := "responder-" + strconv.Itoa(i)
+		if err := sendJoinKnowing(conn, docId, siteId, map[string]int{siteId: sr.known}); err != nil {
+			t.Fatal(err)
+		}
+		go sr.answer(conn, siteId)
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestSyncFailsOverToAnotherResponder(t *testing.T) {
+	server, _ := runTestServer(t, room.WithSyncTimeout(100*time.Millisecond, 3))
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "failover-doc"
+	silent, answering := &syncResponder{silent: true}, &syncResponder{}
+	joinResponders(t, wsURL, docId, silent, answering)
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendHello(alice, protocol.ProtocolVersion, "sync_status"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var states []string
+	var synced []protocol.SyncOpMessage
+	alice.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for done := false; !done; {
+		_, data, err := alice.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for sync_done: %v", err)
+		}
+		var env protocol.Message
+		json.Unmarshal(data, &env)
+		switch env.Type {
+		case protocol.TypeSyncStatus:
+			var status protocol.SyncStatusMessage
+			json.Unmarshal(data, &status)
+			states = append(states, status.State)
+		case protocol.TypeSyncOp:
+			var msg protocol.SyncOpMessage
+			json.Unmarshal(data, &msg)
+			synced = append(synced, msg)
+		case protocol.TypeSyncDone:
+			done = true
+		}
+	}
+	if len(synced) != 1 || synced[0].Op.SiteId != "responder-1" {
+		t.Errorf("expected the answering responder's op, got %+v", synced)
+	}
+	if len(states) == 0 || states[0] != protocol.SyncRequested {
+		t.Errorf("expected a requested status first, got %v", states)
+	}
+	// Whether the silent responder was asked first is up to chance; if it
+	// was, the room must have moved on to the other one.
+	if silent.asked.Load() == 1 && (len(states) != 2 || states[1] != protocol.SyncRetrying) {
+		t.Errorf("silent responder was asked, expected a retry, got %v", states)
+	}
+	for _, s := range states {
+		if s == protocol.SyncFailed {
+			t.Errorf("sync should not fail with an answering peer, got %v", states)
+		}
+	}
+}
+
+func TestSyncGivesUpAfterSilentResponders(t *testing.T) {
+	failures := metrics.SyncFailuresTotal.Load()
+	server, _ := runTestServer(t, room.WithSyncTimeout(50*time.Millisecond, 2))
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "silent-doc"
+	responders := []*syncResponder{{silent: true}, {silent: true}, {silent: true}}
+	joinResponders(t, wsURL, docId, responders...)
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendHello(alice, protocol.ProtocolVersion, "sync_status"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var status protocol.SyncStatusMessage
+	readUntilType(t, alice, protocol.TypeSyncStatus, &status)
+	if status.State != protocol.SyncRequested || status.Attempt != 1 {
+		t.Errorf("unexpected first status %+v", status)
+	}
+	readUntilType(t, alice, protocol.TypeSyncStatus, &status)
+	if status.State != protocol.SyncRetrying || status.Attempt != 2 {
+		t.Errorf("unexpected second status %+v", status)
+	}
+	readUntilType(t, alice, protocol.TypeSyncStatus, &status)
+	if status.State != protocol.SyncFailed {
+		t.Errorf("expected sync to fail, got %+v", status)
+	}
+	var done protocol.SyncDoneMessage
+	readUntilType(t, alice, protocol.TypeSyncDone, &done)
+	if done.Target != "alice" {
+		t.Errorf("unexpected sync_done %+v", done)
+	}
+	total := int32(0)
+	for _, sr := range responders {
+		total += sr.asked.Load()
+	}
+	if total != 2 {
+		t.Errorf("expected 2 responders to be asked, got %d", total)
+	}
+	if metrics.SyncFailuresTotal.Load() == failures {
+		t.Error("failed sync was not counted")
+	}
+}
+
+// TestUnsolicitedSyncOpDropped has mallory send bob a sync_op while bob isn't
+// waiting on a sync. It answers no join, so the room drops it.
+func TestUnsolicitedSyncOpDropped(t *testing.T) {
+	server, _ := runTestServer(t)
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "unsolicited-doc"
+
+	var done protocol.SyncDoneMessage
+	conns := map[string]*websocket.Conn{}
+	for _, siteId := range []string{"bob", "mallory"} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := sendJoin(conn, docId, siteId); err != nil {
+			t.Fatal(err)
+		}
+		readUntilType(t, conn, protocol.TypeSyncDone, &done)
+		conns[siteId] = conn
+	}
+	mallory, bob := conns["mallory"], conns["bob"]
+	if err := mallory.WriteMessage(websocket.TextMessage, syncOpFrame(docId, "mallory", "bob", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendInsert(mallory, docId, "mallory", 1, []int{200}, "m"); err != nil {
+		t.Fatal(err)
+	}
+	bob.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		var msg protocol.Message
+		if err := bob.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == protocol.TypeSyncOp {
+			t.Fatal("bob got a sync_op answering no join")
+		}
+		if msg.Type == protocol.TypeInsert {
+			break
+		}
+	}
+}
+
+func TestSyncResponderSelection(t *testing.T) {
+	server, _ := runTestServer(t, room.WithSyncTimeout(5*time.Second, 3))
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "selection-doc"
+	// eve holds the most ops but nobody answers her join, so she is still
+	// syncing when alice arrives. Of the rest carol holds the most.
+	bob, dave, carol := &syncResponder{known: 100}, &syncResponder{known: 300}, &syncResponder{known: 500, ignore: "responder-3"}
+	eve := &syncResponder{known: 900}
+	joinResponders(t, wsURL, docId, bob, dave, carol, eve)
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendJoinKnowing(alice, docId, "alice", map[string]int{"alice": 42}); err != nil {
+		t.Fatal(err)
+	}
+	var done protocol.SyncDoneMessage
+	readUntilType(t, alice, protocol.TypeSyncDone, &done)
+	for name, sr := range map[string]*syncResponder{"bob": bob, "dave": dave, "eve": eve} {
+		if n := sr.asked.Load(); n != 0 {
+			t.Errorf("%s was asked %d times", name, n)
+		}
+	}
+	if carol.asked.Load() != 1 {
+		t.Fatalf("carol should have answered alice, was asked %d times", carol.asked.Load())
+	}
+	if got := carol.aliceKnown.Load(); got != 42 {
+		t.Errorf("responder got alice known up to %d, want 42", got)
+	}
+}
+
+// readResync reads a sync to its sync_done and returns the seqs of the synced
+// ops, their text and the sync_done.
+func readResync(t *testing.T, conn *websocket.Conn) ([]uint64, string, protocol.SyncDoneMessage) {
+	t.Helper()
+	var seqs []uint64
+	var text strings.Builder
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for sync: %v", err)
+		}
+		var msg struct {
+			protocol.SyncOpMessage
+			Seq   uint64 `json:"seq"`
+			Epoch string `json:"epoch"`
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == protocol.TypeSyncDone {
+			return seqs, text.String(), protocol.SyncDoneMessage{Type: msg.Type, DocId: msg.DocId, Target: msg.Target, Seq: msg.Seq, Epoch: msg.Epoch}
+		}
+		if msg.Type != protocol.TypeSyncOp {
+			continue
+		}
+		p, err := msg.Op.InsertPayload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, msg.Op.Seq)
+		text.WriteString(p.Value)
+	}
+}
+
+func sendJoinAfter(conn *websocket.Conn, docId, siteId, epoch string, lastSeq uint64) error {
+	join, _ := json.Marshal(protocol.JoinMessage{Type: protocol.TypeJoin, DocId: docId, SiteId: siteId, Epoch: epoch, LastSeq: lastSeq})
+	return conn.WriteMessage(websocket.TextMessage, join)
+}
+
+func TestResumeFromLastSeq(t *testing.T) {
+	server, _ := runTestServer(t, room.WithResumeBuffer(4))
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "resume-doc"
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	_, _, first := readResync(t, alice)
+	if first.Epoch == "" {
+		t.Fatal("sync_done should carry the room's epoch")
+	}
+	base, epoch := first.Seq, first.Epoch
+	for i, v := range []string{"a", "b"} {
+		if err := sendInsert(alice, docId, "alice", i, []int{100 * (i + 1)}, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	join := func(siteId, epoch string, lastSeq uint64) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sendJoinAfter(conn, docId, siteId, epoch, lastSeq); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	bob := join("bob", "", 0)
+	_, text, done := readResync(t, bob)
+	if seq := done.Seq; text != "ab" || seq != base+2 || done.Epoch != epoch {
+		t.Fatalf("full sync should bring bob to seq %d, got %q at %d", base+2, text, seq)
+	}
+	bob.Close()
+
+	for i, v := range []string{"c", "d", "e"} {
+		if err := sendInsert(alice, docId, "alice", i+2, []int{300 + 100*i}, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	resumes, misses := metrics.ResumesTotal.Load(), metrics.ResumeMissesTotal.Load()
+	bob = join("bob", epoch, done.Seq)
+	defer bob.Close()
+	seqs, text, done := readResync(t, bob)
+	if seq := done.Seq; text != "cde" || len(seqs) != 3 || seqs[0] != base+3 || seqs[2] != base+5 || seq != base+5 {
+		t.Errorf("bob should get only the ops after his lastSeq, got %q with seqs %v, done at %d", text, seqs, seq)
+	}
+	if metrics.ResumesTotal.Load() == resumes {
+		t.Error("resumes_total should count the rejoin")
+	}
+
+	if err := sendInsert(alice, docId, "alice", 5, []int{600}, "f"); err != nil {
+		t.Fatal(err)
+	}
+	var live protocol.Operation
+	readUntilType(t, bob, protocol.TypeInsert, &live)
+	if live.Seq != base+6 {
+		t.Errorf("relayed op should carry seq %d, got %d", base+6, live.Seq)
+	}
+
+	// Only the last 4 ops are kept, a seq the room never handed out can't be
+	// trusted, and neither can one from another epoch, even if the room's own
+	// seqs have got that far: all get the whole doc.
+	for _, resume := range []struct {
+		epoch   string
+		lastSeq uint64
+	}{{epoch, base + 1}, {epoch, base + 100}, {"other", base + 5}} {
+		carol := join("carol", resume.epoch, resume.lastSeq)
+		_, text, done := readResync(t, carol)
+		carol.Close()
+		if text != "abcdef" || done.Seq != base+6 {
+			t.Errorf("lastSeq %d of epoch %q should fall back to a full sync, got %q at %d", resume.lastSeq-base, resume.epoch, text, done.Seq)
+		}
+	}
+	if metrics.ResumeMissesTotal.Load() < misses+3 {
+		t.Error("resume_misses_total should count every fallback")
+	}
+}
+
+// TestResumeAcrossRoomRestart lets a room hibernate and come back. Without a
+// store the new room starts a new epoch, so a lastSeq from the old one is a
+// miss even where the new room's seqs overlap it. With a store the epoch and
+// the seqs carry on, and a resume in that epoch works.
+func TestResumeAcrossRoomRestart(t *testing.T) {
+	for _, stored := range []bool{false, true} {
+		opts := []room.Option{room.WithIdleTTL(50 * time.Millisecond), room.WithResumeBuffer(16)}
+		if stored {
+			opts = append(opts, room.WithStore(store.NewMemoryStore()), room.WithSnapshotEvery(0, 0))
+		}
+		server, roomManager := runTestServer(t, opts...)
+		wsURL := "ws" + server.URL[4:] + "/ws"
+		docId := "restart-doc"
+		join := func(siteId, epoch string, lastSeq uint64) *websocket.Conn {
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sendJoinAfter(conn, docId, siteId, epoch, lastSeq); err != nil {
+				t.Fatal(err)
+			}
+			return conn
+		}
+		hibernate := func() {
+			deadline := time.Now().Add(3 * time.Second)
+			for rooms, _ := roomManager.Stats(); rooms != 0; rooms, _ = roomManager.Stats() {
+				if time.Now().After(deadline) {
+					t.Fatal("empty room was not evicted")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		alice := join("alice", "", 0)
+		_, _, first := readResync(t, alice)
+		for i, v := range []string{"a", "b"} {
+			if err := sendInsert(alice, docId, "alice", i, []int{100 * (i + 1)}, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		alice.Close()
+		hibernate()
+
+		bob := join("bob", "", 0)
+		_, _, done := readResync(t, bob)
+		if stored != (done.Epoch == first.Epoch) {
+			t.Errorf("stored %v: epoch went from %q to %q", stored, first.Epoch, done.Epoch)
+		}
+		for i, v := range []string{"x", "y", "z"} {
+			if err := sendInsert(bob, docId, "bob", i, []int{1000 + i}, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		// Without a store, seq 1 of the new room is x, so taking alice's
+		// lastSeq for one of its own would skip it.
+		lastSeq := first.Seq + 1
+		if stored {
+			lastSeq = done.Seq
+		}
+		resumes := metrics.ResumesTotal.Load()
+		carol := join("carol", first.Epoch, lastSeq)
+		_, text, _ := readResync(t, carol)
+		if text != "xyz" || stored != (metrics.ResumesTotal.Load() > resumes) {
+			t.Errorf("stored %v: join from alice's epoch got %q, resumed %v", stored, text, metrics.ResumesTotal.Load() > resumes)
+		}
+		carol.Close()
+		bob.Close()
+		server.Close()
+	}
+}
+
+// TestResumeReplaysBeforeLiveOps resumes bob from further back than his queue
+// holds while alice keeps typing. Every op he missed has to reach him, in
+// order, before sync_done and before any of alice's new ops.
+func TestResumeReplaysBeforeLiveOps(t *testing.T) {
+	const missed, live = 3000, 50
+	server, _ := runTestServerWithHub(t, []ws.Option{ws.WithConnLimits(ws.Limits{})}, room.WithResumeBuffer(missed))
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "replay-doc"
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendHello(alice, protocol.ProtocolVersion, "acks", "presence"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	_, _, first := readResync(t, alice)
+	base := first.Seq
+	// Big enough values that the replay can't all sit in socket buffers.
+	// Alice waits for her acks every so often so as not to overrun the room's
+	// queue, which would cost her the connection.
+	value := strings.Repeat("x", 4096)
+	const window = 500
+	for i := 0; i < missed; i++ {
+		if err := sendInsert(alice, docId, "alice", i, []int{i + 1}, value); err != nil {
+			t.Fatal(err)
+		}
+		if (i+1)%window != 0 && i != missed-1 {
+			continue
+		}
+		for {
+			var ack protocol.AckMessage
+			readUntilType(t, alice, protocol.TypeAck, &ack)
+			if ack.OpIds[len(ack.OpIds)-1].Counter == i {
+				break
+			}
+		}
+	}
+
+	bob, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if err := sendJoinAfter(bob, docId, "bob", first.Epoch, base); err != nil {
+		t.Fatal(err)
+	}
+	var joined protocol.PeerJoined
+	readUntilType(t, alice, protocol.TypePeerJoined, &joined)
+	for i := missed; i < missed+live; i++ {
+		if err := sendInsert(alice, docId, "alice", i, []int{i + 1}, "x"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Let bob's queue fill up before he starts reading.
+	time.Sleep(200 * time.Millisecond)
+
+	last, synced, relayed := base, 0, 0
+	bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for relayed < live {
+		_, data, err := bob.ReadMessage()
+		if err != nil {
+			t.Fatalf("after %d synced and %d live ops: %v", synced, relayed, err)
+		}
+		var msg struct {
+			protocol.SyncOpMessage
+			Seq uint64 `json:"seq"`
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		seq := msg.Seq
+		switch msg.Type {
+		case protocol.TypeSyncOp:
+			seq = msg.Op.Seq
+			synced++
+		case protocol.TypeInsert:
+			if synced != missed {
+				t.Fatalf("live op %d arrived after only %d of the %d synced ops", seq, synced, missed)
+			}
+			relayed++
+		case protocol.TypeSyncDone:
+			if synced != missed || seq != base+missed {
+				t.Fatalf("sync_done at %d after %d ops, want %d after %d", seq, synced, base+missed, missed)
+			}
+			continue
+		default:
+			continue
+		}
+		if seq != last+1 {
+			t.Fatalf("got seq %d after %d", seq, last)
+		}
+		last = seq
+	}
+}
+
+// countingConn counts the frames read, as a client keeping a session would.
+type countingConn struct {
+	*websocket.Conn
+	received uint64
+}
+
+func (c *countingConn) next(t *testing.T) map[string]interface{} {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var msg map[string]interface{}
+	if err := c.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg["type"] != protocol.TypeHello || msg["resumed"] != true {
+		c.received++
+	}
+	return msg
+}
+
+func (c *countingConn) nextOf(t *testing.T, msgType string) map[string]interface{} {
+	t.Helper()
+	for {
+		if msg := c.next(t); msg["type"] == msgType {
+			return msg
+		}
+	}
+}
+
+func dialSession(t *testing.T, wsURL, token string, received uint64) *countingConn {
+	t.Helper()
+	if token != "" {
+		wsURL += "?session=" + token + "&received=" + strconv.FormatUint(received, 10)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendHello(conn, protocol.ProtocolVersion, "sessions"); err != nil {
+		t.Fatal(err)
+	}
+	return &countingConn{Conn: conn}
+}
+
+func TestSessionResume(t *testing.T) {
+	server, roomManager := runTestServerWithHub(t, []ws.Option{ws.WithSessionGrace(400 * time.Millisecond)})
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "session-doc"
+
+	bob := dialSession(t, wsURL, "", 0)
+	hello := bob.nextOf(t, protocol.TypeHello)
+	token, _ := hello["session"].(string)
+	if token == "" {
+		t.Fatalf("hello should carry a session token, got %v", hello)
+	}
+	if err := sendJoin(bob.Conn, docId, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	bob.nextOf(t, protocol.TypeSyncDone)
+	if err := sendInsert(bob.Conn, docId, "bob", 0, []int{100}, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendHello(alice, protocol.ProtocolVersion, "presence"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if text := readSyncedText(t, alice); text != "a" {
+		t.Fatalf("alice should sync bob's insert, got %q", text)
+	}
+	if err := sendInsert(alice, docId, "alice", 0, []int{200}, "x"); err != nil {
+		t.Fatal(err)
+	}
+	bob.nextOf(t, protocol.TypeInsert)
+
+	suspended := metrics.SessionsSuspended.Load()
+	bob.Close()
+	time.Sleep(100 * time.Millisecond)
+	if metrics.SessionsSuspended.Load() == suspended {
+		t.Error("closing the socket should suspend bob's session")
+	}
+	if _, peers := roomManager.Stats(); peers != 2 {
+		t.Errorf("a suspended session should stay in its room, got %d peers", peers)
+	}
+	for i, v := range []string{"y", "z"} {
+		if err := sendInsert(alice, docId, "alice", i+1, []int{300 + 100*i}, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// Pretend the insert of x never arrived: it is sent again with what bob
+	// missed while he was away.
+	bob = dialSession(t, wsURL, token, bob.received-1)
+	defer bob.Close()
+	hello = bob.next(t)
+	if hello["type"] != protocol.TypeHello || hello["resumed"] != true || hello["session"] != token {
+		t.Fatalf("a resumed socket should start with a resumed hello, got %v", hello)
+	}
+	var got []string
+	for len(got) < 3 {
+		msg := bob.nextOf(t, protocol.TypeInsert)
+		payload, _ := msg["payload"].(map[string]interface{})
+		got = append(got, payload["value"].(string))
+	}
+	if strings.Join(got, "") != "xyz" {
+		t.Errorf("resumed session should pick up where it left off, got %v", got)
+	}
+	if err := sendInsert(bob.Conn, docId, "bob", 1, []int{600}, "b"); err != nil {
+		t.Fatal(err)
+	}
+	var op protocol.Operation
+	readUntilType(t, alice, protocol.TypeInsert, &op)
+	if op.SiteId != "bob" {
+		t.Errorf("bob's ops should still reach alice, got %+v", op)
+	}
+
+	// The server may not have noticed the old socket is dead yet; the new one
+	// takes over anyway.
+	stale := bob
+	bob = dialSession(t, wsURL, token, stale.received)
+	defer bob.Close()
+	if hello = bob.next(t); hello["resumed"] != true {
+		t.Fatalf("taking over a live session should resume it, got %v", hello)
+	}
+	stale.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		if _, _, err := stale.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if err := sendInsert(alice, docId, "alice", 3, []int{700}, "w"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := bob.nextOf(t, protocol.TypeInsert); msg["siteId"] != "alice" {
+		t.Errorf("unexpected insert after takeover %v", msg)
+	}
+
+	carol := dialSession(t, wsURL, "", 0)
+	hello = carol.nextOf(t, protocol.TypeHello)
+	carolToken, _ := hello["session"].(string)
+	if err := sendJoin(carol.Conn, docId, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	carol.nextOf(t, protocol.TypeSyncDone)
+	expired := metrics.SessionsExpired.Load()
+	carol.Close()
+	var left protocol.PeerLeft
+	readUntilType(t, alice, protocol.TypePeerLeft, &left)
+	if left.SiteId != "carol" || metrics.SessionsExpired.Load() == expired {
+		t.Errorf("carol should leave once her session expires, got %+v", left)
+	}
+	carol = dialSession(t, wsURL, carolToken, carol.received)
+	defer carol.Close()
+	hello = carol.next(t)
+	if hello["resumed"] == true || hello["session"] == carolToken {
+		t.Errorf("an expired session should get a new connection, got %v", hello)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	server, _ := runTestServerWithHub(t, []ws.Option{ws.WithConnLimits(ws.Limits{OpsPerSecond: 20})})
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "limited-doc"
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendHello(alice, protocol.ProtocolVersion, "acks"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var done protocol.SyncDoneMessage
+	readUntilType(t, alice, protocol.TypeSyncDone, &done)
+	throttled := metrics.ThrottledMessages.Load()
+	for i := 0; i < 60; i++ {
+		if err := sendInsert(alice, docId, "alice", i, []int{100 + i}, "x"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var acked, limited int
+	alice.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for acked+limited < 60 {
+		var msg protocol.ErrorMessage
+		if err := alice.ReadJSON(&msg); err != nil {
+			t.Fatalf("after %d acks and %d errors: %v", acked, limited, err)
+		}
+		switch {
+		case msg.Type == protocol.TypeAck:
+			acked++
+		case msg.Type == protocol.TypeError && msg.Code == protocol.CodeRateLimited && msg.OpId != nil:
+			limited++
+		}
+	}
+	if acked < 20 || limited < 30 {
+		t.Errorf("expected the burst through and the rest throttled, got %d acks and %d errors", acked, limited)
+	}
+	if metrics.ThrottledMessages.Load()-throttled < uint64(limited) {
+		t.Error("throttled_messages_total should count every throttled op")
+	}
+
+	eve, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eve.Close()
+	for i := 0; i < 200; i++ {
+		if err := sendInsert(eve, docId, "eve", i, []int{1000 + i}, "!"); err != nil {
+			break
+		}
+	}
+	eve.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		_, _, err := eve.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, protocol.CloseRateLimited) {
+			t.Errorf("a flooding connection should be closed with %d, got %v", protocol.CloseRateLimited, err)
+		}
+		break
+	}
+
+	// sync_op frames spend ops like any other, so they can't be used to
+	// flood the room past the limits either.
+	trudy, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trudy.Close()
+	if err := sendHello(trudy, protocol.ProtocolVersion, "acks"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 60; i++ {
+		if err := trudy.WriteMessage(websocket.TextMessage, syncOpFrame(docId, "trudy", "alice", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var reply protocol.ErrorMessage
+	readUntilType(t, trudy, protocol.TypeError, &reply)
+	if reply.Code != protocol.CodeRateLimited {
+		t.Errorf("a flood of sync_op frames should be throttled, got %+v", reply)
+	}
+
+	ipServer, _ := runTestServerWithHub(t, []ws.Option{ws.WithIPLimits(ws.Limits{JoinsPerMinute: 2})})
+	defer ipServer.Close()
+	ipURL := "ws" + ipServer.URL[4:] + "/ws"
+	for i := 0; i < 3; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(ipURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := sendHello(conn, protocol.ProtocolVersion, "acks"); err != nil {
+			t.Fatal(err)
+		}
+		docId := "ip-doc-" + strconv.Itoa(i)
+		if err := sendJoin(conn, docId, "site-"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+		if i < 2 {
+			readUntilType(t, conn, protocol.TypeSyncDone, &done)
+			continue
+		}
+		var reply protocol.ErrorMessage
+		readUntilType(t, conn, protocol.TypeError, &reply)
+		if reply.Code != protocol.CodeRateLimited || reply.DocId != docId {
+			t.Errorf("a third join from the same address should be throttled, got %+v", reply)
+		}
+	}
+
+	// Site limits go by the site mallory joined as, so claiming a new site
+	// in every op doesn't get her a fresh bucket each time.
+	siteServer, _ := runTestServerWithHub(t, []ws.Option{ws.WithSiteLimits(ws.Limits{OpsPerSecond: 10})})
+	defer siteServer.Close()
+	mallory, _, err := websocket.DefaultDialer.Dial("ws"+siteServer.URL[4:]+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mallory.Close()
+	if err := sendHello(mallory, protocol.ProtocolVersion, "acks"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendJoin(mallory, docId, "mallory"); err != nil {
+		t.Fatal(err)
+	}
+	readUntilType(t, mallory, protocol.TypeSyncDone, &done)
+	for i := 0; i < 30; i++ {
+		site := "mallory-" + strconv.Itoa(i)
+		if err := sendInsert(mallory, docId, site, 0, []int{100 + i}, "m"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		var reply protocol.ErrorMessage
+		readUntilType(t, mallory, protocol.TypeError, &reply)
+		if reply.Code == protocol.CodeRateLimited {
+			break
+		}
+	}
+}
+
+func TestRoomCapacity(t *testing.T) {
+	server, _ := runTestServerWithHub(t, nil, room.WithMaxPeers(2, 1))
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "capped-doc"
+
+	join := func(siteId string, features ...string) *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if err := sendHello(conn, protocol.ProtocolVersion, features...); err != nil {
+			t.Fatal(err)
+		}
+		if err := sendJoin(conn, docId, siteId); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	var done protocol.SyncDoneMessage
+	alice := join("alice", "acks")
+	readUntilType(t, alice, protocol.TypeSyncDone, &done)
+	bob := join("bob", "acks")
+	readUntilType(t, bob, protocol.TypeSyncDone, &done)
+
+	var refused protocol.ErrorMessage
+	carol := join("carol", "acks")
+	readUntilType(t, carol, protocol.TypeError, &refused)
+	if refused.Code != protocol.CodeRoomFull || refused.DocId != docId {
+		t.Errorf("a third peer should be refused, got %+v", refused)
+	}
+
+	dave := join("dave", "acks", "observe", "presence")
+	readUntilType(t, dave, protocol.TypeSyncDone, &done)
+	if err := sendInsert(alice, docId, "alice", 1, []int{1}, "a"); err != nil {
+		t.Fatal(err)
+	}
+	var op protocol.Operation
+	readUntilType(t, dave, protocol.TypeInsert, &op)
+	if op.SiteId != "alice" {
+		t.Errorf("observer should get alice's insert, got %+v", op)
+	}
+	if err := sendInsert(dave, docId, "dave", 1, []int{2}, "d"); err != nil {
+		t.Fatal(err)
+	}
+	readUntilType(t, dave, protocol.TypeError, &refused)
+	if refused.Code != protocol.CodeRoomFull || refused.OpId == nil || refused.OpId.Site != "dave" {
+		t.Errorf("an observer's insert should be answered with room_full, got %+v", refused)
+	}
+	if err := sendInsert(alice, docId, "alice", 2, []int{3}, "b"); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		readUntilType(t, bob, protocol.TypeInsert, &op)
+		if op.SiteId == "dave" {
+			t.Fatal("an observer's insert was relayed")
+		}
+		if op.OpId.Counter == 2 {
+			break
+		}
+	}
+
+	eve := join("eve", "acks", "observe")
+	readUntilType(t, eve, protocol.TypeError, &refused)
+	if refused.Code != protocol.CodeRoomFull {
+		t.Errorf("observers past the cap should be refused, got %+v", refused)
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL+"?doc="+docId, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("upgrading into a full doc should get 503, got %v", err)
+	}
+	if metrics.JoinsRefused.Load() < 2 || metrics.ObserverJoins.Load() < 1 {
+		t.Error("joins_refused_total and observer_joins_total should count refusals and observers")
+	}
+
+	capped, _ := runTestServerWithHub(t, []ws.Option{ws.WithMaxConns(1)})
+	defer capped.Close()
+	cappedURL := "ws" + capped.URL[4:] + "/ws"
+	first, _, err := websocket.DefaultDialer.Dial(cappedURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if err := sendHello(first, protocol.ProtocolVersion); err != nil {
+		t.Fatal(err)
+	}
+	var hello protocol.HelloMessage
+	readUntilType(t, first, protocol.TypeHello, &hello)
+	refusedBefore := metrics.ConnectionsRefused.Load()
+	_, resp, err = websocket.DefaultDialer.Dial(cappedURL, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("a connection past MAX_CONNS should get 503, got %v", err)
+	}
+	if metrics.ConnectionsRefused.Load() == refusedBefore {
+		t.Error("connections_refused_total should count the refusal")
+	}
+}
+
+func TestRefusedJoinFreesSubscription(t *testing.T) {
+	server, _ := runTestServerWithHub(t, []ws.Option{ws.WithMaxSubscriptions(1)}, room.WithMaxPeers(1, 0))
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendJoin(alice, "full-doc", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var done protocol.SyncDoneMessage
+	readUntilType(t, alice, protocol.TypeSyncDone, &done)
+
+	carol, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer carol.Close()
+	if err := sendHello(carol, protocol.ProtocolVersion, "acks"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendJoin(carol, "full-doc", "carol"); err != nil {
+		t.Fatal(err)
+	}
+	var refused protocol.ErrorMessage
+	readUntilType(t, carol, protocol.TypeError, &refused)
+	if refused.Code != protocol.CodeRoomFull {
+		t.Fatalf("carol should be refused, got %+v", refused)
+	}
+	time.Sleep(50 * time.Millisecond)
+	// The doc that turned carol away doesn't take up her only subscription.
+	if err := sendJoin(carol, "open-doc", "carol"); err != nil {
+		t.Fatal(err)
+	}
+	carol.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		var msg protocol.ErrorMessage
+		if err := carol.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == protocol.TypeError {
+			t.Fatalf("joining another doc after a refusal got %+v", msg)
+		}
+		if msg.Type == protocol.TypeSyncDone {
+			break
+		}
+	}
+}
+
+// TestSlowConsumerResync has bob stop reading while alice types. He only
+// stalls until his send queue is full, which the tight buffers make a matter
+// of a few hundred KB, so he starts reading again well within the server's
+// write timeout and has to converge without being disconnected.
+func TestSlowConsumerResync(t *testing.T) {
+	server, _ := runTightServer(t)
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "slow-doc"
+
+	bob, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if err := sendJoin(bob, docId, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	var done protocol.SyncDoneMessage
+	readUntilType(t, bob, protocol.TypeSyncDone, &done)
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	lagged, resyncs := metrics.SlowConsumers.Load(), metrics.SlowConsumerResyncs.Load()
+	// 8 MB is many times what bob's socket buffers and send queue hold
+	// together. alice types in the background so bob reads again as soon as
+	// he has fallen behind.
+	const batches, perBatch = 10, 100
+	value := strings.Repeat("x", 8<<10)
+	typed := make(chan error, 1)
+	go func() {
+		for b := 0; b < batches; b++ {
+			ops := make([]map[string]interface{}, perBatch)
+			for i := range ops {
+				n := b*perBatch + i + 1
+				ops[i] = map[string]interface{}{
+					"type":    "insert",
+					"opId":    map[string]interface{}{"site": "alice", "counter": n},
+					"payload": insertPayload{Position: []int{n}, Value: value},
+				}
+			}
+			batch, _ := json.Marshal(map[string]interface{}{"type": "batch", "docId": docId, "siteId": "alice", "ops": ops})
+			if err := alice.WriteMessage(websocket.TextMessage, batch); err != nil {
+				typed <- err
+				return
+			}
+		}
+		typed <- nil
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for metrics.SlowConsumers.Load() == lagged {
+		if time.Now().After(deadline) {
+			t.Fatal("bob never fell behind")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	seen := make(map[int]bool)
+	bob.SetReadDeadline(time.Now().Add(20 * time.Second))
+	for len(seen) < batches*perBatch {
+		_, data, err := bob.ReadMessage()
+		if err != nil {
+			t.Fatalf("with %d of %d ops: %v", len(seen), batches*perBatch, err)
+		}
+		var msg struct {
+			protocol.Operation
+			Op *protocol.Operation `json:"op"`
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		switch msg.Type {
+		case protocol.TypeInsert:
+			seen[msg.OpId.Counter] = true
+		case protocol.TypeSyncOp:
+			seen[msg.Op.OpId.Counter] = true
+		}
+	}
+	if err := <-typed; err != nil {
+		t.Fatal(err)
+	}
+	if metrics.SlowConsumerResyncs.Load() == resyncs {
+		t.Error("slow_consumer_resyncs_total should count bob's catch-up")
+	}
+}
+
+// TestLaggingJoinerIsSyncedAgain has bob answer alice's join with more than
+// she can take while she isn't reading. The frames she missed can't be caught
+// up from the room's seqs, so once she has caught up bob is asked again, and
+// she hears sync_done only after she has had every op. The answer is a few MB,
+// so she stalls for much less than the server's write timeout.
+func TestLaggingJoinerIsSyncedAgain(t *testing.T) {
+	server, _ := runTightServer(t, room.WithSyncTimeout(5*time.Second, 3))
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "lagging-joiner-doc"
+	const ops = 500
+	value := strings.Repeat("x", 8<<10)
+
+	bob, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if err := sendJoin(bob, docId, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	var done protocol.SyncDoneMessage
+	readUntilType(t, bob, protocol.TypeSyncDone, &done)
+	bob.SetReadDeadline(time.Time{})
+	var asked atomic.Int32
+	answered := make(chan struct{}, 1)
+	go func() {
+		for {
+			_, data, err := bob.ReadMessage()
+			if err != nil {
+				return
+			}
+			var join protocol.JoinMessage
+			if json.Unmarshal(data, &join) != nil || join.Type != protocol.TypeJoin {
+				continue
+			}
+			again := asked.Add(1) > 1
+			for c := 0; c < ops; c++ {
+				if again {
+					// Paced, so alice's short queue keeps up with it.
+					time.Sleep(time.Millisecond)
+				}
+				payload, _ := json.Marshal(insertPayload{Position: []int{c + 1}, Value: value})
+				op := protocol.Operation{Type: protocol.TypeInsert, DocId: docId, SiteId: "bob",
+					OpId: protocol.OpId{Site: "bob", Counter: c}, Payload: payload}
+				syncOp, _ := json.Marshal(protocol.SyncOpMessage{Type: protocol.TypeSyncOp, DocId: docId, Target: "alice", Op: op})
+				if bob.WriteMessage(websocket.TextMessage, syncOp) != nil {
+					return
+				}
+			}
+			done, _ := json.Marshal(protocol.SyncDoneMessage{Type: protocol.TypeSyncDone, DocId: docId, Target: "alice"})
+			bob.WriteMessage(websocket.TextMessage, done)
+			select {
+			case answered <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	lagged := metrics.SlowConsumers.Load()
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-answered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("bob never got through his answer")
+	}
+	deadline := time.Now().Add(time.Second)
+	for metrics.SlowConsumers.Load() == lagged {
+		if time.Now().After(deadline) {
+			t.Fatal("alice never fell behind")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	seen := make(map[int]bool)
+	alice.SetReadDeadline(time.Now().Add(20 * time.Second))
+	for {
+		_, data, err := alice.ReadMessage()
+		if err != nil {
+			t.Fatalf("with %d of %d ops: %v", len(seen), ops, err)
+		}
+		var msg protocol.SyncOpMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == protocol.TypeSyncOp {
+			seen[msg.Op.OpId.Counter] = true
+		}
+		if msg.Type == protocol.TypeSyncDone {
+			break
+		}
+	}
+	if len(seen) != ops {
+		t.Errorf("sync_done came after %d of %d ops", len(seen), ops)
+	}
+	if n := asked.Load(); n != 2 {
+		t.Errorf("bob should be asked again once alice caught up, was asked %d times", n)
+	}
+}
+
+// stallingStore holds up every room that loads a snapshot until released,
+// so the room's command queue fills.
+type stallingStore struct {
+	*store.MemoryStore
+	release chan struct{}
+	// doc, if set, is the only doc held up.
+	doc string
+}
+
+func (s *stallingStore) LoadSnapshot(docId string) (*store.Snapshot, error) {
+	if s.doc == "" || docId == s.doc {
+		<-s.release
+	}
+	return s.MemoryStore.LoadSnapshot(docId)
+}
+
+func TestRoomQueueOverflowDropsSender(t *testing.T) {
+	stalled := &stallingStore{MemoryStore: store.NewMemoryStore(), release: make(chan struct{})}
+	server, roomManager := runTestServerWithHub(t, []ws.Option{ws.WithConnLimits(ws.Limits{})}, room.WithStore(stalled), room.WithIdleTTL(50*time.Millisecond))
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+	docId := "stuck-doc"
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendJoin(alice, docId, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	drops := metrics.RoomCommandDrops.Load()
+	for i := 1; i <= 1500; i++ {
+		if err := sendInsert(alice, docId, "alice", i, []int{i}, "a"); err != nil {
+			break
+		}
+	}
+	alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := alice.ReadMessage(); err != nil {
+			var netErr interface{ Timeout() bool }
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				t.Fatal("the sender of ops that didn't fit in the room's queue should be dropped")
+			}
+			break
+		}
+	}
+	if metrics.RoomCommandDrops.Load() == drops {
+		t.Error("room_command_drops_total should count the dropped ops")
+	}
+
+	close(stalled.release)
+	bob, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if err := sendJoin(bob, docId, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	var done protocol.SyncDoneMessage
+	readUntilType(t, bob, protocol.TypeSyncDone, &done)
+
+	// The joins dropped along with alice's ops don't keep the room up once
+	// everyone has left.
+	bob.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if rooms, _ := roomManager.Stats(); rooms == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("room should hibernate once its last peer has left")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestStuckRoomDropsSenderAtOnce checks the shard doesn't wait on a full room
+// queue: the op that doesn't fit costs alice her connection straight away,
+// and bob, on another doc of the same shard, is served meanwhile.
+func TestStuckRoomDropsSenderAtOnce(t *testing.T) {
+	stalled := &stallingStore{MemoryStore: store.NewMemoryStore(), release: make(chan struct{}), doc: "stuck-doc"}
+	defer close(stalled.release)
+	server, _ := runTestServerWithHub(t, []ws.Option{ws.WithConnLimits(ws.Limits{})}, room.WithStore(stalled), room.WithShards(1))
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if err := sendJoin(alice, "stuck-doc", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 1; i <= 1500; i++ {
+		if err := sendInsert(alice, "stuck-doc", "alice", i, []int{i}, "a"); err != nil {
+			break
+		}
+	}
+	if err := sendJoin(bob, "other-doc", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	var done protocol.SyncDoneMessage
+	readUntilType(t, bob, protocol.TypeSyncDone, &done)
+	alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := alice.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("alice was dropped after %v; the shard shouldn't wait for room in a stuck queue", elapsed)
+	}
+}
+
+func TestDropsDuringChurn(t *testing.T) {
+	server, roomManager := runTestServer(t)
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+
+	const clients = 40
+	const rounds = 5
+	stop := make(chan struct{})
+	var dropping sync.WaitGroup
+	for d := 0; d < 4; d++ {
+		dropping.Add(1)
+		go func(d int) {
+			defer dropping.Done()
+			for id := uint64(d + 1); ; id += 3 {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				roomManager.Drop(id % (clients * rounds))
+				time.Sleep(time.Millisecond)
+			}
+		}(d)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			siteId := "site-" + strconv.Itoa(i)
+			for round := 0; round < rounds; round++ {
+				conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+				if err != nil {
+					continue
+				}
+				for d := 0; d < 3; d++ {
+					docId := "churn-" + strconv.Itoa((i+d)%8)
+					if err := sendJoin(conn, docId, siteId); err != nil {
+						break
+					}
+					for n := 1; n <= 20; n++ {
+						if err := sendInsert(conn, docId, siteId, round*100+n, []int{n}, "x"); err != nil {
+							break
+						}
+					}
+				}
+				conn.Close()
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	dropping.Wait()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, peers := roomManager.Stats()
+		if peers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d peers still joined after every connection closed", peers)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestLeaveDoesNotWaitOnStuckRoom(t *testing.T) {
+	stalled := &stallingStore{MemoryStore: store.NewMemoryStore(), release: make(chan struct{}), doc: "stuck-doc"}
+	server, roomManager := runTestServerWithHub(t, []ws.Option{ws.WithConnLimits(ws.Limits{})}, room.WithStore(stalled), room.WithShards(1))
+	defer server.Close()
+	wsURL := "ws" + server.URL[4:] + "/ws"
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := sendJoin(alice, "stuck-doc", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 1500; i++ {
+		if err := sendInsert(alice, "stuck-doc", "alice", i, []int{i}, "a"); err != nil {
+			break
+		}
+	}
+	alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := alice.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	// Alice's leave can't get into the stuck room's queue, which mustn't hold
+	// up the other docs on its shard.
+	bob, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendJoin(bob, "other-doc", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	var done protocol.SyncDoneMessage
+	readUntilType(t, bob, protocol.TypeSyncDone, &done)
+	bob.Close()
+
+	close(stalled.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, peers := roomManager.Stats(); peers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("alice should leave the stuck room once it catches up")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -7,7 +7,6 @@ export type NetworkConfig = {
   url: string;
   docId: string;
   siteId: string;
-  knownClock?: number;
   onOp?: (op: Operation) => void;
   onSyncComplete?: () => void;
   onJoinRequest?: (join: JoinMessage) => void;
@@ -57,8 +56,9 @@ export class CollabNetwork {
       type: "join",
       docId: this.config.docId,
       siteId: this.config.siteId,
-      knownClock: this.config.knownClock ?? 0,
     };
+    const known = this.log.known();
+    if (Object.keys(known).length > 0) msg.known = known;
     this.ws.send(JSON.stringify(msg));
   }
 
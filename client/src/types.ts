@@ -1,34 +1,37 @@
-export type OpId = { site: string; counter: number };
+import type {
+  OpId,
+  Operation,
+  JoinMessage,
+  SyncOpMessage,
+  SyncDoneMessage,
+} from "./protocol.gen";
 
-export type Operation = {
-  type: "insert" | "delete" | "cursor" | "sync";
-  docId: string;
-  siteId: string;
-  opId: OpId;
-  payload: unknown;
-  timestamp: number;
-  inverseOpId?: OpId;
-};
-
-export type JoinMessage = {
-  type: "join";
-  docId: string;
-  siteId: string;
-  knownClock: number;
-};
-
-export type SyncOpMessage = {
-  type: "sync_op";
-  docId: string;
-  target: string;
-  op: Operation;
-};
-
-export type SyncDoneMessage = {
-  type: "sync_done";
-  docId: string;
-  target: string;
-};
+export type {
+  OpId,
+  Operation,
+  InsertPayload,
+  DeletePayload,
+  CursorPayload,
+  JoinMessage,
+  SyncOpMessage,
+  SyncDoneMessage,
+  BatchMessage,
+  HelloMessage,
+  AckMessage,
+  ErrorMessage,
+  PresenceMessage,
+  PeerJoined,
+  PeerLeft,
+  RosterEntry,
+  RosterMessage,
+  SubscribeMessage,
+  UnsubscribeMessage,
+  SyncStatusMessage,
+  ClientMessage,
+  ServerMessage,
+  Feature,
+  ErrorCode,
+} from "./protocol.gen";
 
 export type InboundMessage =
   | Operation
@@ -37,6 +37,7 @@ export class CrdtClient {
       onPendingCountChange: () => this.config.onStateChange?.(),
       onJoinRequest: (join) => {
         for (const op of this.network.getOpLog()) {
+          if (op.opId.counter <= (join.known?.[op.opId.site] ?? -1)) continue;
           this.network.sendSyncOp(join.siteId, op);
         }
         this.network.sendSyncDone(join.siteId);
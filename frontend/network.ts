@@ -23,7 +23,6 @@ export type NetworkConfig = {
   url: string;
   docId: string;
   siteId: string;
-  knownClock?: number;
   onOp: (op: WireOperation, isFromSelf: boolean) => void;
   onSyncComplete?: () => void;
   onJoinRequest?: (join: JoinMessage) => void;
@@ -56,6 +55,8 @@ export class CollabNetwork {
   private reconnectTimerId: ReturnType<typeof setTimeout> | null = null;
   private connectionStatus: ConnectionStatus = "offline";
   private persistTimeoutId: ReturnType<typeof setTimeout> | null = null;
+  private epoch = "";
+  private lastSeq = 0;
 
   constructor(config: NetworkConfig) {
     this.config = config;
@@ -175,8 +176,13 @@ export class CollabNetwork {
       type: "join",
       docId: this.config.docId,
       siteId: this.config.siteId,
-      knownClock: this.config.knownClock ?? 0,
     };
+    const known = this.log.known();
+    if (Object.keys(known).length > 0) msg.known = known;
+    if (this.epoch !== "") {
+      msg.epoch = this.epoch;
+      msg.lastSeq = this.lastSeq;
+    }
     this.ws.send(JSON.stringify(msg));
   }
 
@@ -236,6 +242,20 @@ export class CollabNetwork {
     persistOps(this.config.docId, this.log.getAll());
   }
 
+  private noteSeq(seq: number | undefined): void {
+    if (seq !== undefined && seq > this.lastSeq) this.lastSeq = seq;
+  }
+
+  // Seqs only compare within an epoch; a sync from a new one starts over.
+  private noteSyncDone(msg: SyncDoneMessage): void {
+    if (msg.epoch !== undefined && msg.epoch !== this.epoch) {
+      this.epoch = msg.epoch;
+      this.lastSeq = msg.seq ?? 0;
+      return;
+    }
+    this.noteSeq(msg.seq);
+  }
+
   private handleMessage(data: string | ArrayBuffer | Blob): void {
     if (typeof data !== "string") return;
     const raw = data;
@@ -248,6 +268,7 @@ export class CollabNetwork {
         break;
       case "sync_op":
         this.clearSyncTimeout();
+        this.noteSeq(msg.op.seq);
         if (this.syncState.isSyncing()) {
           this.syncState.pushToBuffer(msg);
         } else if (this.replay) {
@@ -257,6 +278,7 @@ export class CollabNetwork {
         break;
       case "sync_done":
         this.clearSyncTimeout();
+        this.noteSyncDone(msg);
         if (this.syncState.isSyncing()) {
           const buffer = this.syncState.drainBuffer();
           const syncOps = buffer
@@ -286,6 +308,7 @@ export class CollabNetwork {
         }
         break;
       default:
+        if (isOperation(msg)) this.noteSeq(msg.seq);
         if (this.syncState.isSyncing() && isOperation(msg)) {
           this.syncState.pushToBuffer(msg);
         } else if (this.syncState.isLive() && this.replay && isOperation(msg)) {
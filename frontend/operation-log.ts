@@ -21,6 +21,20 @@ export class OperationLog {
     return this.ops;
   }
 
+  // known maps each site to the highest counter up to which the log holds
+  // every one of its ops, the version vector sent with a join.
+  known(): Record<string, number> {
+    const known: Record<string, number> = {};
+    for (const op of this.ops) {
+      const site = op.opId.site;
+      if (site in known) continue;
+      let counter = -1;
+      while (this.has({ site, counter: counter + 1 })) counter++;
+      if (counter >= 0) known[site] = counter;
+    }
+    return known;
+  }
+
   length(): number {
     return this.ops.length;
   }
@@ -0,0 +1,185 @@
+// Code generated by protogen from backend/internal/protocol. DO NOT EDIT.
+
+export const PROTOCOL_VERSION = 1;
+export const MIN_PROTOCOL_VERSION = 1;
+
+export type ErrorCode = "malformed" | "invalid_type" | "missing_doc_id" | "missing_site_id" | "missing_target" | "payload_too_large" | "empty_batch" | "batch_too_large" | "batch_mismatch" | "site_mismatch" | "site_changed" | "missing_version" | "unsupported_version" | "invalid_payload" | "presence_too_large" | "overloaded" | "too_many_subscriptions" | "rate_limited" | "room_full" | "store_unavailable";
+
+export type Feature = "batch" | "acks" | "presence" | "resend" | "subscriptions" | "sync_status" | "sessions" | "observe";
+
+export type LeftReason = "disconnected" | "dropped" | "unsubscribed";
+
+export type Subprotocol = "skepsi.cbor" | "skepsi.json";
+
+export type SyncState = "requested" | "retrying" | "failed";
+
+export type OpId = {
+  site: string;
+  counter: number;
+};
+
+export type InsertPayload = {
+  position: number[];
+  value: string;
+};
+
+export type DeletePayload = {
+  position: number[];
+};
+
+export type CursorPayload = {
+  position: number[];
+};
+
+export type Operation = {
+  type: "insert" | "delete" | "cursor" | "sync";
+  docId: string;
+  siteId: string;
+  opId: OpId;
+  payload: unknown;
+  timestamp: number;
+  inverseOpId?: OpId;
+  seq?: number;
+};
+
+export type JoinMessage = {
+  type: "join";
+  docId: string;
+  siteId: string;
+  known?: Record<string, number>;
+  epoch?: string;
+  lastSeq?: number;
+};
+
+export type SyncOpMessage = {
+  type: "sync_op";
+  docId: string;
+  target: string;
+  op: Operation;
+};
+
+export type SyncDoneMessage = {
+  type: "sync_done";
+  docId: string;
+  target: string;
+  seq?: number;
+  epoch?: string;
+};
+
+export type BatchMessage = {
+  type: "batch";
+  docId: string;
+  siteId: string;
+  ops: Operation[];
+};
+
+export type HelloMessage = {
+  type: "hello";
+  version: number;
+  minVersion?: number;
+  features: Feature[];
+  session?: string;
+  resumed?: boolean;
+};
+
+export type AckMessage = {
+  type: "ack";
+  docId: string;
+  opIds: OpId[];
+};
+
+export type ErrorMessage = {
+  type: "error";
+  code: ErrorCode;
+  message: string;
+  docId?: string;
+  opId?: OpId;
+};
+
+export type PresenceMessage = {
+  type: "presence";
+  docId: string;
+  siteId: string;
+  state: unknown;
+};
+
+export type PeerJoined = {
+  type: "peer_joined";
+  docId: string;
+  siteId: string;
+};
+
+export type PeerLeft = {
+  type: "peer_left";
+  docId: string;
+  siteId: string;
+  reason: LeftReason;
+};
+
+export type RosterEntry = {
+  siteId: string;
+  state?: unknown;
+};
+
+export type RosterMessage = {
+  type: "roster";
+  docId: string;
+  peers: RosterEntry[];
+};
+
+export type ResendMessage = {
+  type: "resend";
+  docId: string;
+  site: string;
+  from: number;
+  to: number;
+};
+
+export type SyncStatusMessage = {
+  type: "sync_status";
+  docId: string;
+  state: SyncState;
+  attempt: number;
+  ops: number;
+};
+
+export type SubscribeMessage = {
+  type: "subscribe";
+  docId: string;
+  siteId: string;
+  known?: Record<string, number>;
+  epoch?: string;
+  lastSeq?: number;
+};
+
+export type UnsubscribeMessage = {
+  type: "unsubscribe";
+  docId: string;
+};
+
+export type ClientMessage =
+  | Operation
+  | JoinMessage
+  | SyncOpMessage
+  | SyncDoneMessage
+  | BatchMessage
+  | HelloMessage
+  | PresenceMessage
+  | SubscribeMessage
+  | UnsubscribeMessage;
+
+export type ServerMessage =
+  | Operation
+  | JoinMessage
+  | SyncOpMessage
+  | SyncDoneMessage
+  | BatchMessage
+  | HelloMessage
+  | AckMessage
+  | ErrorMessage
+  | PresenceMessage
+  | PeerJoined
+  | PeerLeft
+  | RosterMessage
+  | ResendMessage
+  | SyncStatusMessage;
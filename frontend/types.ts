@@ -1,39 +1,40 @@
-export type Position = number[];
-
-export type OpId = { site: string; counter: number };
-
-export type InsertPayload = { position: number[]; value: string };
-export type DeletePayload = { position: number[] };
+import type {
+  OpId,
+  Operation,
+  JoinMessage,
+  SyncOpMessage,
+  SyncDoneMessage,
+} from "./protocol.gen";
+
+export type {
+  OpId,
+  InsertPayload,
+  DeletePayload,
+  CursorPayload,
+  JoinMessage,
+  SyncOpMessage,
+  SyncDoneMessage,
+  BatchMessage,
+  HelloMessage,
+  AckMessage,
+  ErrorMessage,
+  PresenceMessage,
+  PeerJoined,
+  PeerLeft,
+  RosterEntry,
+  RosterMessage,
+  SubscribeMessage,
+  UnsubscribeMessage,
+  SyncStatusMessage,
+  ClientMessage,
+  ServerMessage,
+  Feature,
+  ErrorCode,
+} from "./protocol.gen";
 
-export type WireOperation = {
-  type: "insert" | "delete" | "cursor" | "sync";
-  docId: string;
-  siteId: string;
-  opId: OpId;
-  payload: InsertPayload | DeletePayload | unknown;
-  timestamp: number;
-  inverseOpId?: OpId;
-};
-
-export type JoinMessage = {
-  type: "join";
-  docId: string;
-  siteId: string;
-  knownClock: number;
-};
-
-export type SyncOpMessage = {
-  type: "sync_op";
-  docId: string;
-  target: string;
-  op: WireOperation;
-};
+export type Position = number[];
 
-export type SyncDoneMessage = {
-  type: "sync_done";
-  docId: string;
-  target: string;
-};
+export type WireOperation = Operation;
 
 export type InboundMessage =
   | WireOperation